@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
+
+// APIKeyPrefix starts every API key, making leaked keys easy to spot
+const APIKeyPrefix = "lgk_"
+
+// GenerateAPIKey returns a new API key of the form lgk_<id>_<secret> along
+// with its id. The id is stored in clear to look the key up and to show which
+// key is which, only a hash of the whole key is stored.
+func GenerateAPIKey() (key, id string, err error) {
+	idBytes := make([]byte, 6)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", "", err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+
+	id = hex.EncodeToString(idBytes)
+	return APIKeyPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(secret), id, nil
+}
+
+// ParseAPIKey returns the id of an API key, or false if the key is not in the
+// lgk_<id>_<secret> form
+func ParseAPIKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, APIKeyPrefix)
+	if !ok {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(rest, "_")
+	if !ok || len(id) != 12 || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// HashAPIKey returns the hex encoded SHA-256 of an API key as stored in the
+// database. Keys are random enough that a plain hash is safe.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"context"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID uint
+	Email  string
+	// Login session of an access token
+	SessionID uint
+
+	// Set when the caller authenticated with an API key, which acts for the
+	// user who created it but may only call the methods in its scopes
+	APIKeyID uint
+	Scopes   []string
+}
+
+// ViaAPIKey reports whether the caller authenticated with an API key
+func (p *Principal) ViaAPIKey() bool {
+	return p.APIKeyID != 0
+}
+
+type principalKey struct{}
+
+// NewContext returns a copy of ctx carrying the principal
+func NewContext(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// FromContext returns the principal stored in ctx, if any
+func FromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok
+}
@@ -0,0 +1,110 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var (
+	// ErrInvalidToken is returned for tokens that are malformed or not signed
+	// by us
+	ErrInvalidToken = errors.New("invalid token")
+	// ErrTokenExpired is returned for well-formed tokens past their expiry
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// DefaultTokenTTL is how long access tokens stay valid unless configured
+const DefaultTokenTTL = 15 * time.Minute
+
+// TokenType is the token type reported to clients, who send tokens back in
+// an "authorization: Bearer <token>" header
+const TokenType = "Bearer"
+
+// Claims are the claims carried by access tokens. The subject is the user ID.
+type Claims struct {
+	Email string `json:"email"`
+	// Login session the token was issued for, tokens of revoked sessions are
+	// rejected
+	SessionID uint `json:"sid,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// UserID returns the user ID held in the subject claim
+func (c *Claims) UserID() (uint, error) {
+	id, err := strconv.ParseUint(c.Subject, 10, 64)
+	if err != nil || id == 0 {
+		return 0, ErrInvalidToken
+	}
+	return uint(id), nil
+}
+
+// TokenManager issues and verifies HS256 signed JWT access tokens
+type TokenManager struct {
+	secret []byte
+	issuer string
+	ttl    time.Duration
+}
+
+// NewTokenManager creates a token manager signing with secret. Tokens expire
+// ttl after being issued.
+func NewTokenManager(secret []byte, issuer string, ttl time.Duration) *TokenManager {
+	return &TokenManager{secret: secret, issuer: issuer, ttl: ttl}
+}
+
+// Issue returns a signed access token for the user's session along with its
+// expiry
+func (m *TokenManager) Issue(userID uint, email string, sessionID uint) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(m.ttl)
+
+	claims := Claims{
+		Email:     email,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    m.issuer,
+			Subject:   strconv.FormatUint(uint64(userID), 10),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(m.secret)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("sign token: %w", err)
+	}
+	return token, expiresAt, nil
+}
+
+// Verify checks the signature, issuer and expiry of a token and returns its
+// claims
+func (m *TokenManager) Verify(token string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) {
+		return m.secret, nil
+	},
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithIssuer(m.issuer),
+		jwt.WithExpirationRequired(),
+	)
+	if errors.Is(err, jwt.ErrTokenExpired) {
+		return nil, ErrTokenExpired
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if _, err := claims.UserID(); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Principal returns the caller described by the claims
+func (c *Claims) Principal() *Principal {
+	id, _ := c.UserID()
+	return &Principal{UserID: id, Email: c.Email, SessionID: c.SessionID}
+}
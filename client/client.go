@@ -4,16 +4,30 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"os"
 	"time"
 
+	"github.com/riskykurniawan15/learn-grpc/config"
 	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/tlsconfig"
+	"github.com/riskykurniawan15/learn-grpc/totp"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
 )
 
 func main() {
-	// Connect to gRPC server
-	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	cfg, err := config.LoadClient(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Connect to gRPC server, over TLS when any grpc.tls_* setting is given
+	creds, _, err := tlsconfig.ClientCredentials(cfg.GRPC.TLSFiles())
+	if err != nil {
+		log.Fatalf("Failed to load TLS settings: %v", err)
+	}
+
+	conn, err := grpc.Dial(cfg.GRPC.Addr, grpc.WithTransportCredentials(creds))
 	if err != nil {
 		log.Fatalf("Failed to connect: %v", err)
 	}
@@ -23,7 +37,7 @@ func main() {
 	client := proto.NewUserServiceClient(conn)
 
 	// Set timeout context
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
 	defer cancel()
 
 	fmt.Println("=== Go RPC User Service Test ===")
@@ -58,22 +72,54 @@ func main() {
 			createResp2.User.Id, createResp2.User.Name, createResp2.User.Email, createResp2.User.Age)
 	}
 
-	// Test 3: Get All Users
-	fmt.Println("\n3. Getting all users...")
-	allUsersResp, err := client.GetAllUsers(ctx, &proto.GetAllUsersRequest{})
+	// Test 3: Authenticate, the remaining calls need an access token
+	fmt.Println("\n3. Logging in as john@example.com...")
+	authResp, err := client.Authenticate(ctx, &proto.AuthenticateRequest{
+		Email:    "john@example.com",
+		Password: "password123",
+	})
+	if err != nil {
+		log.Fatalf("Authenticate failed: %v", err)
+	}
+	fmt.Printf("   Token expires at %s\n", authResp.ExpiresAt.AsTime().Format(time.RFC3339))
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", authResp.TokenType+" "+authResp.AccessToken)
+
+	// Listing and deleting users needs the admin role, which the admin key
+	// can grant
+	if adminKey := cfg.AdminAPIKey; adminKey != "" {
+		fmt.Println("   Granting admin role with ADMIN_API_KEY...")
+		keyCtx := metadata.AppendToOutgoingContext(ctx, "x-admin-key", adminKey)
+		if _, err := client.GrantRole(keyCtx, &proto.GrantRoleRequest{UserId: authResp.User.Id, Role: "admin"}); err != nil {
+			log.Printf("GrantRole failed: %v", err)
+		}
+
+		// Admins need TOTP for admin calls unless the server runs with
+		// REQUIRE_ADMIN_MFA=false, so enroll it with a code from the secret
+		fmt.Println("   Enrolling TOTP for the admin role...")
+		if err := enrollTOTP(ctx, client); err != nil {
+			log.Printf("Enrolling TOTP failed: %v", err)
+		}
+	}
+
+	// Test 4: List Users
+	fmt.Println("\n4. Listing users by name...")
+	listResp, err := client.ListUsers(ctx, &proto.ListUsersRequest{
+		PageSize: 10,
+		OrderBy:  "name",
+	})
 	if err != nil {
-		log.Printf("GetAllUsers failed: %v", err)
+		log.Printf("ListUsers failed: %v", err)
 	} else {
-		fmt.Printf("   Found %d users:\n", len(allUsersResp.Users))
-		for _, user := range allUsersResp.Users {
+		fmt.Printf("   Found %d of %d users:\n", len(listResp.Users), listResp.TotalSize)
+		for _, user := range listResp.Users {
 			fmt.Printf("     - ID: %d, Name: %s, Email: %s, Age: %d\n",
 				user.Id, user.Name, user.Email, user.Age)
 		}
 	}
 
-	// Test 4: Get User by ID
+	// Test 5: Get User by ID
 	if createResp != nil && createResp.Success {
-		fmt.Printf("\n4. Getting user with ID %d...\n", createResp.User.Id)
+		fmt.Printf("\n5. Getting user with ID %d...\n", createResp.User.Id)
 		getResp, err := client.GetUser(ctx, &proto.GetUserRequest{Id: createResp.User.Id})
 		if err != nil {
 			log.Printf("GetUser failed: %v", err)
@@ -82,8 +128,8 @@ func main() {
 				getResp.User.Id, getResp.User.Name, getResp.User.Email, getResp.User.Age)
 		}
 
-		// Test 5: Update User
-		fmt.Printf("\n5. Updating user with ID %d...\n", createResp.User.Id)
+		// Test 6: Update User
+		fmt.Printf("\n6. Updating user with ID %d...\n", createResp.User.Id)
 		updateResp, err := client.UpdateUser(ctx, &proto.UpdateUserRequest{
 			Id:   createResp.User.Id,
 			Name: "John Doe Updated",
@@ -96,9 +142,12 @@ func main() {
 				updateResp.User.Id, updateResp.User.Name, updateResp.User.Email, updateResp.User.Age)
 		}
 
-		// Test 6: Delete User
-		fmt.Printf("\n6. Deleting user with ID %d...\n", createResp.User.Id)
-		deleteResp, err := client.DeleteUser(ctx, &proto.DeleteUserRequest{Id: createResp.User.Id})
+	}
+
+	// Test 7: Delete the other user, deleting ourselves would end the session
+	if createResp2 != nil && createResp2.Success {
+		fmt.Printf("\n7. Deleting user with ID %d...\n", createResp2.User.Id)
+		deleteResp, err := client.DeleteUser(ctx, &proto.DeleteUserRequest{Id: createResp2.User.Id})
 		if err != nil {
 			log.Printf("DeleteUser failed: %v", err)
 		} else {
@@ -106,14 +155,14 @@ func main() {
 		}
 	}
 
-	// Test 7: Get All Users after deletion
-	fmt.Println("\n7. Getting all users after deletion...")
-	allUsersResp2, err := client.GetAllUsers(ctx, &proto.GetAllUsersRequest{})
+	// Test 8: List Users after deletion
+	fmt.Println("\n8. Listing users after deletion...")
+	listResp2, err := client.ListUsers(ctx, &proto.ListUsersRequest{PageSize: 10})
 	if err != nil {
-		log.Printf("GetAllUsers failed: %v", err)
+		log.Printf("ListUsers failed: %v", err)
 	} else {
-		fmt.Printf("   Found %d users:\n", len(allUsersResp2.Users))
-		for _, user := range allUsersResp2.Users {
+		fmt.Printf("   Found %d of %d users:\n", len(listResp2.Users), listResp2.TotalSize)
+		for _, user := range listResp2.Users {
 			fmt.Printf("     - ID: %d, Name: %s, Email: %s, Age: %d\n",
 				user.Id, user.Name, user.Email, user.Age)
 		}
@@ -121,3 +170,22 @@ func main() {
 
 	fmt.Println("\n=== Test completed ===")
 }
+
+// enrollTOTP enrolls TOTP for the logged in user, answering the confirmation
+// the way an authenticator app would
+func enrollTOTP(ctx context.Context, client proto.UserServiceClient) error {
+	enrollResp, err := client.EnrollTotp(ctx, &proto.EnrollTotpRequest{})
+	if err != nil {
+		return err
+	}
+	code, err := totp.Code(enrollResp.Secret, totp.Step(time.Now()))
+	if err != nil {
+		return err
+	}
+	confirmResp, err := client.ConfirmTotp(ctx, &proto.ConfirmTotpRequest{Code: code})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("   TOTP enrolled, %d recovery codes issued\n", len(confirmResp.RecoveryCodes))
+	return nil
+}
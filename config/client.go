@@ -0,0 +1,148 @@
+package config
+
+import (
+	"errors"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/tlsconfig"
+)
+
+// GRPCClient configures the connection to the gRPC server
+type GRPCClient struct {
+	Addr string `yaml:"addr" env:"GRPC_ADDR"`
+	// TLS is used when any of these is set
+	CAFile     string `yaml:"tls_ca_file" env:"GRPC_TLS_CA_FILE"`
+	CertFile   string `yaml:"tls_cert_file" env:"GRPC_TLS_CERT_FILE"`
+	KeyFile    string `yaml:"tls_key_file" env:"GRPC_TLS_KEY_FILE"`
+	ServerName string `yaml:"tls_server_name" env:"GRPC_TLS_SERVER_NAME"`
+}
+
+// TLSFiles returns the TLS settings for tlsconfig.ClientCredentials
+func (c GRPCClient) TLSFiles() tlsconfig.ClientFiles {
+	return tlsconfig.ClientFiles{
+		CAFile:     c.CAFile,
+		CertFile:   c.CertFile,
+		KeyFile:    c.KeyFile,
+		ServerName: c.ServerName,
+	}
+}
+
+func (c GRPCClient) validate() []error {
+	var errs []error
+	if c.Addr == "" {
+		errs = append(errs, errors.New("grpc.addr is required"))
+	}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, errors.New("grpc.tls_cert_file and grpc.tls_key_file must be set together"))
+	}
+	return errs
+}
+
+// Gateway configures the HTTP gateway
+type Gateway struct {
+	ListenAddr string `yaml:"listen_addr" env:"HTTP_LISTEN_ADDR"`
+	// Deadline of the gRPC call made for each HTTP request
+	RequestTimeout time.Duration `yaml:"request_timeout" env:"REQUEST_TIMEOUT"`
+	// How long in-flight requests may take to finish on SIGINT or SIGTERM
+	// before their connections are closed
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	GRPC            GRPCClient    `yaml:"grpc"`
+	TLS             GatewayTLS    `yaml:"tls"`
+}
+
+// GatewayTLS serves HTTPS when a key pair is given, requiring client
+// certificates issued by ClientCAFile when that is set too
+type GatewayTLS struct {
+	CertFile     string `yaml:"cert_file" env:"HTTP_TLS_CERT_FILE"`
+	KeyFile      string `yaml:"key_file" env:"HTTP_TLS_KEY_FILE"`
+	ClientCAFile string `yaml:"client_ca_file" env:"HTTP_TLS_CLIENT_CA_FILE"`
+	// How often these files and the gRPC client key pair are checked for
+	// changes
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"HTTP_TLS_RELOAD_INTERVAL"`
+}
+
+// Enabled reports whether a key pair is configured
+func (t GatewayTLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// DefaultGateway returns the settings used when nothing is configured
+func DefaultGateway() *Gateway {
+	return &Gateway{
+		ListenAddr:      ":8080",
+		RequestTimeout:  10 * time.Second,
+		ShutdownTimeout: 20 * time.Second,
+		GRPC:            GRPCClient{Addr: "localhost:50051"},
+		TLS:             GatewayTLS{ReloadInterval: tlsconfig.DefaultReloadInterval},
+	}
+}
+
+// LoadGateway loads the gateway config from the "gateway" section of the
+// config file, the environment and the command line arguments
+func LoadGateway(args []string) (*Gateway, error) {
+	cfg := DefaultGateway()
+	if err := load("http_server", cfg, args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid setting
+func (c *Gateway) Validate() error {
+	errs := c.GRPC.validate()
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen_addr is required"))
+	}
+	if c.RequestTimeout <= 0 {
+		errs = append(errs, errors.New("request_timeout must be positive"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		errs = append(errs, errors.New("tls.reload_interval must be positive"))
+	}
+	if c.TLS.Enabled() && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		errs = append(errs, errors.New("tls.cert_file and tls.key_file must be set together"))
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.Enabled() {
+		errs = append(errs, errors.New("tls.client_ca_file needs tls.cert_file and tls.key_file"))
+	}
+	return errors.Join(errs...)
+}
+
+// Client configures the example client
+type Client struct {
+	// Deadline of the whole test run
+	Timeout time.Duration `yaml:"timeout" env:"CLIENT_TIMEOUT"`
+	// Used to grant the logged in user the admin role when set
+	AdminAPIKey string     `yaml:"admin_api_key" env:"ADMIN_API_KEY" secret:"true"`
+	GRPC        GRPCClient `yaml:"grpc"`
+}
+
+// DefaultClient returns the settings used when nothing is configured
+func DefaultClient() *Client {
+	return &Client{
+		Timeout: 10 * time.Second,
+		GRPC:    GRPCClient{Addr: "localhost:50051"},
+	}
+}
+
+// LoadClient loads the client config from the "client" section of the config
+// file, the environment and the command line arguments
+func LoadClient(args []string) (*Client, error) {
+	cfg := DefaultClient()
+	if err := load("client", cfg, args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid setting
+func (c *Client) Validate() error {
+	errs := c.GRPC.validate()
+	if c.Timeout <= 0 {
+		errs = append(errs, errors.New("timeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
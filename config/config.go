@@ -0,0 +1,275 @@
+// Package config loads the settings of the gRPC server, the HTTP gateway and
+// the example client. Every setting has a default, which is overridden in
+// turn by the YAML config file, environment variables and command line flags.
+//
+// Settings are described by struct tags: yaml is the key in the binary's
+// section of the config file, env the environment variable, and secret marks
+// values that must not be printed. The flag name is the file key with dots
+// and underscores replaced by dashes, e.g. -auth-jwt-ttl for auth.jwt_ttl.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setting is a single configurable value inside a config struct
+type setting struct {
+	key    string
+	env    string
+	secret bool
+	value  reflect.Value
+}
+
+// flagName is the command line flag of the setting
+func (s *setting) flagName() string {
+	return strings.NewReplacer(".", "-", "_", "-").Replace(s.key)
+}
+
+// parse converts a value given in the environment or on the command line to
+// the type of the setting
+func (s *setting) parse(raw string) (reflect.Value, error) {
+	parsed := reflect.New(s.value.Type()).Elem()
+	typ := s.value.Type()
+
+	switch {
+	case typ == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return parsed, err
+		}
+		parsed.SetInt(int64(d))
+	case typ.Kind() == reflect.String:
+		parsed.SetString(raw)
+	case typ.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return parsed, err
+		}
+		parsed.SetBool(b)
+	case typ.Kind() >= reflect.Int && typ.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, typ.Bits())
+		if err != nil {
+			return parsed, err
+		}
+		parsed.SetInt(n)
+	case typ.Kind() >= reflect.Uint && typ.Kind() <= reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, typ.Bits())
+		if err != nil {
+			return parsed, err
+		}
+		parsed.SetUint(n)
+	case typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.String:
+		// Comma separated
+		list := reflect.MakeSlice(typ, 0, 0)
+		for _, entry := range strings.Split(raw, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				list = reflect.Append(list, reflect.ValueOf(entry))
+			}
+		}
+		parsed.Set(list)
+	default:
+		return parsed, fmt.Errorf("unsupported setting type %s", typ)
+	}
+	return parsed, nil
+}
+
+// String formats the current value, hiding secrets
+func (s *setting) String() string {
+	if s.secret {
+		if s.value.IsZero() {
+			return ""
+		}
+		return "[REDACTED]"
+	}
+	if s.value.Type() == durationType {
+		return time.Duration(s.value.Int()).String()
+	}
+	if s.value.Kind() == reflect.Slice {
+		parts := make([]string, s.value.Len())
+		for i := range parts {
+			parts[i] = s.value.Index(i).String()
+		}
+		return strings.Join(parts, ",")
+	}
+	return fmt.Sprint(s.value.Interface())
+}
+
+// settings lists the settings of a config struct, descending into nested
+// structs, in declaration order
+func settings(v reflect.Value, prefix string) []*setting {
+	var list []*setting
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			list = append(list, settings(v.Field(i), prefix+name+".")...)
+			continue
+		}
+		list = append(list, &setting{
+			key:    prefix + name,
+			env:    field.Tag.Get("env"),
+			secret: field.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return list
+}
+
+// flagValue collects a command line flag. It is only applied once the
+// config file and environment are loaded, so flags take precedence.
+type flagValue struct {
+	setting *setting
+	parsed  *reflect.Value
+}
+
+func (f *flagValue) String() string {
+	if f.setting == nil {
+		return ""
+	}
+	return f.setting.String()
+}
+
+func (f *flagValue) Set(raw string) error {
+	parsed, err := f.setting.parse(raw)
+	if err != nil {
+		return err
+	}
+	f.parsed = &parsed
+	return nil
+}
+
+// IsBoolFlag lets boolean settings be switched on with just -name
+func (f *flagValue) IsBoolFlag() bool {
+	return f.setting.value.Kind() == reflect.Bool
+}
+
+// validator is implemented by the config of each binary
+type validator interface {
+	Validate() error
+}
+
+// load fills cfg, holding the defaults, from its section of the config file,
+// the environment and the command line arguments, then validates it. The
+// file is named by -config or CONFIG_FILE. With -print-config the effective
+// config is printed and the program exits.
+func load(name string, cfg validator, args []string) error {
+	list := settings(reflect.ValueOf(cfg).Elem(), "")
+
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	path := fs.String("config", "", "YAML config file (env CONFIG_FILE)")
+	printOnly := fs.Bool("print-config", false, "print the effective config, secrets redacted, and exit")
+	flags := make([]*flagValue, len(list))
+	for i, s := range list {
+		flags[i] = &flagValue{setting: s}
+		usage := s.key
+		if s.env != "" {
+			usage += " (env " + s.env + ")"
+		}
+		fs.Var(flags[i], s.flagName(), usage)
+	}
+	fs.Parse(args)
+
+	if *path == "" {
+		*path = os.Getenv("CONFIG_FILE")
+	}
+	if *path != "" {
+		if err := readFile(*path, cfg); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range list {
+		if s.env == "" {
+			continue
+		}
+		raw := os.Getenv(s.env)
+		if raw == "" {
+			continue
+		}
+		parsed, err := s.parse(raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q: %w", s.env, raw, err)
+		}
+		s.value.Set(parsed)
+	}
+
+	for _, f := range flags {
+		if f.parsed != nil {
+			f.setting.value.Set(*f.parsed)
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if *printOnly {
+		fmt.Print(Redacted(cfg))
+		os.Exit(0)
+	}
+	return nil
+}
+
+// file is the layout of the config file, one section per binary
+type file struct {
+	Server  *Server  `yaml:"server"`
+	Gateway *Gateway `yaml:"gateway"`
+	Client  *Client  `yaml:"client"`
+}
+
+// readFile decodes the section of cfg from a config file. The other sections
+// are decoded too, so unknown keys, most likely typos, are rejected in all of
+// them.
+func readFile(path string, cfg validator) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+
+	doc := file{Server: DefaultServer(), Gateway: DefaultGateway(), Client: DefaultClient()}
+	switch c := cfg.(type) {
+	case *Server:
+		doc.Server = c
+	case *Gateway:
+		doc.Gateway = c
+	case *Client:
+		doc.Client = c
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Redacted formats the effective config one "key: value" line per setting,
+// replacing secrets with [REDACTED]
+func Redacted(cfg interface{}) string {
+	var b strings.Builder
+	for _, s := range settings(reflect.ValueOf(cfg).Elem(), "") {
+		b.WriteString("  " + s.key + ":")
+		if value := s.String(); value != "" {
+			b.WriteString(" " + value)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,219 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/lockout"
+)
+
+// writeConfig writes a config file and points CONFIG_FILE at it
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return path
+}
+
+func TestLoadServerPrecedence(t *testing.T) {
+	path := writeConfig(t, `
+server:
+  listen_addr: ":1000"
+  database_path: file.db
+  idempotency_ttl: 1h
+  shutdown_timeout: 5s
+`)
+	t.Setenv("CONFIG_FILE", path)
+	t.Setenv("DATABASE_PATH", "env.db")
+	t.Setenv("IDEMPOTENCY_TTL", "2h")
+
+	cfg, err := LoadServer([]string{"-idempotency-ttl", "3h"})
+	if err != nil {
+		t.Fatalf("LoadServer() error = %v", err)
+	}
+
+	tests := []struct {
+		setting string
+		got     interface{}
+		want    interface{}
+	}{
+		{"default", cfg.Auth.PasswordResetTTL, time.Hour},
+		{"file", cfg.ListenAddr, ":1000"},
+		{"file", cfg.ShutdownTimeout, 5 * time.Second},
+		{"env over file", cfg.DatabasePath, "env.db"},
+		{"flag over env and file", cfg.IdempotencyTTL, 3 * time.Hour},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadServerConfigFlag(t *testing.T) {
+	path := writeConfig(t, "server:\n  database_path: flag.db\n")
+	t.Setenv("CONFIG_FILE", writeConfig(t, "server:\n  database_path: env.db\n"))
+
+	cfg, err := LoadServer([]string{"-config", path})
+	if err != nil {
+		t.Fatalf("LoadServer() error = %v", err)
+	}
+	if cfg.DatabasePath != "flag.db" {
+		t.Errorf("DatabasePath = %q, want the file named by -config", cfg.DatabasePath)
+	}
+}
+
+func TestSettingParse(t *testing.T) {
+	var cfg struct {
+		Duration time.Duration
+		List     []string
+		Flag     bool
+		Count    int
+		Size     uint8
+	}
+	field := func(name string) *setting {
+		return &setting{key: name, value: reflect.ValueOf(&cfg).Elem().FieldByName(name)}
+	}
+
+	tests := []struct {
+		field string
+		raw   string
+		want  interface{}
+	}{
+		{"Duration", "1m30s", 90 * time.Second},
+		{"List", "10.0.0.0/8, ::1 ,,", []string{"10.0.0.0/8", "::1"}},
+		{"List", "", []string{}},
+		{"Flag", "true", true},
+		{"Count", "-3", -3},
+		{"Size", "255", uint8(255)},
+	}
+	for _, tt := range tests {
+		parsed, err := field(tt.field).parse(tt.raw)
+		if err != nil {
+			t.Errorf("parse %s %q error = %v", tt.field, tt.raw, err)
+			continue
+		}
+		if !reflect.DeepEqual(parsed.Interface(), tt.want) {
+			t.Errorf("parse %s %q = %#v, want %#v", tt.field, tt.raw, parsed.Interface(), tt.want)
+		}
+	}
+
+	for _, tt := range []struct{ field, raw string }{
+		{"Duration", "90"},
+		{"Flag", "maybe"},
+		{"Count", "ten"},
+		{"Size", "256"},
+	} {
+		if _, err := field(tt.field).parse(tt.raw); err == nil {
+			t.Errorf("parse %s %q succeeded, want an error", tt.field, tt.raw)
+		}
+	}
+}
+
+func TestLoadServerListFromEnv(t *testing.T) {
+	t.Setenv("CONFIG_FILE", "")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.1, 192.168.0.0/16")
+
+	cfg, err := LoadServer(nil)
+	if err != nil {
+		t.Fatalf("LoadServer() error = %v", err)
+	}
+	prefixes, err := cfg.TrustedProxyPrefixes()
+	if err != nil {
+		t.Fatalf("TrustedProxyPrefixes() error = %v", err)
+	}
+	if len(prefixes) != 2 || prefixes[0].String() != "10.0.0.1/32" || prefixes[1].String() != "192.168.0.0/16" {
+		t.Errorf("TrustedProxyPrefixes() = %v", prefixes)
+	}
+}
+
+func TestLoadRejectsInvalidValues(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+		want string
+	}{
+		{
+			name: "unknown key in own section",
+			file: "server:\n  listen_adress: \":1\"\n",
+			want: "field listen_adress not found",
+		},
+		{
+			name: "unknown key in another section",
+			file: "gateway:\n  request_timout: 1s\n",
+			want: "field request_timout not found",
+		},
+		{
+			name: "invalid env value",
+			env:  map[string]string{"IDEMPOTENCY_TTL": "soon"},
+			want: "invalid IDEMPOTENCY_TTL",
+		},
+		{
+			name: "invalid trusted proxy",
+			env:  map[string]string{"TRUSTED_PROXIES": "gateway"},
+			want: "trusted_proxies",
+		},
+		{
+			name: "negative drain delay",
+			env:  map[string]string{"SHUTDOWN_DRAIN_DELAY": "-1s"},
+			want: "shutdown_drain_delay must not be negative",
+		},
+		{
+			name: "lockout threshold before the delays start",
+			file: "server:\n  lockout:\n    account_threshold: 3\n    address_threshold: 20\n",
+			want: "lockout.address_threshold must be more than 20",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CONFIG_FILE", "")
+			if tt.file != "" {
+				t.Setenv("CONFIG_FILE", writeConfig(t, tt.file))
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			_, err := LoadServer(nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("LoadServer() error = %v, want it to mention %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLockoutDelaysMatchPolicies(t *testing.T) {
+	if accountDelayAfter != lockout.DefaultAccountPolicy.DelayAfter || addressDelayAfter != lockout.DefaultAddressPolicy.DelayAfter {
+		t.Errorf("delays start after %d and %d failures, lockout policies use %d and %d",
+			accountDelayAfter, addressDelayAfter, lockout.DefaultAccountPolicy.DelayAfter, lockout.DefaultAddressPolicy.DelayAfter)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	cfg := DefaultServer()
+	cfg.AdminAPIKey = "admin-secret"
+	cfg.Mail.SMTPUsername = "mailer"
+
+	out := Redacted(cfg)
+	for _, want := range []string{
+		"  admin_api_key: [REDACTED]\n",
+		"  auth.jwt_secret:\n",
+		"  mail.smtp_username: mailer\n",
+		"  idempotency_ttl: 24h0m0s\n",
+		"  trusted_proxies: 127.0.0.0/8,::1/128\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Redacted() is missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "admin-secret") {
+		t.Errorf("Redacted() shows a secret:\n%s", out)
+	}
+}
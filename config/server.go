@@ -0,0 +1,259 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/encryption"
+	"github.com/riskykurniawan15/learn-grpc/password"
+	"github.com/riskykurniawan15/learn-grpc/tlsconfig"
+)
+
+// Server configures the gRPC server
+type Server struct {
+	ListenAddr   string `yaml:"listen_addr" env:"GRPC_LISTEN_ADDR"`
+	DatabasePath string `yaml:"database_path" env:"DATABASE_PATH"`
+	// Key that allows PurgeUser and granting the first admin role
+	AdminAPIKey    string        `yaml:"admin_api_key" env:"ADMIN_API_KEY" secret:"true"`
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl" env:"IDEMPOTENCY_TTL"`
+	// Addresses or CIDR ranges whose x-forwarded-for metadata is trusted
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	// How long in-flight calls may take to finish on SIGINT or SIGTERM
+	// before they are cancelled
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	// How long to keep serving after health checks report NOT_SERVING, so
+	// load balancers stop routing new calls here before the server stops
+	// accepting them
+	ShutdownDrainDelay time.Duration `yaml:"shutdown_drain_delay" env:"SHUTDOWN_DRAIN_DELAY"`
+
+	Auth     Auth      `yaml:"auth"`
+	Argon2id Argon2id  `yaml:"argon2id"`
+	Lockout  Lockout   `yaml:"lockout"`
+	Mail     Mail      `yaml:"mail"`
+	TLS      ServerTLS `yaml:"tls"`
+}
+
+// Auth configures tokens, sessions and login requirements
+type Auth struct {
+	// At least 32 bytes. A random secret is used when empty, so tokens
+	// stop working on restart.
+	JWTSecret            string        `yaml:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	JWTTTL               time.Duration `yaml:"jwt_ttl" env:"JWT_TTL"`
+	RefreshTokenTTL      time.Duration `yaml:"refresh_token_ttl" env:"REFRESH_TOKEN_TTL"`
+	PasswordResetTTL     time.Duration `yaml:"password_reset_ttl" env:"PASSWORD_RESET_TTL"`
+	EmailVerificationTTL time.Duration `yaml:"email_verification_ttl" env:"EMAIL_VERIFICATION_TTL"`
+	RequireVerifiedEmail bool          `yaml:"require_verified_email" env:"REQUIRE_VERIFIED_EMAIL"`
+	RequireAdminMFA      bool          `yaml:"require_admin_mfa" env:"REQUIRE_ADMIN_MFA"`
+	// 32 bytes encoded in base64. A random key is used when empty, so
+	// authenticator apps enrolled before a restart stop working.
+	MFAEncryptionKey string `yaml:"mfa_encryption_key" env:"MFA_ENCRYPTION_KEY" secret:"true"`
+}
+
+// Argon2id sets the password hashing costs
+type Argon2id struct {
+	// Memory in KiB
+	Memory      uint32 `yaml:"memory" env:"ARGON2_MEMORY"`
+	Iterations  uint32 `yaml:"iterations" env:"ARGON2_ITERATIONS"`
+	Parallelism uint8  `yaml:"parallelism" env:"ARGON2_PARALLELISM"`
+}
+
+// Lockout sets the failed login limits
+type Lockout struct {
+	// Failures that lock out an account or a client address
+	AccountThreshold int           `yaml:"account_threshold" env:"LOCKOUT_ACCOUNT_THRESHOLD"`
+	AddressThreshold int           `yaml:"address_threshold" env:"LOCKOUT_ADDRESS_THRESHOLD"`
+	Duration         time.Duration `yaml:"duration" env:"LOCKOUT_DURATION"`
+}
+
+// The lockout thresholds have to be above the failures after which attempts
+// start being delayed, lockout.DefaultAccountPolicy.DelayAfter and
+// lockout.DefaultAddressPolicy.DelayAfter. They are repeated here rather than
+// imported so that the gateway and the client do not link the lockout
+// package and its database driver.
+const (
+	accountDelayAfter = 3
+	addressDelayAfter = 20
+)
+
+// Mail selects how emails are delivered: through SMTPAddr when set, else
+// appended to the Outbox file when set, else logged
+type Mail struct {
+	SMTPAddr     string `yaml:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	SMTPFrom     string `yaml:"smtp_from" env:"SMTP_FROM"`
+	Outbox       string `yaml:"outbox" env:"NOTIFY_OUTBOX"`
+}
+
+// ServerTLS serves gRPC over TLS when a key pair is given, requiring client
+// certificates issued by ClientCAFile when that is set too
+type ServerTLS struct {
+	CertFile       string        `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile        string        `yaml:"key_file" env:"TLS_KEY_FILE"`
+	ClientCAFile   string        `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"TLS_RELOAD_INTERVAL"`
+}
+
+// Enabled reports whether a key pair is configured
+func (t ServerTLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// DefaultServer returns the settings used when nothing is configured
+func DefaultServer() *Server {
+	return &Server{
+		ListenAddr:     ":50051",
+		DatabasePath:   "users.db",
+		IdempotencyTTL: 24 * time.Hour,
+		// The HTTP gateway running on the same host
+		TrustedProxies:     []string{"127.0.0.0/8", "::1/128"},
+		ShutdownTimeout:    20 * time.Second,
+		ShutdownDrainDelay: 5 * time.Second,
+		Auth: Auth{
+			JWTTTL:               auth.DefaultTokenTTL,
+			RefreshTokenTTL:      30 * 24 * time.Hour,
+			PasswordResetTTL:     time.Hour,
+			EmailVerificationTTL: 24 * time.Hour,
+			RequireAdminMFA:      true,
+		},
+		Argon2id: Argon2id{
+			Memory:      password.DefaultArgon2idParams.Memory,
+			Iterations:  password.DefaultArgon2idParams.Iterations,
+			Parallelism: password.DefaultArgon2idParams.Parallelism,
+		},
+		Lockout: Lockout{
+			AccountThreshold: 10,
+			AddressThreshold: 100,
+			Duration:         15 * time.Minute,
+		},
+		TLS: ServerTLS{ReloadInterval: tlsconfig.DefaultReloadInterval},
+	}
+}
+
+// LoadServer loads the server config from the "server" section of the
+// config file, the environment and the command line arguments
+func LoadServer(args []string) (*Server, error) {
+	cfg := DefaultServer()
+	if err := load("server", cfg, args); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid setting
+func (c *Server) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if c.ListenAddr == "" {
+		fail("listen_addr is required")
+	}
+	if c.DatabasePath == "" {
+		fail("database_path is required")
+	}
+	if _, err := c.TrustedProxyPrefixes(); err != nil {
+		fail("trusted_proxies: %v", err)
+	}
+
+	for _, d := range []struct {
+		key   string
+		value time.Duration
+	}{
+		{"idempotency_ttl", c.IdempotencyTTL},
+		{"shutdown_timeout", c.ShutdownTimeout},
+		{"auth.jwt_ttl", c.Auth.JWTTTL},
+		{"auth.refresh_token_ttl", c.Auth.RefreshTokenTTL},
+		{"auth.password_reset_ttl", c.Auth.PasswordResetTTL},
+		{"auth.email_verification_ttl", c.Auth.EmailVerificationTTL},
+		{"lockout.duration", c.Lockout.Duration},
+		{"tls.reload_interval", c.TLS.ReloadInterval},
+	} {
+		if d.value <= 0 {
+			fail("%s must be positive", d.key)
+		}
+	}
+
+	if c.ShutdownDrainDelay < 0 {
+		fail("shutdown_drain_delay must not be negative")
+	}
+
+	if c.Auth.JWTSecret != "" && len(c.Auth.JWTSecret) < 32 {
+		fail("auth.jwt_secret must be at least 32 bytes")
+	}
+	if c.Auth.MFAEncryptionKey != "" {
+		if _, err := c.Auth.MFAKey(); err != nil {
+			fail("auth.mfa_encryption_key must be %d bytes encoded in base64", encryption.KeySize)
+		}
+	}
+
+	if c.Argon2id.Memory == 0 || c.Argon2id.Iterations == 0 || c.Argon2id.Parallelism == 0 {
+		fail("argon2id memory, iterations and parallelism must be positive")
+	} else if c.Argon2id.Memory < 8*uint32(c.Argon2id.Parallelism) {
+		// argon2 needs at least 8 KiB of memory per lane
+		fail("argon2id.memory must be at least %d KiB", 8*uint32(c.Argon2id.Parallelism))
+	}
+
+	if c.Lockout.AccountThreshold <= accountDelayAfter {
+		fail("lockout.account_threshold must be more than %d", accountDelayAfter)
+	}
+	if c.Lockout.AddressThreshold <= addressDelayAfter {
+		fail("lockout.address_threshold must be more than %d", addressDelayAfter)
+	}
+
+	if (c.Mail.SMTPUsername != "" || c.Mail.SMTPPassword != "" || c.Mail.SMTPFrom != "") && c.Mail.SMTPAddr == "" {
+		fail("mail.smtp_addr is required by the other SMTP settings")
+	}
+
+	if c.TLS.Enabled() && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		fail("tls.cert_file and tls.key_file must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && !c.TLS.Enabled() {
+		fail("tls.client_ca_file needs tls.cert_file and tls.key_file")
+	}
+
+	return errors.Join(errs...)
+}
+
+// TrustedProxyPrefixes parses TrustedProxies, where single addresses stand
+// for a prefix of their full length
+func (c *Server) TrustedProxyPrefixes() ([]netip.Prefix, error) {
+	proxies := []netip.Prefix{}
+	for _, entry := range c.TrustedProxies {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(entry)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid entry %q", entry)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		proxies = append(proxies, prefix)
+	}
+	return proxies, nil
+}
+
+// MFAKey decodes MFAEncryptionKey, nil when it is not set
+func (a Auth) MFAKey() ([]byte, error) {
+	if a.MFAEncryptionKey == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(a.MFAEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != encryption.KeySize {
+		return nil, fmt.Errorf("key is %d bytes, expected %d", len(key), encryption.KeySize)
+	}
+	return key, nil
+}
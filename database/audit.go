@@ -0,0 +1,28 @@
+package database
+
+import "log"
+
+// auditTriggers make audit_events append-only, so entries cannot be altered
+// or removed through the application
+var auditTriggers = []string{
+	`CREATE TRIGGER IF NOT EXISTS audit_events_no_update BEFORE UPDATE ON audit_events
+BEGIN
+  SELECT RAISE(ABORT, 'audit events are immutable');
+END`,
+	`CREATE TRIGGER IF NOT EXISTS audit_events_no_delete BEFORE DELETE ON audit_events
+BEGIN
+  SELECT RAISE(ABORT, 'audit events are immutable');
+END`,
+}
+
+// setupAuditLog installs the triggers keeping audit_events append-only
+func setupAuditLog() {
+	if DB.Dialector.Name() != "sqlite" {
+		return
+	}
+	for _, ddl := range auditTriggers {
+		if err := DB.Exec(ddl).Error; err != nil {
+			log.Fatal("Failed to set up audit log:", err)
+		}
+	}
+}
@@ -10,19 +10,32 @@ import (
 
 var DB *gorm.DB
 
-// InitDatabase initializes the database connection
-func InitDatabase() {
+// InitDatabase opens the SQLite database at path, creating it if needed, and
+// migrates the schema
+func InitDatabase(path string) {
 	var err error
-	DB, err = gorm.Open(sqlite.Open("users.db"), &gorm.Config{})
+	DB, err = gorm.Open(sqlite.Open(path), &gorm.Config{})
 	if err != nil {
 		log.Fatal("Failed to connect to database:", err)
 	}
 
 	// Auto migrate the schema
-	err = DB.AutoMigrate(&models.User{})
+	err = DB.AutoMigrate(&models.User{}, &models.UserEvent{}, &models.IdempotencyRecord{}, &models.UserRole{}, &models.AuditEvent{}, &models.PasswordResetToken{}, &models.APIKey{}, &models.LoginThrottle{}, &models.EmailVerificationToken{}, &models.Session{}, &models.RefreshToken{}, &models.TOTPCredential{}, &models.RecoveryCode{}, &models.MFAChallenge{})
 	if err != nil {
 		log.Fatal("Failed to migrate database:", err)
 	}
 
+	setupUserSearch()
+	setupAuditLog()
+
 	log.Println("Database connected and migrated successfully")
 }
+
+// Close closes the connection pool, waiting for queries in progress
+func Close() error {
+	sqlDB, err := DB.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
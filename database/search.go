@@ -0,0 +1,92 @@
+package database
+
+import (
+	"log"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// UserSearchFTS reports whether users are searched through the users_fts
+// FTS5 index. It is false on databases other than SQLite and when the SQLite
+// driver was built without FTS5 (go-sqlite3 needs the sqlite_fts5 build tag),
+// in which case searches fall back to LIKE.
+var UserSearchFTS bool
+
+// Triggers keeping users_fts in sync with the users table. Soft deletes only
+// touch deleted_at, so soft-deleted users stay indexed and are filtered out
+// when searching.
+var userSearchTriggers = map[string]string{
+	"users_fts_ai": `CREATE TRIGGER users_fts_ai AFTER INSERT ON users BEGIN
+  INSERT INTO users_fts(rowid, name, email) VALUES (new.id, new.name, new.email);
+END`,
+	"users_fts_ad": `CREATE TRIGGER users_fts_ad AFTER DELETE ON users BEGIN
+  INSERT INTO users_fts(users_fts, rowid, name, email) VALUES ('delete', old.id, old.name, old.email);
+END`,
+	"users_fts_au": `CREATE TRIGGER users_fts_au AFTER UPDATE OF name, email ON users BEGIN
+  INSERT INTO users_fts(users_fts, rowid, name, email) VALUES ('delete', old.id, old.name, old.email);
+  INSERT INTO users_fts(rowid, name, email) VALUES (new.id, new.name, new.email);
+END`,
+}
+
+// setupUserSearch creates the users_fts index when the database supports it
+func setupUserSearch() {
+	UserSearchFTS = false
+	if DB.Dialector.Name() != "sqlite" {
+		return
+	}
+
+	// The statement is expected to fail without FTS5, so keep it out of the
+	// query log and report the fallback below instead
+	quiet := DB.Session(&gorm.Session{Logger: logger.Default.LogMode(logger.Silent)})
+	err := quiet.Exec(`CREATE VIRTUAL TABLE IF NOT EXISTS users_fts USING fts5(
+  name, email,
+  content='users', content_rowid='id',
+  tokenize='unicode61 remove_diacritics 2'
+)`).Error
+	if err == nil {
+		// CREATE ... IF NOT EXISTS skips the module lookup when the table
+		// already exists, so read from it to be sure FTS5 is available
+		err = quiet.Exec("SELECT rowid FROM users_fts LIMIT 0").Error
+	}
+	if err != nil {
+		// Triggers left over from an FTS5-enabled build would make every
+		// write to users fail, so drop them before falling back to LIKE
+		dropUserSearchTriggers()
+		log.Printf("Full-text search unavailable, falling back to LIKE: %v", err)
+		return
+	}
+
+	// A missing trigger means the index may have missed writes, so rebuild
+	// it from the users table once the triggers are in place
+	rebuild := false
+	for name, ddl := range userSearchTriggers {
+		var count int64
+		if err := DB.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name = ?", name).Scan(&count).Error; err != nil {
+			log.Fatal("Failed to set up user search:", err)
+		}
+		if count > 0 {
+			continue
+		}
+		if err := DB.Exec(ddl).Error; err != nil {
+			log.Fatal("Failed to set up user search:", err)
+		}
+		rebuild = true
+	}
+
+	if rebuild {
+		if err := DB.Exec("INSERT INTO users_fts(users_fts) VALUES ('rebuild')").Error; err != nil {
+			log.Fatal("Failed to build user search index:", err)
+		}
+	}
+
+	UserSearchFTS = true
+}
+
+func dropUserSearchTriggers() {
+	for name := range userSearchTriggers {
+		if err := DB.Exec("DROP TRIGGER IF EXISTS " + name).Error; err != nil {
+			log.Printf("Failed to drop trigger %s: %v", name, err)
+		}
+	}
+}
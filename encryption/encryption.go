@@ -0,0 +1,75 @@
+// Package encryption encrypts secrets the service has to read back later,
+// such as TOTP secrets, before they are stored. Secrets that only need to be
+// compared, like passwords and tokens, are hashed instead.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// KeySize is the key length in bytes, selecting AES-256
+const KeySize = 32
+
+// version prefixes sealed values so the format can change later
+const version = "v1."
+
+// ErrInvalidCiphertext is returned for values that were not sealed with the
+// key, were sealed for different associated data or were modified
+var ErrInvalidCiphertext = errors.New("invalid ciphertext")
+
+// Cipher seals and opens values with AES-256-GCM
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+// NewCipher creates a cipher using a KeySize byte key
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, errors.New("encryption key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Seal encrypts plaintext. The associated data, e.g. the ID of the row the
+// value is stored in, is not stored but must be passed again to Open, so a
+// sealed value cannot be copied to another row.
+func (c *Cipher) Seal(plaintext string, associatedData []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), associatedData)
+	return version + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value produced by Seal
+func (c *Cipher) Open(sealed string, associatedData []byte) (string, error) {
+	encoded, ok := strings.CutPrefix(sealed, version)
+	if !ok {
+		return "", ErrInvalidCiphertext
+	}
+	data, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(data) < c.aead.NonceSize() {
+		return "", ErrInvalidCiphertext
+	}
+
+	nonce, ciphertext := data[:c.aead.NonceSize()], data[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, associatedData)
+	if err != nil {
+		return "", ErrInvalidCiphertext
+	}
+	return string(plaintext), nil
+}
@@ -0,0 +1,104 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func newTestCipher(t *testing.T, fill byte) *Cipher {
+	t.Helper()
+	c, err := NewCipher(bytes.Repeat([]byte{fill}, KeySize))
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+	return c
+}
+
+func TestNewCipherKeySize(t *testing.T) {
+	for _, size := range []int{0, 16, 24, 31, 33} {
+		if _, err := NewCipher(make([]byte, size)); err == nil {
+			t.Errorf("NewCipher() accepted a %d byte key", size)
+		}
+	}
+}
+
+func TestSealOpenRoundTrip(t *testing.T) {
+	c := newTestCipher(t, 1)
+	ad := []byte("user:1")
+
+	for _, plaintext := range []string{"", "JBSWY3DPEHPK3PXP", strings.Repeat("x", 1000)} {
+		sealed, err := c.Seal(plaintext, ad)
+		if err != nil {
+			t.Fatalf("Seal() error = %v", err)
+		}
+		if !strings.HasPrefix(sealed, version) {
+			t.Errorf("Seal() = %q, want the %q prefix", sealed, version)
+		}
+		if plaintext != "" && strings.Contains(sealed, plaintext) {
+			t.Errorf("Seal() = %q contains the plaintext", sealed)
+		}
+
+		opened, err := c.Open(sealed, ad)
+		if err != nil {
+			t.Fatalf("Open() error = %v", err)
+		}
+		if opened != plaintext {
+			t.Errorf("Open() = %q, want %q", opened, plaintext)
+		}
+	}
+}
+
+func TestSealUsesFreshNonces(t *testing.T) {
+	c := newTestCipher(t, 1)
+	first, _ := c.Seal("secret", nil)
+	second, _ := c.Seal("secret", nil)
+	if first == second {
+		t.Error("sealing the same value twice gave the same ciphertext")
+	}
+}
+
+func TestOpenRejectsTampering(t *testing.T) {
+	c := newTestCipher(t, 1)
+	ad := []byte("user:1")
+	sealed, err := c.Seal("JBSWY3DPEHPK3PXP", ad)
+	if err != nil {
+		t.Fatalf("Seal() error = %v", err)
+	}
+
+	data, _ := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(sealed, version))
+	flip := func(i int) string {
+		modified := bytes.Clone(data)
+		modified[i] ^= 0x01
+		return version + base64.RawStdEncoding.EncodeToString(modified)
+	}
+
+	tests := []struct {
+		name   string
+		sealed string
+		ad     []byte
+		cipher *Cipher
+	}{
+		{"flipped nonce bit", flip(0), ad, c},
+		{"flipped ciphertext bit", flip(len(data) / 2), ad, c},
+		{"flipped tag bit", flip(len(data) - 1), ad, c},
+		{"truncated", version + base64.RawStdEncoding.EncodeToString(data[:len(data)-1]), ad, c},
+		{"shorter than a nonce", version + base64.RawStdEncoding.EncodeToString(data[:4]), ad, c},
+		{"other associated data", sealed, []byte("user:2"), c},
+		{"missing associated data", sealed, nil, c},
+		{"other key", sealed, ad, newTestCipher(t, 2)},
+		{"missing version", strings.TrimPrefix(sealed, version), ad, c},
+		{"unknown version", "v2." + strings.TrimPrefix(sealed, version), ad, c},
+		{"not base64", version + "!!!", ad, c},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened, err := tt.cipher.Open(tt.sealed, tt.ad)
+			if !errors.Is(err, ErrInvalidCiphertext) {
+				t.Errorf("Open() = %q, %v, want ErrInvalidCiphertext", opened, err)
+			}
+		})
+	}
+}
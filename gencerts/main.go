@@ -0,0 +1,172 @@
+// Command gencerts creates a local CA along with server and client
+// certificates issued by it, for trying TLS and mutual TLS in development and
+// tests. An existing CA in the output directory is reused, so running it
+// again rotates the server and client certificates only.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	out := flag.String("out", "certs", "directory to write the certificates to")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma separated DNS names and IPs of the server certificate")
+	client := flag.String("client", "learn-grpc-client", "common name of the client certificate")
+	validFor := flag.Duration("valid-for", 365*24*time.Hour, "validity of the server and client certificates")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		log.Fatalf("Failed to create %s: %v", *out, err)
+	}
+
+	ca, caKey, err := loadOrCreateCA(*out)
+	if err != nil {
+		log.Fatalf("Failed to prepare CA: %v", err)
+	}
+
+	server := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "learn-grpc-server"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range strings.Split(*hosts, ",") {
+		host = strings.TrimSpace(host)
+		if ip := net.ParseIP(host); ip != nil {
+			server.IPAddresses = append(server.IPAddresses, ip)
+		} else if host != "" {
+			server.DNSNames = append(server.DNSNames, host)
+		}
+	}
+	if err := issue(*out, "server", server, *validFor, ca, caKey); err != nil {
+		log.Fatalf("Failed to issue server certificate: %v", err)
+	}
+
+	clientCert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: *client},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if err := issue(*out, "client", clientCert, *validFor, ca, caKey); err != nil {
+		log.Fatalf("Failed to issue client certificate: %v", err)
+	}
+
+	fmt.Printf("Certificates written to %s:\n", *out)
+	for _, name := range []string{"ca.pem", "ca-key.pem", "server.pem", "server-key.pem", "client.pem", "client-key.pem"} {
+		fmt.Printf("  %s\n", filepath.Join(*out, name))
+	}
+}
+
+// loadOrCreateCA loads ca.pem and ca-key.pem from dir, creating a new CA
+// valid for ten years when they do not exist yet
+func loadOrCreateCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err == nil {
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, nil, errors.New("existing CA key is not an ECDSA key")
+		}
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Reusing CA from %s", certFile)
+		return cert, key, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "learn-grpc development CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	key, der, err := sign(template, 10*365*24*time.Hour, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeFiles(dir, "ca", der, key); err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// issue signs template with the CA and writes <name>.pem and <name>-key.pem
+func issue(dir, name string, template *x509.Certificate, validFor time.Duration, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	key, der, err := sign(template, validFor, ca, caKey)
+	if err != nil {
+		return err
+	}
+	return writeFiles(dir, name, der, key)
+}
+
+// sign creates a key and a certificate for it from template, self-signed
+// when parent is nil
+func sign(template *x509.Certificate, validFor time.Duration, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(validFor)
+
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, der, nil
+}
+
+// writeFiles writes a certificate and its key as PEM. Each file is written
+// to a temporary file first and renamed, so servers reloading certificates
+// never see a half written file.
+func writeFiles(dir, name string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(dir, name+"-key.pem"), "PRIVATE KEY", keyDER, 0o600); err != nil {
+		return err
+	}
+	return writePEM(filepath.Join(dir, name+".pem"), "CERTIFICATE", der, 0o644)
+}
+
+func writePEM(path, blockType string, der []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := os.WriteFile(tmp, data, perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
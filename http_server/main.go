@@ -2,193 +2,1402 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/riskykurniawan15/learn-grpc/config"
 	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/requestid"
+	"github.com/riskykurniawan15/learn-grpc/tlsconfig"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 type HTTPServer struct {
+	conn       *grpc.ClientConn
 	grpcClient proto.UserServiceClient
+	// Deadline of each gRPC call
+	requestTimeout time.Duration
+	// Set once shutdown starts, failing health checks
+	draining atomic.Bool
 }
 
 type CreateUserRequest struct {
-	Name  string `json:"name"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Age      int32  `json:"age"`
+}
+
+type UpdateUserRequest struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+	Age   int32  `json:"age,omitempty"`
+}
+
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type ConfirmPasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type VerifyMFARequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type DisableTOTPRequest struct {
+	Code   string `json:"code"`
+	UserID int64  `json:"user_id,omitempty"`
+}
+
+type RefreshSessionRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token"`
+}
+
+type ResendVerificationEmailRequest struct {
 	Email string `json:"email"`
-	Age   int32  `json:"age"`
 }
 
-type UpdateUserRequest struct {
-	Name  string `json:"name,omitempty"`
-	Email string `json:"email,omitempty"`
-	Age   int32  `json:"age,omitempty"`
+type CreateAPIKeyRequest struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// updatableFields lists the JSON keys accepted by PUT /users/{id}, which are
+// also the UpdateUser field mask paths
+var updatableFields = map[string]bool{
+	"name":  true,
+	"email": true,
+	"age":   true,
+}
+
+type Response struct {
+	Success    bool         `json:"success"`
+	Message    string       `json:"message"`
+	Data       interface{}  `json:"data,omitempty"`
+	Pagination *Pagination  `json:"pagination,omitempty"`
+	Errors     []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is one entry of the errors array returned when validation fails
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+type Pagination struct {
+	NextPageToken string `json:"next_page_token,omitempty"`
+	TotalSize     int64  `json:"total_size"`
+}
+
+// forwardedHeaders maps HTTP request headers to the gRPC metadata keys they
+// are passed on as
+var forwardedHeaders = map[string]string{
+	"Authorization":   "authorization",
+	"X-Api-Key":       "x-api-key",
+	"X-Admin-Key":     "x-admin-key",
+	"Idempotency-Key": "idempotency-key",
+	"X-Request-Id":    requestid.Metadata,
+}
+
+// requestContext creates the context for the gRPC call made on behalf of an
+// HTTP request, forwarding the headers the gRPC server understands
+func (s *HTTPServer) requestContext(r *http.Request) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.requestTimeout)
+
+	for header, key := range forwardedHeaders {
+		if value := r.Header.Get(header); value != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, key, value)
+		}
+	}
+
+	// Pass on who the client is. The server trusts the entry the gateway
+	// appends, entries sent by the client itself may be forged.
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		forwardedFor := host
+		if prior := r.Header.Get("X-Forwarded-For"); prior != "" {
+			forwardedFor = prior + ", " + host
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-for", forwardedFor)
+	}
+	if userAgent := r.Header.Get("User-Agent"); userAgent != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-forwarded-user-agent", userAgent)
+	}
+
+	return ctx, cancel
+}
+
+// protoJSONOptions renders proto messages with their proto field names, so
+// well-known types such as Timestamp keep their canonical JSON form
+var protoJSONOptions = protojson.MarshalOptions{UseProtoNames: true}
+
+// protoJSON renders a proto message for a JSON response, nil when unset
+func protoJSON(m protoreflect.ProtoMessage) json.RawMessage {
+	if m == nil || !m.ProtoReflect().IsValid() {
+		return nil
+	}
+
+	data, err := protoJSONOptions.Marshal(m)
+	if err != nil {
+		log.Printf("Failed to encode %s: %v", m.ProtoReflect().Descriptor().FullName(), err)
+		return nil
+	}
+	return data
+}
+
+// protoJSONList renders a list of proto messages for a JSON response
+func protoJSONList[T protoreflect.ProtoMessage](items []T) []json.RawMessage {
+	list := make([]json.RawMessage, 0, len(items))
+	for _, item := range items {
+		if data := protoJSON(item); data != nil {
+			list = append(list, data)
+		}
+	}
+	return list
+}
+
+// writeError writes a failed gRPC call to the response. Validation failures
+// become a 400 listing every failing field in the errors array and version
+// conflicts a 412 carrying the current ETag.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	for _, detail := range st.Details() {
+		// Throttled logins, tell the client when to try again
+		if retry, ok := detail.(*errdetails.RetryInfo); ok {
+			seconds := int64(math.Ceil(retry.RetryDelay.AsDuration().Seconds()))
+			w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+			continue
+		}
+
+		// A stale If-Match, report the version the user is at now
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason == "VERSION_CONFLICT" {
+			w.Header().Set("ETag", formatETag(info.Metadata["current_version"]))
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusPreconditionFailed)
+			json.NewEncoder(w).Encode(Response{
+				Success: false,
+				Message: st.Message(),
+			})
+			return
+		}
+
+		badRequest, ok := detail.(*errdetails.BadRequest)
+		if !ok {
+			continue
+		}
+
+		response := Response{
+			Success: false,
+			Message: st.Message(),
+		}
+		for _, violation := range badRequest.FieldViolations {
+			response.Errors = append(response.Errors, FieldError{
+				Field:   violation.Field,
+				Rule:    violation.Reason,
+				Message: violation.Description,
+			})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	http.Error(w, safeMessage(w, st), httpStatus(st.Code()))
+}
+
+// safeMessage returns the message of a failed call that can be shown to the
+// client. Messages from the server are written to be shown, but errors raised
+// by the gRPC client itself, such as failing to dial the server, describe the
+// internal network, so those are only logged with the request ID.
+func safeMessage(w http.ResponseWriter, st *status.Status) string {
+	var message string
+	switch {
+	case st.Code() == codes.Unknown:
+		message = "Internal error"
+	case st.Code() == codes.Unavailable && len(st.Details()) == 0:
+		message = "Service unavailable, try again later"
+	default:
+		return st.Message()
+	}
+
+	id := w.Header().Get("X-Request-Id")
+	log.Printf("gRPC call failed [request %s]: %s: %s", id, st.Code(), st.Message())
+	return fmt.Sprintf("%s (request ID %s)", message, id)
+}
+
+// httpStatus maps a gRPC status code to the closest HTTP status
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Canceled:
+		return 499
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// setETag exposes the user version as a strong ETag
+func setETag(w http.ResponseWriter, user *proto.User) {
+	if user != nil {
+		w.Header().Set("ETag", formatETag(strconv.FormatInt(user.Version, 10)))
+	}
+}
+
+func formatETag(version string) string {
+	return `"` + version + `"`
+}
+
+// parseIfMatch turns an If-Match header holding a user ETag into the expected
+// version, 0 when the header is absent or "*"
+func parseIfMatch(r *http.Request) (int64, error) {
+	value := strings.TrimSpace(r.Header.Get("If-Match"))
+	if value == "" || value == "*" {
+		return 0, nil
+	}
+
+	version, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("Invalid If-Match header")
+	}
+	return version, nil
+}
+
+func NewHTTPServer(ctx context.Context, cfg *config.Gateway) *HTTPServer {
+	// Connect to gRPC server, over TLS when any grpc.tls_* setting is given
+	creds, reloader, err := tlsconfig.ClientCredentials(cfg.GRPC.TLSFiles())
+	if err != nil {
+		log.Fatalf("Failed to load gRPC client TLS settings: %v", err)
+	}
+	if reloader != nil {
+		go reloader.Watch(ctx, cfg.TLS.ReloadInterval)
+	}
+
+	conn, err := grpc.Dial(cfg.GRPC.Addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		log.Fatalf("Failed to connect to gRPC server: %v", err)
+	}
+
+	return &HTTPServer{
+		conn:           conn,
+		grpcClient:     proto.NewUserServiceClient(conn),
+		requestTimeout: cfg.RequestTimeout,
+	}
+}
+
+func (s *HTTPServer) createUser(w http.ResponseWriter, r *http.Request) {
+	var req CreateUserRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.CreateUser(ctx, &proto.CreateUserRequest{
+		Name:     req.Name,
+		Email:    req.Email,
+		Password: req.Password,
+		Age:      req.Age,
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.User),
+	}
+
+	setETag(w, resp.User)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) getUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.GetUser(ctx, &proto.GetUserRequest{Id: id})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.User),
+	}
+
+	setETag(w, resp.User)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) listUsers(w http.ResponseWriter, r *http.Request) {
+	req, err := parseListUsersQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.ListUsers(ctx, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSONList(resp.Users),
+		Pagination: &Pagination{
+			NextPageToken: resp.NextPageToken,
+			TotalSize:     resp.TotalSize,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseListUsersQuery maps the GET /users query parameters onto a ListUsersRequest
+func parseListUsersQuery(query url.Values) (*proto.ListUsersRequest, error) {
+	req := &proto.ListUsersRequest{
+		PageToken: query.Get("page_token"),
+		OrderBy:   query.Get("order_by"),
+		Filter: &proto.ListUsersFilter{
+			NamePrefix:  query.Get("name_prefix"),
+			EmailDomain: query.Get("email_domain"),
+		},
+	}
+
+	ints := map[string]*int32{
+		"page_size": &req.PageSize,
+		"min_age":   &req.Filter.MinAge,
+		"max_age":   &req.Filter.MaxAge,
+	}
+	for name, dst := range ints {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s", name)
+			}
+			*dst = int32(n)
+		}
+	}
+
+	times := map[string]**timestamppb.Timestamp{
+		"created_after":  &req.Filter.CreatedAfter,
+		"created_before": &req.Filter.CreatedBefore,
+	}
+	for name, dst := range times {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s, expected RFC 3339 timestamp", name)
+			}
+			*dst = timestamppb.New(t)
+		}
+	}
+
+	return req, nil
+}
+
+func (s *HTTPServer) listAuditEvents(w http.ResponseWriter, r *http.Request) {
+	req, err := parseListAuditEventsQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.ListAuditEvents(ctx, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success:    resp.Success,
+		Message:    resp.Message,
+		Data:       protoJSONList(resp.Events),
+		Pagination: &Pagination{NextPageToken: resp.NextPageToken},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseListAuditEventsQuery maps the GET /audit-events query parameters onto
+// a ListAuditEventsRequest
+func parseListAuditEventsQuery(query url.Values) (*proto.ListAuditEventsRequest, error) {
+	req := &proto.ListAuditEventsRequest{
+		PageToken: query.Get("page_token"),
+		Method:    query.Get("method"),
+		Action:    query.Get("action"),
+	}
+
+	if value := query.Get("page_size"); value != "" {
+		n, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid page_size")
+		}
+		req.PageSize = int32(n)
+	}
+
+	ids := map[string]*int64{
+		"actor_id":       &req.ActorId,
+		"target_user_id": &req.TargetUserId,
+	}
+	for name, dst := range ids {
+		if value := query.Get(name); value != "" {
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s", name)
+			}
+			*dst = n
+		}
+	}
+
+	times := map[string]**timestamppb.Timestamp{
+		"start_time": &req.StartTime,
+		"end_time":   &req.EndTime,
+	}
+	for name, dst := range times {
+		if value := query.Get(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid %s, expected RFC 3339 timestamp", name)
+			}
+			*dst = timestamppb.New(t)
+		}
+	}
+
+	return req, nil
+}
+
+func (s *HTTPServer) updateUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	expectedVersion, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	// Only the keys present in the body are updated, so they become the field mask
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	var req UpdateUserRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	updateMask := &fieldmaskpb.FieldMask{}
+	for field := range fields {
+		if !updatableFields[field] {
+			http.Error(w, fmt.Sprintf("Unknown field: %s", field), http.StatusBadRequest)
+			return
+		}
+		updateMask.Paths = append(updateMask.Paths, field)
+	}
+	if len(updateMask.Paths) == 0 {
+		http.Error(w, "No fields to update", http.StatusBadRequest)
+		return
+	}
+	sort.Strings(updateMask.Paths)
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.UpdateUser(ctx, &proto.UpdateUserRequest{
+		Id:              id,
+		Name:            req.Name,
+		Email:           req.Email,
+		Age:             req.Age,
+		UpdateMask:      updateMask,
+		ExpectedVersion: expectedVersion,
+	})
+
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.User),
+	}
+
+	setETag(w, resp.User)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	expectedVersion, err := parseIfMatch(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.DeleteUser(ctx, &proto.DeleteUserRequest{
+		Id:              id,
+		ExpectedVersion: expectedVersion,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) undeleteUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.UndeleteUser(ctx, &proto.UndeleteUserRequest{Id: id})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.User),
+	}
+
+	setETag(w, resp.User)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) listDeletedUsers(w http.ResponseWriter, r *http.Request) {
+	req := &proto.ListDeletedUsersRequest{PageToken: r.URL.Query().Get("page_token")}
+	if value := r.URL.Query().Get("page_size"); value != "" {
+		pageSize, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid page_size", http.StatusBadRequest)
+			return
+		}
+		req.PageSize = int32(pageSize)
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.ListDeletedUsers(ctx, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSONList(resp.Users),
+		Pagination: &Pagination{
+			NextPageToken: resp.NextPageToken,
+			TotalSize:     resp.TotalSize,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) searchUsers(w http.ResponseWriter, r *http.Request) {
+	req := &proto.SearchUsersRequest{Query: r.URL.Query().Get("q")}
+	if value := r.URL.Query().Get("page_size"); value != "" {
+		pageSize, err := strconv.ParseInt(value, 10, 32)
+		if err != nil {
+			http.Error(w, "Invalid page_size", http.StatusBadRequest)
+			return
+		}
+		req.PageSize = int32(pageSize)
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.SearchUsers(ctx, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSONList(resp.Results),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) purgeUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	idStr := vars["id"]
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.PurgeUser(ctx, &proto.PurgeUserRequest{Id: id})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) login(w http.ResponseWriter, r *http.Request) {
+	var req LoginRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.Authenticate(ctx, &proto.AuthenticateRequest{
+		Email:    req.Email,
+		Password: req.Password,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data: protoJSON(&proto.AuthenticateResponse{
+			AccessToken:           resp.AccessToken,
+			TokenType:             resp.TokenType,
+			ExpiresAt:             resp.ExpiresAt,
+			User:                  resp.User,
+			RefreshToken:          resp.RefreshToken,
+			RefreshTokenExpiresAt: resp.RefreshTokenExpiresAt,
+			SessionId:             resp.SessionId,
+			MfaRequired:           resp.MfaRequired,
+			MfaToken:              resp.MfaToken,
+			MfaTokenExpiresAt:     resp.MfaTokenExpiresAt,
+		}),
+	}
+
+	// Tokens must not end up in shared caches
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) verifyMFA(w http.ResponseWriter, r *http.Request) {
+	var req VerifyMFARequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.VerifyMfa(ctx, &proto.VerifyMfaRequest{
+		MfaToken: req.MFAToken,
+		Code:     req.Code,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data: protoJSON(&proto.AuthenticateResponse{
+			AccessToken:           resp.AccessToken,
+			TokenType:             resp.TokenType,
+			ExpiresAt:             resp.ExpiresAt,
+			User:                  resp.User,
+			RefreshToken:          resp.RefreshToken,
+			RefreshTokenExpiresAt: resp.RefreshTokenExpiresAt,
+			SessionId:             resp.SessionId,
+		}),
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) enrollTOTP(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.EnrollTotp(ctx, &proto.EnrollTotpRequest{})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data: map[string]interface{}{
+			"secret":      resp.Secret,
+			"otpauth_uri": resp.OtpauthUri,
+		},
+	}
+
+	// The secret must not end up in shared caches
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) confirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var req TOTPCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.ConfirmTotp(ctx, &proto.ConfirmTotpRequest{Code: req.Code})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data: map[string]interface{}{
+			"recovery_codes": resp.RecoveryCodes,
+			"user":           protoJSON(resp.User),
+		},
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) disableTOTP(w http.ResponseWriter, r *http.Request) {
+	var req DisableTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.DisableTotp(ctx, &proto.DisableTotpRequest{
+		Code:   req.Code,
+		UserId: req.UserID,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.User),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) refreshSession(w http.ResponseWriter, r *http.Request) {
+	var req RefreshSessionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.RefreshSession(ctx, &proto.RefreshSessionRequest{RefreshToken: req.RefreshToken})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data: protoJSON(&proto.RefreshSessionResponse{
+			AccessToken:           resp.AccessToken,
+			TokenType:             resp.TokenType,
+			ExpiresAt:             resp.ExpiresAt,
+			RefreshToken:          resp.RefreshToken,
+			RefreshTokenExpiresAt: resp.RefreshTokenExpiresAt,
+			Session:               resp.Session,
+		}),
+	}
+
+	// Tokens must not end up in shared caches
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-type Response struct {
-	Success bool        `json:"success"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+func (s *HTTPServer) changePassword(w http.ResponseWriter, r *http.Request) {
+	var req ChangePasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.ChangePassword(ctx, &proto.ChangePasswordRequest{
+		CurrentPassword: req.CurrentPassword,
+		NewPassword:     req.NewPassword,
+	})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-func NewHTTPServer() *HTTPServer {
-	// Connect to gRPC server
-	conn, err := grpc.Dial("localhost:50051", grpc.WithTransportCredentials(insecure.NewCredentials()))
+func (s *HTTPServer) requestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req PasswordResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.RequestPasswordReset(ctx, &proto.RequestPasswordResetRequest{Email: req.Email})
 	if err != nil {
-		log.Fatalf("Failed to connect to gRPC server: %v", err)
+		writeError(w, err)
+		return
 	}
 
-	return &HTTPServer{
-		grpcClient: proto.NewUserServiceClient(conn),
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
 	}
+
+	// The token is sent out of band, the request is only accepted here
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(response)
 }
 
-func (s *HTTPServer) createUser(w http.ResponseWriter, r *http.Request) {
-	var req CreateUserRequest
+func (s *HTTPServer) confirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req ConfirmPasswordResetRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := s.requestContext(r)
 	defer cancel()
 
-	resp, err := s.grpcClient.CreateUser(ctx, &proto.CreateUserRequest{
-		Name:  req.Name,
-		Email: req.Email,
-		Age:   req.Age,
+	resp, err := s.grpcClient.ConfirmPasswordReset(ctx, &proto.ConfirmPasswordResetRequest{
+		Token:       req.Token,
+		NewPassword: req.NewPassword,
 	})
-
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	response := Response{
 		Success: resp.Success,
 		Message: resp.Message,
-		Data:    resp.User,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *HTTPServer) getUser(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	idStr := vars["id"]
-	id, err := strconv.ParseInt(idStr, 10, 64)
+func (s *HTTPServer) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req VerifyEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.VerifyEmail(ctx, &proto.VerifyEmailRequest{Token: req.Token})
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.User),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) resendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	var req ResendVerificationEmailRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := s.requestContext(r)
 	defer cancel()
 
-	resp, err := s.grpcClient.GetUser(ctx, &proto.GetUserRequest{Id: id})
+	resp, err := s.grpcClient.ResendVerificationEmail(ctx, &proto.ResendVerificationEmailRequest{Email: req.Email})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	response := Response{
 		Success: resp.Success,
 		Message: resp.Message,
-		Data:    resp.User,
 	}
 
+	// The token is sent out of band, the request is only accepted here
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *HTTPServer) getAllUsers(w http.ResponseWriter, r *http.Request) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+func (s *HTTPServer) grantRole(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	var req RoleRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
 	defer cancel()
 
-	resp, err := s.grpcClient.GetAllUsers(ctx, &proto.GetAllUsersRequest{})
+	resp, err := s.grpcClient.GrantRole(ctx, &proto.GrantRoleRequest{UserId: id, Role: req.Role})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	response := Response{
 		Success: resp.Success,
 		Message: resp.Message,
-		Data:    resp.Users,
+		Data:    protoJSON(resp.User),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *HTTPServer) updateUser(w http.ResponseWriter, r *http.Request) {
+func (s *HTTPServer) revokeRole(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	idStr := vars["id"]
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
-	var req UpdateUserRequest
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.RevokeRole(ctx, &proto.RevokeRoleRequest{UserId: id, Role: vars["role"]})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.User),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	grpcReq := &proto.CreateApiKeyRequest{
+		Name:   req.Name,
+		Scopes: req.Scopes,
+	}
+	if req.ExpiresAt != nil {
+		grpcReq.ExpiresAt = timestamppb.New(*req.ExpiresAt)
+	}
+
+	ctx, cancel := s.requestContext(r)
 	defer cancel()
 
-	resp, err := s.grpcClient.UpdateUser(ctx, &proto.UpdateUserRequest{
-		Id:    id,
-		Name:  req.Name,
-		Email: req.Email,
-		Age:   req.Age,
-	})
+	resp, err := s.grpcClient.CreateApiKey(ctx, grpcReq)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data: protoJSON(&proto.CreateApiKeyResponse{
+			ApiKey: resp.ApiKey,
+			Key:    resp.Key,
+		}),
+	}
+
+	// The key is only shown once and must not end up in shared caches
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
 
+	resp, err := s.grpcClient.ListApiKeys(ctx, &proto.ListApiKeysRequest{})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	response := Response{
 		Success: resp.Success,
 		Message: resp.Message,
-		Data:    resp.User,
+		Data:    protoJSONList(resp.ApiKeys),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-func (s *HTTPServer) deleteUser(w http.ResponseWriter, r *http.Request) {
+func (s *HTTPServer) revokeAPIKey(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	idStr := vars["id"]
-	id, err := strconv.ParseInt(idStr, 10, 64)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid API key ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.RevokeApiKey(ctx, &proto.RevokeApiKeyRequest{Id: id})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.ApiKey),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) unlockUser(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
 	if err != nil {
 		http.Error(w, "Invalid user ID", http.StatusBadRequest)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.UnlockUser(ctx, &proto.UnlockUserRequest{Id: id})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.User),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	req := &proto.ListSessionsRequest{}
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		userID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		req.UserId = userID
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.ListSessions(ctx, req)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSONList(resp.Sessions),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) revokeSession(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid session ID", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := s.requestContext(r)
+	defer cancel()
+
+	resp, err := s.grpcClient.RevokeSession(ctx, &proto.RevokeSessionRequest{Id: id})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := Response{
+		Success: resp.Success,
+		Message: resp.Message,
+		Data:    protoJSON(resp.Session),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) revokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	req := &proto.RevokeAllSessionsRequest{}
+	if value := r.URL.Query().Get("user_id"); value != "" {
+		userID, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid user_id", http.StatusBadRequest)
+			return
+		}
+		req.UserId = userID
+	}
+	if value := r.URL.Query().Get("keep_current"); value != "" {
+		keepCurrent, err := strconv.ParseBool(value)
+		if err != nil {
+			http.Error(w, "Invalid keep_current", http.StatusBadRequest)
+			return
+		}
+		req.KeepCurrent = keepCurrent
+	}
+
+	ctx, cancel := s.requestContext(r)
 	defer cancel()
 
-	resp, err := s.grpcClient.DeleteUser(ctx, &proto.DeleteUserRequest{Id: id})
+	resp, err := s.grpcClient.RevokeAllSessions(ctx, req)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
 	response := Response{
 		Success: resp.Success,
 		Message: resp.Message,
+		Data: map[string]interface{}{
+			"revoked_count": resp.RevokedCount,
+		},
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -196,6 +1405,13 @@ func (s *HTTPServer) deleteUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *HTTPServer) healthCheck(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(Response{Success: false, Message: "HTTP server is shutting down"})
+		return
+	}
+
 	response := Response{
 		Success: true,
 		Message: "HTTP server is running",
@@ -210,7 +1426,17 @@ func (s *HTTPServer) healthCheck(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	server := NewHTTPServer()
+	cfg, err := config.LoadGateway(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Configuration:\n%s", config.Redacted(cfg))
+
+	// Cancelled on SIGINT or SIGTERM to start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := NewHTTPServer(ctx, cfg)
 
 	router := mux.NewRouter()
 
@@ -218,18 +1444,57 @@ func main() {
 	router.HandleFunc("/health", server.healthCheck).Methods("GET")
 
 	// User routes
+	router.HandleFunc("/auth/login", server.login).Methods("POST")
+	router.HandleFunc("/auth/mfa/verify", server.verifyMFA).Methods("POST")
+	router.HandleFunc("/auth/refresh", server.refreshSession).Methods("POST")
+	router.HandleFunc("/auth/password", server.changePassword).Methods("POST")
+	router.HandleFunc("/auth/password-reset", server.requestPasswordReset).Methods("POST")
+	router.HandleFunc("/auth/password-reset/confirm", server.confirmPasswordReset).Methods("POST")
+	router.HandleFunc("/auth/verify-email", server.verifyEmail).Methods("POST")
+	router.HandleFunc("/auth/verify-email/resend", server.resendVerificationEmail).Methods("POST")
+	router.HandleFunc("/auth/totp", server.enrollTOTP).Methods("POST")
+	router.HandleFunc("/auth/totp/confirm", server.confirmTOTP).Methods("POST")
+	router.HandleFunc("/auth/totp/disable", server.disableTOTP).Methods("POST")
 	router.HandleFunc("/users", server.createUser).Methods("POST")
-	router.HandleFunc("/users", server.getAllUsers).Methods("GET")
+	router.HandleFunc("/users", server.listUsers).Methods("GET")
+	router.HandleFunc("/users/deleted", server.listDeletedUsers).Methods("GET")
+	router.HandleFunc("/users/search", server.searchUsers).Methods("GET")
 	router.HandleFunc("/users/{id}", server.getUser).Methods("GET")
 	router.HandleFunc("/users/{id}", server.updateUser).Methods("PUT")
 	router.HandleFunc("/users/{id}", server.deleteUser).Methods("DELETE")
+	router.HandleFunc("/users/{id}/undelete", server.undeleteUser).Methods("POST")
+	router.HandleFunc("/users/{id}/purge", server.purgeUser).Methods("DELETE")
+	router.HandleFunc("/users/{id}/unlock", server.unlockUser).Methods("POST")
+	router.HandleFunc("/users/{id}/roles", server.grantRole).Methods("POST")
+	router.HandleFunc("/users/{id}/roles/{role}", server.revokeRole).Methods("DELETE")
+	router.HandleFunc("/api-keys", server.createAPIKey).Methods("POST")
+	router.HandleFunc("/api-keys", server.listAPIKeys).Methods("GET")
+	router.HandleFunc("/api-keys/{id}", server.revokeAPIKey).Methods("DELETE")
+	router.HandleFunc("/sessions", server.listSessions).Methods("GET")
+	router.HandleFunc("/sessions", server.revokeAllSessions).Methods("DELETE")
+	router.HandleFunc("/sessions/{id}", server.revokeSession).Methods("DELETE")
+	router.HandleFunc("/audit-events", server.listAuditEvents).Methods("GET")
+
+	// Tag every request with an ID, passed on to the gRPC server and returned
+	// to the client, so a response can be matched with the server logs and
+	// audit events. IDs sent by the client are kept if they are well formed.
+	router.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !requestid.Valid(r.Header.Get("X-Request-Id")) {
+				r.Header.Set("X-Request-Id", requestid.New())
+			}
+			w.Header().Set("X-Request-Id", r.Header.Get("X-Request-Id"))
+			next.ServeHTTP(w, r)
+		})
+	})
 
 	// CORS middleware
 	router.Use(func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Api-Key, X-Admin-Key, If-Match, Idempotency-Key, X-Request-Id")
+			w.Header().Set("Access-Control-Expose-Headers", "ETag, Retry-After, X-Request-Id")
 
 			if r.Method == "OPTIONS" {
 				w.WriteHeader(http.StatusOK)
@@ -240,15 +1505,107 @@ func main() {
 		})
 	})
 
-	port := ":8080"
+	httpServer := &http.Server{Addr: cfg.ListenAddr, Handler: router}
+	scheme := "http"
+	if tlsConfig := httpsConfig(ctx, cfg.TLS); tlsConfig != nil {
+		httpServer.TLSConfig = tlsConfig
+		scheme = "https"
+	}
+
+	port := httpServer.Addr
 	fmt.Printf("HTTP server starting on port %s...\n", port)
-	fmt.Printf("Health check: http://localhost%s/health\n", port)
+	fmt.Printf("Health check: %s://localhost%s/health\n", scheme, port)
 	fmt.Printf("API endpoints:\n")
+	fmt.Printf("  POST   /auth/login - Exchange email and password for an access token\n")
+	fmt.Printf("  POST   /auth/mfa/verify - Exchange an mfa_token and a TOTP or recovery code for tokens\n")
+	fmt.Printf("  POST   /auth/refresh - Exchange a refresh token for new tokens\n")
+	fmt.Printf("  POST   /auth/password - Change own password\n")
+	fmt.Printf("  POST   /auth/password-reset - Send a password reset token\n")
+	fmt.Printf("  POST   /auth/password-reset/confirm - Set a new password with a reset token\n")
+	fmt.Printf("  POST   /auth/verify-email - Verify email with a verification token\n")
+	fmt.Printf("  POST   /auth/verify-email/resend - Send a new verification token\n")
+	fmt.Printf("  POST   /auth/totp - Start TOTP enrollment, returns secret and otpauth URI\n")
+	fmt.Printf("  POST   /auth/totp/confirm - Enable TOTP with a code, returns recovery codes\n")
+	fmt.Printf("  POST   /auth/totp/disable - Disable TOTP (code, user_id for admins)\n")
 	fmt.Printf("  POST   /users     - Create user\n")
-	fmt.Printf("  GET    /users     - Get all users\n")
+	fmt.Printf("  GET    /users     - List users (page_size, page_token, order_by, min_age, max_age,\n")
+	fmt.Printf("                      name_prefix, email_domain, created_after, created_before)\n")
 	fmt.Printf("  GET    /users/{id} - Get user by ID\n")
 	fmt.Printf("  PUT    /users/{id} - Update user\n")
 	fmt.Printf("  DELETE /users/{id} - Delete user\n")
+	fmt.Printf("  GET    /users/deleted - List deleted users\n")
+	fmt.Printf("  GET    /users/search?q= - Search users by name or email\n")
+	fmt.Printf("  POST   /users/{id}/undelete - Restore deleted user\n")
+	fmt.Printf("  DELETE /users/{id}/purge - Permanently remove deleted user (X-Admin-Key)\n")
+	fmt.Printf("  POST   /users/{id}/unlock - Lift a failed login lockout (admin)\n")
+	fmt.Printf("  POST   /users/{id}/roles - Grant role (admin)\n")
+	fmt.Printf("  DELETE /users/{id}/roles/{role} - Revoke role (admin)\n")
+	fmt.Printf("  POST   /api-keys - Create API key, sent back as X-Api-Key\n")
+	fmt.Printf("  GET    /api-keys - List API keys\n")
+	fmt.Printf("  DELETE /api-keys/{id} - Revoke API key\n")
+	fmt.Printf("  GET    /sessions - List active sessions (user_id for admins)\n")
+	fmt.Printf("  DELETE /sessions - Revoke all sessions (user_id, keep_current)\n")
+	fmt.Printf("  DELETE /sessions/{id} - Revoke session\n")
+	fmt.Printf("  GET    /audit-events - List audit events (admin; actor_id, target_user_id, method,\n")
+	fmt.Printf("                         action, start_time, end_time, page_size, page_token)\n")
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if httpServer.TLSConfig != nil {
+			// The certificate comes from TLSConfig, which reloads it
+			serveErr <- httpServer.ListenAndServeTLS("", "")
+			return
+		}
+		serveErr <- httpServer.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process right away
+	stop()
+
+	server.shutdown(httpServer, cfg.ShutdownTimeout)
+}
+
+// shutdown stops accepting requests and waits until the timeout for the ones
+// in flight, whose gRPC calls are not tied to the client connection and run
+// to completion, then closes the gRPC connection
+func (s *HTTPServer) shutdown(httpServer *http.Server, timeout time.Duration) {
+	log.Printf("Shutting down, waiting up to %s for in-flight requests...", timeout)
+	s.draining.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown timeout reached, closing the remaining connections: %v", err)
+		httpServer.Close()
+	}
+
+	if err := s.conn.Close(); err != nil {
+		log.Printf("Failed to close gRPC connection: %v", err)
+	}
+	log.Println("HTTP server stopped")
+}
+
+// httpsConfig serves HTTPS with the configured key pair, requiring client
+// certificates issued by the client CA when it is set. The files are checked
+// for changes until ctx is done. Without a certificate nil is returned and
+// the gateway serves plain HTTP.
+func httpsConfig(ctx context.Context, cfg config.GatewayTLS) *tls.Config {
+	if !cfg.Enabled() {
+		return nil
+	}
 
-	log.Fatal(http.ListenAndServe(port, router))
+	reloader, err := tlsconfig.NewReloader(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+	if err != nil {
+		log.Fatalf("Failed to load HTTPS certificates: %v", err)
+	}
+	tlsCfg, err := tlsconfig.Server(reloader)
+	if err != nil {
+		log.Fatalf("Failed to configure HTTPS: %v", err)
+	}
+	go reloader.Watch(ctx, cfg.ReloadInterval)
+	return tlsCfg
 }
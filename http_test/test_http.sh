@@ -17,6 +17,7 @@ CREATE_RESPONSE=$(curl -s -X POST "$BASE_URL/users" \
   -d '{
     "name": "Bob Wilson",
     "email": "bob@example.com",
+    "password": "Passw0rd!",
     "age": 35
   }')
 echo $CREATE_RESPONSE | jq '.'
@@ -25,17 +26,45 @@ echo $CREATE_RESPONSE | jq '.'
 USER_ID=$(echo $CREATE_RESPONSE | jq -r '.data.id')
 echo "User ID: $USER_ID"
 
+# Log in, every other endpoint needs the access token
+echo -e "\n2️⃣ Login:"
+LOGIN_RESPONSE=$(curl -s -X POST "$BASE_URL/auth/login" \
+  -H "Content-Type: application/json" \
+  -d '{
+    "email": "bob@example.com",
+    "password": "Passw0rd!"
+  }')
+echo $LOGIN_RESPONSE | jq '.'
+AUTH_HEADER="Authorization: Bearer $(echo $LOGIN_RESPONSE | jq -r '.data.access_token')"
+
+# Listing and deleting users needs the admin role, which the admin key can
+# grant. Start the server with the same ADMIN_API_KEY. Admins also need TOTP
+# by default, which this script cannot answer, so start the server with
+# REQUIRE_ADMIN_MFA=false as well.
+echo -e "\n2️⃣ Grant Admin Role:"
+curl -s -X POST -H "$AUTH_HEADER" -H "X-Admin-Key: $ADMIN_API_KEY" "$BASE_URL/users/$USER_ID/roles" \
+  -H "Content-Type: application/json" \
+  -d '{"role": "admin"}' | jq '.'
+
 # Get all users
 echo -e "\n3️⃣ Get All Users:"
-curl -s "$BASE_URL/users" | jq '.'
+curl -s -H "$AUTH_HEADER" "$BASE_URL/users" | jq '.'
+
+# List users with filter and sorting
+echo -e "\n3️⃣ List Users (filtered):"
+curl -s -H "$AUTH_HEADER" "$BASE_URL/users?page_size=5&order_by=age%20desc&email_domain=example.com" | jq '.'
+
+# Search users by partial name or email
+echo -e "\n3️⃣ Search Users:"
+curl -s -H "$AUTH_HEADER" "$BASE_URL/users/search?q=bob" | jq '.'
 
 # Get user by ID
 echo -e "\n4️⃣ Get User by ID:"
-curl -s "$BASE_URL/users/$USER_ID" | jq '.'
+curl -s -H "$AUTH_HEADER" "$BASE_URL/users/$USER_ID" | jq '.'
 
 # Update user
 echo -e "\n5️⃣ Update User:"
-curl -s -X PUT "$BASE_URL/users/$USER_ID" \
+curl -s -X PUT -H "$AUTH_HEADER" "$BASE_URL/users/$USER_ID" \
   -H "Content-Type: application/json" \
   -d '{
     "name": "Bob Wilson Updated",
@@ -44,15 +73,15 @@ curl -s -X PUT "$BASE_URL/users/$USER_ID" \
 
 # Get updated user
 echo -e "\n6️⃣ Get Updated User:"
-curl -s "$BASE_URL/users/$USER_ID" | jq '.'
+curl -s -H "$AUTH_HEADER" "$BASE_URL/users/$USER_ID" | jq '.'
 
 # Delete user
 echo -e "\n7️⃣ Delete User:"
-curl -s -X DELETE "$BASE_URL/users/$USER_ID" | jq '.'
+curl -s -X DELETE -H "$AUTH_HEADER" "$BASE_URL/users/$USER_ID" | jq '.'
 
 # Verify deletion
 echo -e "\n8️⃣ Verify Deletion:"
-curl -s "$BASE_URL/users" | jq '.'
+curl -s -H "$AUTH_HEADER" "$BASE_URL/users" | jq '.'
 
 echo -e "\n✅ HTTP API testing completed!"
 
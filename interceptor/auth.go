@@ -0,0 +1,210 @@
+package interceptor
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// AuthorizationMetadata is the metadata key carrying "Bearer <token>"
+	AuthorizationMetadata = "authorization"
+
+	// APIKeyMetadata is the metadata key carrying an API key
+	APIKeyMetadata = "x-api-key"
+
+	// How stale the last used time of an API key may get, so that busy keys
+	// do not cause a write on every call
+	apiKeyLastUsedGranularity = time.Minute
+)
+
+// Access says who may call a method
+type Access int
+
+const (
+	// Public methods can be called without a token
+	Public Access = iota + 1
+	// Authenticated methods need a valid access token, or an API key whose
+	// scopes include the method
+	Authenticated
+)
+
+// AuthPolicy maps full method names, e.g.
+// proto.UserService_GetUser_FullMethodName, to who may call them. Methods
+// missing from the policy are denied to everyone.
+type AuthPolicy map[string]Access
+
+// Authenticator checks the access tokens and API keys of incoming calls
+// against a policy and puts the authenticated principal into the context
+type Authenticator struct {
+	tokens   *auth.TokenManager
+	apiKeys  *repository.APIKeyRepository
+	sessions *repository.SessionRepository
+	policy   AuthPolicy
+}
+
+// NewAuthenticator creates an authenticator verifying tokens with the token
+// manager and API keys against the database
+func NewAuthenticator(tokens *auth.TokenManager, policy AuthPolicy) *Authenticator {
+	return &Authenticator{
+		tokens:   tokens,
+		apiKeys:  repository.NewAPIKeyRepository(),
+		sessions: repository.NewSessionRepository(),
+		policy:   policy,
+	}
+}
+
+// UnaryServerInterceptor returns the interceptor to install on the gRPC server
+func (a *Authenticator) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := a.authorize(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns the interceptor to install on the gRPC server
+func (a *Authenticator) StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := a.authorize(stream.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+	}
+}
+
+// authorize applies the policy of a method to a call, returning the context
+// to run the call with
+func (a *Authenticator) authorize(ctx context.Context, fullMethod string) (context.Context, error) {
+	switch a.policy[fullMethod] {
+	case Public:
+		// Callers who do send credentials are still identified, so that for
+		// example an admin creating a user shows up as the actor in the
+		// audit log. Bad credentials are ignored rather than rejected.
+		md, _ := metadata.FromIncomingContext(ctx)
+		if len(md.Get(AuthorizationMetadata)) == 0 && len(md.Get(APIKeyMetadata)) == 0 {
+			return ctx, nil
+		}
+		if principal, err := a.authenticate(ctx); err == nil {
+			return auth.NewContext(ctx, principal), nil
+		}
+		return ctx, nil
+	case Authenticated:
+		principal, err := a.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if principal.ViaAPIKey() {
+			method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+			if !slices.Contains(principal.Scopes, method) {
+				return nil, status.Errorf(codes.PermissionDenied, "API key is not allowed to call %s", method)
+			}
+		}
+		return auth.NewContext(ctx, principal), nil
+	default:
+		return nil, status.Errorf(codes.PermissionDenied, "Method %s is not allowed by the access policy", fullMethod)
+	}
+}
+
+// authenticate verifies the bearer token or, without one, the API key sent
+// with a call
+func (a *Authenticator) authenticate(ctx context.Context) (*auth.Principal, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(AuthorizationMetadata)
+	if len(values) == 0 {
+		if keys := md.Get(APIKeyMetadata); len(keys) > 0 {
+			return a.authenticateAPIKey(ctx, keys[0])
+		}
+		return nil, status.Error(codes.Unauthenticated, "Missing access token, send it as \"authorization: Bearer <token>\" or an API key as \"x-api-key\"")
+	}
+
+	scheme, token, found := strings.Cut(values[0], " ")
+	if !found || !strings.EqualFold(scheme, auth.TokenType) || strings.TrimSpace(token) == "" {
+		return nil, status.Error(codes.Unauthenticated, "Authorization must use the Bearer scheme")
+	}
+
+	claims, err := a.tokens.Verify(strings.TrimSpace(token))
+	if errors.Is(err, auth.ErrTokenExpired) {
+		return nil, status.Error(codes.Unauthenticated, "Access token has expired")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "Invalid access token")
+	}
+
+	// Access tokens die with their session, so logging out takes effect
+	// before the token expires
+	if claims.SessionID != 0 {
+		active, err := a.sessions.IsActive(claims.SessionID, time.Now())
+		if err != nil {
+			return nil, rpcerror.Storage(ctx, "Failed to check session", err).Err()
+		}
+		if !active {
+			return nil, status.Error(codes.Unauthenticated, "Session has been revoked or has expired")
+		}
+	}
+	return claims.Principal(), nil
+}
+
+// authenticateAPIKey verifies an API key. The principal acts for the owner
+// of the key, limited to the key's scopes.
+func (a *Authenticator) authenticateAPIKey(ctx context.Context, key string) (*auth.Principal, error) {
+	prefix, ok := auth.ParseAPIKey(key)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+	}
+
+	record, err := a.apiKeys.GetByPrefix(prefix)
+	if repository.IsNotFound(err) {
+		return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+	}
+	if err != nil {
+		return nil, rpcerror.Storage(ctx, "Failed to check API key", err).Err()
+	}
+	if subtle.ConstantTimeCompare([]byte(auth.HashAPIKey(key)), []byte(record.KeyHash)) != 1 {
+		return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+	}
+
+	now := time.Now()
+	if record.RevokedAt != nil {
+		return nil, status.Error(codes.Unauthenticated, "API key has been revoked")
+	}
+	if record.Expired(now) {
+		return nil, status.Error(codes.Unauthenticated, "API key has expired")
+	}
+
+	if err := a.apiKeys.TouchLastUsed(record.ID, now, apiKeyLastUsedGranularity); err != nil {
+		log.Printf("Failed to record use of API key %d: %v", record.ID, err)
+	}
+
+	return &auth.Principal{
+		UserID:   record.OwnerID,
+		APIKeyID: record.ID,
+		Scopes:   record.ScopeList(),
+	}, nil
+}
+
+// contextStream overrides the context of a stream, e.g. with one carrying
+// the principal
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
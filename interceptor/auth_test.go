@@ -0,0 +1,162 @@
+package interceptor
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testPolicy = AuthPolicy{
+	proto.UserService_CreateUser_FullMethodName: Public,
+	proto.UserService_GetUser_FullMethodName:    Authenticated,
+	proto.UserService_DeleteUser_FullMethodName: Authenticated,
+}
+
+func newTestAuthenticator() (*Authenticator, *auth.TokenManager) {
+	tokens := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), "test", time.Minute)
+	return NewAuthenticator(tokens, testPolicy), tokens
+}
+
+// authorizeCall runs a unary call through the authenticator and returns the
+// principal the handler saw
+func authorizeCall(a *Authenticator, fullMethod string, pairs ...string) (*auth.Principal, error) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(pairs...))
+	var principal *auth.Principal
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		principal, _ = auth.FromContext(ctx)
+		return nil, nil
+	}
+	_, err := a.UnaryServerInterceptor()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: fullMethod}, handler)
+	return principal, err
+}
+
+func bearer(t *testing.T, tokens *auth.TokenManager, userID uint) string {
+	t.Helper()
+	token, _, err := tokens.Issue(userID, "user@example.com", 0)
+	if err != nil {
+		t.Fatalf("issue token: %v", err)
+	}
+	return "Bearer " + token
+}
+
+func TestAuthorizeRejectsMethodMissingFromPolicy(t *testing.T) {
+	a, tokens := newTestAuthenticator()
+
+	_, err := authorizeCall(a, proto.UserService_PurgeUser_FullMethodName, AuthorizationMetadata, bearer(t, tokens, 1))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("method missing from the policy: %v, want PermissionDenied", err)
+	}
+}
+
+func TestAuthorizePublicMethod(t *testing.T) {
+	a, tokens := newTestAuthenticator()
+
+	principal, err := authorizeCall(a, proto.UserService_CreateUser_FullMethodName)
+	if err != nil || principal != nil {
+		t.Errorf("anonymous call = %+v, %v, want it to run without a principal", principal, err)
+	}
+
+	principal, err = authorizeCall(a, proto.UserService_CreateUser_FullMethodName, AuthorizationMetadata, "Bearer not-a-token")
+	if err != nil || principal != nil {
+		t.Errorf("call with a bad token = %+v, %v, want it to run without a principal", principal, err)
+	}
+
+	principal, err = authorizeCall(a, proto.UserService_CreateUser_FullMethodName, AuthorizationMetadata, bearer(t, tokens, 7))
+	if err != nil || principal == nil || principal.UserID != 7 {
+		t.Errorf("call with a token = %+v, %v, want user 7 identified", principal, err)
+	}
+}
+
+func TestAuthorizeAuthenticatedMethod(t *testing.T) {
+	a, tokens := newTestAuthenticator()
+	expired := auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), "test", -time.Minute)
+
+	tests := []struct {
+		name  string
+		pairs []string
+	}{
+		{"no credentials", nil},
+		{"basic scheme", []string{AuthorizationMetadata, "Basic dXNlcjpwYXNz"}},
+		{"empty token", []string{AuthorizationMetadata, "Bearer "}},
+		{"bad signature", []string{AuthorizationMetadata, bearer(t, auth.NewTokenManager([]byte("another-secret-of-thirty-two-byte"), "test", time.Minute), 1)}},
+		{"expired token", []string{AuthorizationMetadata, bearer(t, expired, 1)}},
+		{"malformed API key", []string{APIKeyMetadata, "not-a-key"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := authorizeCall(a, proto.UserService_GetUser_FullMethodName, tt.pairs...); status.Code(err) != codes.Unauthenticated {
+				t.Errorf("got %v, want Unauthenticated", err)
+			}
+		})
+	}
+
+	principal, err := authorizeCall(a, proto.UserService_GetUser_FullMethodName, AuthorizationMetadata, bearer(t, tokens, 7))
+	if err != nil || principal == nil || principal.UserID != 7 || principal.ViaAPIKey() {
+		t.Errorf("call with a token = %+v, %v, want user 7 identified by the token", principal, err)
+	}
+}
+
+// createAPIKey stores an API key for the owner with the given scopes
+func createAPIKey(t *testing.T, ownerID uint, scopes ...string) (string, *models.APIKey) {
+	t.Helper()
+	key, id, err := auth.GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("generate API key: %v", err)
+	}
+	record := &models.APIKey{Name: "test", Prefix: id, KeyHash: auth.HashAPIKey(key), Scopes: strings.Join(scopes, " "), OwnerID: ownerID}
+	if err := database.DB.Create(record).Error; err != nil {
+		t.Fatalf("create API key: %v", err)
+	}
+	return key, record
+}
+
+func TestAuthorizeAPIKeyScopes(t *testing.T) {
+	openTestDatabase(t)
+	a, tokens := newTestAuthenticator()
+	key, record := createAPIKey(t, 3, "GetUser")
+
+	principal, err := authorizeCall(a, proto.UserService_GetUser_FullMethodName, APIKeyMetadata, key)
+	if err != nil || principal == nil || principal.UserID != 3 || principal.APIKeyID != record.ID {
+		t.Errorf("call in scope = %+v, %v, want the key acting for user 3", principal, err)
+	}
+
+	_, err = authorizeCall(a, proto.UserService_DeleteUser_FullMethodName, APIKeyMetadata, key)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("call out of scope: %v, want PermissionDenied", err)
+	}
+
+	// A bearer token wins over an API key sent alongside, and is not limited
+	// to the key's scopes
+	principal, err = authorizeCall(a, proto.UserService_DeleteUser_FullMethodName, AuthorizationMetadata, bearer(t, tokens, 7), APIKeyMetadata, key)
+	if err != nil || principal == nil || principal.UserID != 7 || principal.ViaAPIKey() {
+		t.Errorf("call with a token and a key = %+v, %v, want user 7 identified by the token", principal, err)
+	}
+
+	wrong := key[:len(key)-1] + "A"
+	if wrong == key {
+		wrong = key[:len(key)-1] + "B"
+	}
+	_, err = authorizeCall(a, proto.UserService_GetUser_FullMethodName, APIKeyMetadata, wrong)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("call with a wrong secret: %v, want Unauthenticated", err)
+	}
+
+	now := time.Now()
+	if err := database.DB.Model(record).Update("revoked_at", &now).Error; err != nil {
+		t.Fatalf("revoke API key: %v", err)
+	}
+	_, err = authorizeCall(a, proto.UserService_GetUser_FullMethodName, APIKeyMetadata, key)
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("call with a revoked key: %v, want Unauthenticated", err)
+	}
+}
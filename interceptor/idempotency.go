@@ -0,0 +1,273 @@
+package interceptor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+const (
+	// IdempotencyKeyMetadata is the metadata key clients set to make a
+	// mutating call safe to retry
+	IdempotencyKeyMetadata = "idempotency-key"
+
+	// IdempotentReplayedMetadata is set in the response header when the
+	// response was replayed from an earlier call
+	IdempotentReplayedMetadata = "idempotent-replayed"
+
+	maxIdempotencyKeyLength = 255
+
+	// How often expired records are swept from the database
+	idempotencySweepInterval = time.Minute
+
+	// How long a call may hold its key before a retry can take it over, in
+	// case the server stopped before the call completed
+	idempotencyLease = time.Minute
+)
+
+// Idempotency makes the configured unary methods idempotent for callers that
+// send an idempotency key. Keys are scoped to the calling user, anonymous
+// callers share one scope. The first call with a key runs normally and its
+// outcome is stored for the TTL. Retries with the same key and request get
+// the stored outcome back, while reusing the key for a different request is
+// rejected.
+type Idempotency struct {
+	repo    *repository.IdempotencyRepository
+	ttl     time.Duration
+	methods map[string]bool
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewIdempotency creates an idempotency interceptor for the given full method
+// names, e.g. proto.UserService_CreateUser_FullMethodName
+func NewIdempotency(ttl time.Duration, methods ...string) *Idempotency {
+	i := &Idempotency{
+		repo:    repository.NewIdempotencyRepository(),
+		ttl:     ttl,
+		methods: make(map[string]bool, len(methods)),
+	}
+	for _, method := range methods {
+		i.methods[method] = true
+	}
+	return i
+}
+
+// UnaryServerInterceptor returns the interceptor to install on the gRPC server
+func (i *Idempotency) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if !i.methods[info.FullMethod] {
+			return handler(ctx, req)
+		}
+
+		key := idempotencyKey(ctx)
+		if key == "" {
+			return handler(ctx, req)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return nil, status.Errorf(codes.InvalidArgument, "Idempotency key must be at most %d characters", maxIdempotencyKeyLength)
+		}
+
+		message, ok := req.(proto.Message)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		fingerprint, err := requestFingerprint(ctx, info.FullMethod, message)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "Failed to fingerprint request")
+		}
+
+		i.sweep()
+
+		record := &models.IdempotencyRecord{
+			Principal:   idempotencyPrincipal(ctx),
+			Key:         key,
+			Method:      info.FullMethod,
+			Fingerprint: fingerprint,
+			ExpiresAt:   time.Now().Add(min(idempotencyLease, i.ttl)),
+		}
+		existing, created, err := i.repo.Claim(record)
+		if err != nil {
+			return nil, rpcerror.Storage(ctx, "Failed to claim idempotency key", err).Err()
+		}
+
+		if !created {
+			if existing.Method != info.FullMethod || existing.Fingerprint != fingerprint {
+				return nil, status.Error(codes.FailedPrecondition, "Idempotency key was already used for a different request")
+			}
+			if !existing.Completed {
+				return nil, status.Error(codes.Aborted, "A request with this idempotency key is still being processed")
+			}
+			grpc.SetHeader(ctx, metadata.Pairs(IdempotentReplayedMetadata, "true"))
+			return replay(info.FullMethod, existing)
+		}
+
+		resp, err := handler(ctx, req)
+		i.complete(record.ID, resp, err)
+		return resp, err
+	}
+}
+
+// complete stores the outcome of the call holding a record. Transient
+// failures release the key instead, so that a retry runs the call again.
+func (i *Idempotency) complete(id uint, resp interface{}, err error) {
+	var (
+		statusCode = codes.OK
+		payload    []byte
+		marshalErr error
+	)
+
+	if err != nil {
+		st := status.Convert(err)
+		statusCode = st.Code()
+		if isTransient(statusCode) {
+			if err := i.repo.Release(id); err != nil {
+				log.Printf("Failed to release idempotency key: %v", err)
+			}
+			return
+		}
+		payload, marshalErr = proto.Marshal(st.Proto())
+	} else if message, ok := resp.(proto.Message); ok {
+		payload, marshalErr = proto.Marshal(message)
+	}
+
+	if marshalErr != nil {
+		log.Printf("Failed to encode response for idempotency key: %v", marshalErr)
+		if err := i.repo.Release(id); err != nil {
+			log.Printf("Failed to release idempotency key: %v", err)
+		}
+		return
+	}
+
+	if err := i.repo.Complete(id, uint32(statusCode), payload, time.Now().Add(i.ttl)); err != nil {
+		log.Printf("Failed to store response for idempotency key: %v", err)
+	}
+}
+
+// sweep deletes expired records, at most once per sweep interval
+func (i *Idempotency) sweep() {
+	i.mu.Lock()
+	if time.Since(i.lastSweep) < idempotencySweepInterval {
+		i.mu.Unlock()
+		return
+	}
+	i.lastSweep = time.Now()
+	i.mu.Unlock()
+
+	if err := i.repo.DeleteExpired(); err != nil {
+		log.Printf("Failed to delete expired idempotency records: %v", err)
+	}
+}
+
+// replay rebuilds the outcome stored in a record
+func replay(fullMethod string, record *models.IdempotencyRecord) (interface{}, error) {
+	if codes.Code(record.StatusCode) != codes.OK {
+		stored := &spb.Status{}
+		if err := proto.Unmarshal(record.Response, stored); err != nil {
+			return nil, status.Error(codes.Internal, "Failed to replay stored response")
+		}
+		return nil, status.FromProto(stored).Err()
+	}
+
+	resp, err := newResponse(fullMethod)
+	if err != nil {
+		return nil, status.Error(codes.Internal, "Failed to replay stored response")
+	}
+	if err := proto.Unmarshal(record.Response, resp); err != nil {
+		return nil, status.Error(codes.Internal, "Failed to replay stored response")
+	}
+	return resp, nil
+}
+
+// newResponse creates an empty response message for a full method name such
+// as /user.UserService/CreateUser
+func newResponse(fullMethod string) (proto.Message, error) {
+	serviceName, methodName, _ := strings.Cut(strings.TrimPrefix(fullMethod, "/"), "/")
+
+	descriptor, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, err
+	}
+	service, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, protoregistry.NotFound
+	}
+	method := service.Methods().ByName(protoreflect.Name(methodName))
+	if method == nil {
+		return nil, protoregistry.NotFound
+	}
+
+	messageType, err := protoregistry.GlobalTypes.FindMessageByName(method.Output().FullName())
+	if err != nil {
+		return nil, err
+	}
+	return messageType.New().Interface(), nil
+}
+
+// idempotencyPrincipal names the caller whose keys a request's key is
+// checked against
+func idempotencyPrincipal(ctx context.Context) string {
+	if principal, ok := auth.FromContext(ctx); ok {
+		return "user:" + strconv.FormatUint(uint64(principal.UserID), 10)
+	}
+	return ""
+}
+
+func idempotencyKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if values := md.Get(IdempotencyKeyMetadata); len(values) > 0 {
+		return strings.TrimSpace(values[0])
+	}
+	return ""
+}
+
+// requestFingerprint hashes the caller, method and request so a reused key can
+// be told apart from a genuine retry, and no caller is replayed a response
+// stored for another
+func requestFingerprint(ctx context.Context, fullMethod string, req proto.Message) (string, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	if principal, ok := auth.FromContext(ctx); ok {
+		hash.Write([]byte(strconv.FormatUint(uint64(principal.UserID), 10)))
+	}
+	hash.Write([]byte{0})
+	hash.Write([]byte(fullMethod))
+	hash.Write([]byte{0})
+	hash.Write(data)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// isTransient reports whether a failure may succeed on retry, in which case
+// its outcome is not stored
+func isTransient(code codes.Code) bool {
+	switch code {
+	case codes.Canceled, codes.DeadlineExceeded, codes.ResourceExhausted,
+		codes.Aborted, codes.Internal, codes.Unavailable, codes.Unknown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package interceptor
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// openTestDatabase points the repositories at a fresh in-memory database
+func openTestDatabase(t *testing.T) {
+	t.Helper()
+	database.InitDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_")))
+	t.Cleanup(func() { database.Close() })
+}
+
+// createUser runs CreateUser through the idempotency interceptor with a key,
+// counting the calls that reach the handler
+type createUser struct {
+	interceptor grpc.UnaryServerInterceptor
+	calls       int
+	// Runs inside the handler, while the call holds its key
+	during func(ctx context.Context)
+}
+
+func (c *createUser) call(ctx context.Context, key, name string) (*proto.CreateUserResponse, error) {
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(IdempotencyKeyMetadata, key))
+	info := &grpc.UnaryServerInfo{FullMethod: proto.UserService_CreateUser_FullMethodName}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		c.calls++
+		if c.during != nil {
+			c.during(ctx)
+		}
+		return &proto.CreateUserResponse{Message: fmt.Sprintf("call %d", c.calls), Success: true}, nil
+	}
+
+	resp, err := c.interceptor(ctx, &proto.CreateUserRequest{Name: name, Email: "alice@example.com"}, info, handler)
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*proto.CreateUserResponse), nil
+}
+
+func newCreateUser(t *testing.T) *createUser {
+	openTestDatabase(t)
+	idempotency := NewIdempotency(time.Hour, proto.UserService_CreateUser_FullMethodName)
+	return &createUser{interceptor: idempotency.UnaryServerInterceptor()}
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	c := newCreateUser(t)
+	ctx := context.Background()
+
+	first, err := c.call(ctx, "key-1", "Alice")
+	if err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	retry, err := c.call(ctx, "key-1", "Alice")
+	if err != nil {
+		t.Fatalf("retry: %v", err)
+	}
+	if c.calls != 1 {
+		t.Errorf("handler ran %d times, want once", c.calls)
+	}
+	if retry.Message != first.Message {
+		t.Errorf("retry got %q, want the stored %q", retry.Message, first.Message)
+	}
+
+	if _, err := c.call(ctx, "key-2", "Alice"); err != nil {
+		t.Fatalf("call with another key: %v", err)
+	}
+	if c.calls != 2 {
+		t.Errorf("handler ran %d times, want a new key to run it again", c.calls)
+	}
+}
+
+func TestIdempotencyRejectsDifferentRequest(t *testing.T) {
+	c := newCreateUser(t)
+	ctx := context.Background()
+
+	if _, err := c.call(ctx, "key-1", "Alice"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	_, err := c.call(ctx, "key-1", "Bob")
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("reusing the key for another request: %v, want FailedPrecondition", err)
+	}
+	if c.calls != 1 {
+		t.Errorf("handler ran %d times, want once", c.calls)
+	}
+}
+
+func TestIdempotencyKeysArePerCaller(t *testing.T) {
+	c := newCreateUser(t)
+	alice := auth.NewContext(context.Background(), &auth.Principal{UserID: 1})
+	bob := auth.NewContext(context.Background(), &auth.Principal{UserID: 2})
+
+	aliceResp, err := c.call(alice, "shared-key", "Alice")
+	if err != nil {
+		t.Fatalf("call as user 1: %v", err)
+	}
+	bobResp, err := c.call(bob, "shared-key", "Alice")
+	if err != nil {
+		t.Fatalf("call as user 2: %v", err)
+	}
+	if c.calls != 2 || bobResp.Message == aliceResp.Message {
+		t.Errorf("user 2 got %q after user 1 got %q, want its own call to run", bobResp.Message, aliceResp.Message)
+	}
+
+	// Anonymous callers have a scope of their own too
+	if _, err := c.call(context.Background(), "shared-key", "Bob"); err != nil {
+		t.Fatalf("anonymous call: %v", err)
+	}
+	if c.calls != 3 {
+		t.Errorf("handler ran %d times, want the anonymous call to run", c.calls)
+	}
+}
+
+func TestIdempotencyLease(t *testing.T) {
+	c := newCreateUser(t)
+
+	var concurrent error
+	c.during = func(ctx context.Context) {
+		c.during = nil
+		_, concurrent = c.call(context.Background(), "key-1", "Alice")
+	}
+	if _, err := c.call(context.Background(), "key-1", "Alice"); err != nil {
+		t.Fatalf("first call: %v", err)
+	}
+	if status.Code(concurrent) != codes.Aborted {
+		t.Errorf("call while the key is held: %v, want Aborted", concurrent)
+	}
+
+	// A call that never completes, e.g. because the server stopped, gives up
+	// its key once the lease runs out
+	record := &models.IdempotencyRecord{
+		Key:         "key-2",
+		Method:      proto.UserService_CreateUser_FullMethodName,
+		Fingerprint: "abandoned",
+		ExpiresAt:   time.Now().Add(-time.Second),
+	}
+	if err := database.DB.Create(record).Error; err != nil {
+		t.Fatalf("create abandoned record: %v", err)
+	}
+	if _, err := c.call(context.Background(), "key-2", "Alice"); err != nil {
+		t.Fatalf("call after the lease ran out: %v", err)
+	}
+	if c.calls != 2 {
+		t.Errorf("handler ran %d times, want the retry to take over the key", c.calls)
+	}
+}
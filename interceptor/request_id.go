@@ -0,0 +1,42 @@
+package interceptor
+
+import (
+	"context"
+
+	"github.com/riskykurniawan15/learn-grpc/requestid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// RequestIDUnaryServerInterceptor gives every call a request ID, taken from
+// the x-request-id metadata when the caller sent a valid one, and returns it
+// in the response header. Install it first so that calls rejected by later
+// interceptors have an ID too.
+func RequestIDUnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(withRequestID(ctx), req)
+	}
+}
+
+// RequestIDStreamServerInterceptor is the stream counterpart of
+// RequestIDUnaryServerInterceptor
+func RequestIDStreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &contextStream{ServerStream: stream, ctx: withRequestID(stream.Context())})
+	}
+}
+
+// withRequestID stores the request ID of a call in its context and sets the
+// response header
+func withRequestID(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := ""
+	if values := md.Get(requestid.Metadata); len(values) > 0 && requestid.Valid(values[0]) {
+		id = values[0]
+	} else {
+		id = requestid.New()
+	}
+
+	grpc.SetHeader(ctx, metadata.Pairs(requestid.Metadata, id))
+	return requestid.NewContext(ctx, id)
+}
@@ -0,0 +1,247 @@
+// Package lockout protects password checks against brute force and
+// credential stuffing. It counts failed checks per account and per source
+// address, slows down further attempts with growing delays and finally locks
+// the account or address out for a while.
+package lockout
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+)
+
+// How often counters without recent failures are swept from the database
+const sweepInterval = time.Minute
+
+// Policy says how failed attempts are punished
+type Policy struct {
+	// Failures older than this are forgotten
+	Window time.Duration
+	// Number of failures after which each attempt has to wait, starting at
+	// BaseDelay and doubling with every further failure up to MaxDelay
+	DelayAfter int
+	BaseDelay  time.Duration
+	MaxDelay   time.Duration
+	// Number of failures that cause a lockout of LockDuration
+	LockAfter    int
+	LockDuration time.Duration
+}
+
+// DefaultAccountPolicy applies to the failures of a single account
+var DefaultAccountPolicy = Policy{
+	Window:       15 * time.Minute,
+	DelayAfter:   3,
+	BaseDelay:    time.Second,
+	MaxDelay:     30 * time.Second,
+	LockAfter:    10,
+	LockDuration: 15 * time.Minute,
+}
+
+// DefaultAddressPolicy applies to the failures from a single source address,
+// which may be shared by many legitimate users
+var DefaultAddressPolicy = Policy{
+	Window:       15 * time.Minute,
+	DelayAfter:   20,
+	BaseDelay:    time.Second,
+	MaxDelay:     30 * time.Second,
+	LockAfter:    100,
+	LockDuration: 15 * time.Minute,
+}
+
+// delay returns how long to wait after the given number of failures
+func (p Policy) delay(failures int) time.Duration {
+	if failures < p.DelayAfter {
+		return 0
+	}
+	delay := p.BaseDelay
+	for i := p.DelayAfter; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, p.MaxDelay)
+}
+
+// Scope is what a throttle applies to
+type Scope string
+
+const (
+	ScopeAccount Scope = "account"
+	ScopeAddress Scope = "address"
+)
+
+// ThrottledError is returned for attempts that have to wait
+type ThrottledError struct {
+	Scope Scope
+	// Locked is set for lockouts, as opposed to the delays before them
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("%s locked for %s", e.Scope, e.RetryAfter)
+	}
+	return fmt.Sprintf("%s throttled for %s", e.Scope, e.RetryAfter)
+}
+
+// Tracker counts failed password checks and decides whether an attempt may
+// go ahead
+type Tracker struct {
+	repo    *repository.LoginThrottleRepository
+	account Policy
+	address Policy
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// NewTracker creates a tracker applying the policies
+func NewTracker(account, address Policy) *Tracker {
+	return &Tracker{
+		repo:    repository.NewLoginThrottleRepository(),
+		account: account,
+		address: address,
+	}
+}
+
+// AccountKey returns the counter key of an account. Accounts are keyed by
+// email so unknown emails are throttled like registered ones.
+func AccountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+// addressKey returns the counter key of a source address
+func addressKey(address string) string {
+	return "ip:" + address
+}
+
+// Check returns a *ThrottledError when an attempt to check the password of
+// email from address has to wait. An empty address is not tracked. Lockouts
+// take precedence over delays, and account throttles over address ones.
+func (t *Tracker) Check(email, address string) error {
+	keys := []string{AccountKey(email)}
+	if address != "" {
+		keys = append(keys, addressKey(address))
+	}
+
+	throttles, err := t.repo.Get(keys...)
+	if err != nil {
+		// Failing open keeps logins working when the counters are unreadable
+		log.Printf("Failed to read login throttles: %v", err)
+		return nil
+	}
+
+	now := time.Now()
+	var delayed *ThrottledError
+	for _, scope := range []Scope{ScopeAccount, ScopeAddress} {
+		throttle := findThrottle(throttles, keyFor(scope, email, address))
+		if throttle == nil {
+			continue
+		}
+		policy := t.policy(scope)
+
+		if throttle.LockedUntil != nil && now.Before(*throttle.LockedUntil) {
+			return &ThrottledError{Scope: scope, Locked: true, RetryAfter: throttle.LockedUntil.Sub(now)}
+		}
+		if now.Sub(throttle.LastFailureAt) >= policy.Window {
+			continue
+		}
+		next := throttle.LastFailureAt.Add(policy.delay(throttle.Failures))
+		if delayed == nil && now.Before(next) {
+			delayed = &ThrottledError{Scope: scope, RetryAfter: next.Sub(now)}
+		}
+	}
+	if delayed != nil {
+		return delayed
+	}
+	return nil
+}
+
+// Failure records a failed password check of email from address, locking the
+// account or address once it reaches the limit of its policy
+func (t *Tracker) Failure(email, address string) {
+	t.sweep()
+
+	now := time.Now()
+	t.record(ScopeAccount, AccountKey(email), now)
+	if address != "" {
+		t.record(ScopeAddress, addressKey(address), now)
+	}
+}
+
+func (t *Tracker) record(scope Scope, key string, now time.Time) {
+	policy := t.policy(scope)
+
+	throttle, err := t.repo.RecordFailure(key, now, now.Add(-policy.Window))
+	if err != nil {
+		log.Printf("Failed to record failed login for %s: %v", key, err)
+		return
+	}
+	if throttle.Failures < policy.LockAfter {
+		return
+	}
+
+	log.Printf("Locking %s for %s after %d failed logins", key, policy.LockDuration, throttle.Failures)
+	if err := t.repo.Lock(key, now.Add(policy.LockDuration)); err != nil {
+		log.Printf("Failed to lock %s: %v", key, err)
+	}
+}
+
+// Success forgets the failures of an account after a correct password.
+// Failures of the address are kept, otherwise an attacker owning one account
+// could clear them.
+func (t *Tracker) Success(email string) {
+	if err := t.repo.Reset(AccountKey(email)); err != nil {
+		log.Printf("Failed to reset failed logins of %s: %v", email, err)
+	}
+}
+
+// Unlock lifts the lockout and forgets the failures of an account, recording
+// the audit event. It reports whether the account was locked.
+func (t *Tracker) Unlock(email string, audit *models.AuditEvent) (bool, error) {
+	return t.repo.Unlock(AccountKey(email), time.Now(), audit)
+}
+
+func (t *Tracker) policy(scope Scope) Policy {
+	if scope == ScopeAddress {
+		return t.address
+	}
+	return t.account
+}
+
+func keyFor(scope Scope, email, address string) string {
+	if scope == ScopeAddress {
+		return addressKey(address)
+	}
+	return AccountKey(email)
+}
+
+func findThrottle(throttles []models.LoginThrottle, key string) *models.LoginThrottle {
+	for i := range throttles {
+		if throttles[i].Key == key {
+			return &throttles[i]
+		}
+	}
+	return nil
+}
+
+// sweep deletes counters without recent failures, at most once per sweep
+// interval
+func (t *Tracker) sweep() {
+	t.mu.Lock()
+	if time.Since(t.lastSweep) < sweepInterval {
+		t.mu.Unlock()
+		return
+	}
+	t.lastSweep = time.Now()
+	t.mu.Unlock()
+
+	now := time.Now()
+	if err := t.repo.DeleteStale(now.Add(-max(t.account.Window, t.address.Window)), now); err != nil {
+		log.Printf("Failed to delete stale login throttles: %v", err)
+	}
+}
@@ -0,0 +1,207 @@
+package lockout
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+)
+
+// lenient never throttles within a test
+var lenient = Policy{
+	Window:       time.Hour,
+	DelayAfter:   1000,
+	BaseDelay:    time.Hour,
+	MaxDelay:     time.Hour,
+	LockAfter:    1000,
+	LockDuration: time.Hour,
+}
+
+// newTestTracker returns a tracker backed by a fresh in-memory database
+func newTestTracker(t *testing.T, account, address Policy) *Tracker {
+	t.Helper()
+	database.InitDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_")))
+	t.Cleanup(func() { database.Close() })
+	return NewTracker(account, address)
+}
+
+func throttled(t *testing.T, err error) *ThrottledError {
+	t.Helper()
+	var throttledErr *ThrottledError
+	if !errors.As(err, &throttledErr) {
+		t.Fatalf("Check() = %v, want a *ThrottledError", err)
+	}
+	return throttledErr
+}
+
+func TestPolicyDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{7, 16 * time.Second},
+		{8, 30 * time.Second},
+		{50, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := DefaultAccountPolicy.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestTrackerLocksAccountAtThreshold(t *testing.T) {
+	account := lenient
+	account.LockAfter = 3
+	tracker := newTestTracker(t, account, lenient)
+
+	for i := 1; i < account.LockAfter; i++ {
+		tracker.Failure("User@Example.com", "10.0.0.1")
+		if err := tracker.Check("user@example.com", "10.0.0.1"); err != nil {
+			t.Fatalf("after %d failures Check() = %v, want nil", i, err)
+		}
+	}
+
+	tracker.Failure("user@example.com", "10.0.0.1")
+	err := throttled(t, tracker.Check(" user@example.com", "10.0.0.2"))
+	if err.Scope != ScopeAccount || !err.Locked {
+		t.Errorf("Check() = %+v, want an account lockout", err)
+	}
+	if err.RetryAfter <= 0 || err.RetryAfter > account.LockDuration {
+		t.Errorf("RetryAfter = %s, want up to %s", err.RetryAfter, account.LockDuration)
+	}
+
+	if err := tracker.Check("other@example.com", "10.0.0.1"); err != nil {
+		t.Errorf("Check() of another account = %v, want nil", err)
+	}
+}
+
+func TestTrackerDelaysBeforeLockout(t *testing.T) {
+	account := lenient
+	account.DelayAfter = 2
+	tracker := newTestTracker(t, account, lenient)
+
+	tracker.Failure("user@example.com", "")
+	if err := tracker.Check("user@example.com", ""); err != nil {
+		t.Fatalf("after 1 failure Check() = %v, want nil", err)
+	}
+
+	tracker.Failure("user@example.com", "")
+	err := throttled(t, tracker.Check("user@example.com", ""))
+	if err.Scope != ScopeAccount || err.Locked {
+		t.Errorf("Check() = %+v, want an account delay", err)
+	}
+	if err.RetryAfter <= 0 || err.RetryAfter > account.BaseDelay {
+		t.Errorf("RetryAfter = %s, want up to %s", err.RetryAfter, account.BaseDelay)
+	}
+}
+
+func TestTrackerLocksAddressAtThreshold(t *testing.T) {
+	address := lenient
+	address.LockAfter = 3
+	tracker := newTestTracker(t, lenient, address)
+
+	for i := 0; i < address.LockAfter; i++ {
+		tracker.Failure(fmt.Sprintf("user%d@example.com", i), "10.0.0.1")
+	}
+
+	err := throttled(t, tracker.Check("new@example.com", "10.0.0.1"))
+	if err.Scope != ScopeAddress || !err.Locked {
+		t.Errorf("Check() = %+v, want an address lockout", err)
+	}
+	if err := tracker.Check("new@example.com", "10.0.0.2"); err != nil {
+		t.Errorf("Check() from another address = %v, want nil", err)
+	}
+}
+
+func TestTrackerAccountLockoutTakesPrecedence(t *testing.T) {
+	account := lenient
+	account.LockAfter = 2
+	address := lenient
+	address.DelayAfter = 1
+	tracker := newTestTracker(t, account, address)
+
+	tracker.Failure("user@example.com", "10.0.0.1")
+	tracker.Failure("user@example.com", "10.0.0.1")
+
+	err := throttled(t, tracker.Check("user@example.com", "10.0.0.1"))
+	if err.Scope != ScopeAccount || !err.Locked {
+		t.Errorf("Check() = %+v, want the account lockout", err)
+	}
+}
+
+func TestTrackerSuccessKeepsAddressFailures(t *testing.T) {
+	account := lenient
+	account.DelayAfter = 2
+	address := lenient
+	address.LockAfter = 2
+	tracker := newTestTracker(t, account, address)
+
+	tracker.Failure("user@example.com", "10.0.0.1")
+	tracker.Success("user@example.com")
+	tracker.Failure("user@example.com", "10.0.0.1")
+
+	err := throttled(t, tracker.Check("user@example.com", "10.0.0.1"))
+	if err.Scope != ScopeAddress {
+		t.Errorf("Check() = %+v, want an address lockout", err)
+	}
+	if err := tracker.Check("user@example.com", ""); err != nil {
+		t.Errorf("Check() of the account alone = %v, want nil after Success", err)
+	}
+}
+
+func TestTrackerForgetsFailuresOutsideWindow(t *testing.T) {
+	account := lenient
+	account.DelayAfter = 2
+	account.LockAfter = 3
+	tracker := newTestTracker(t, account, lenient)
+
+	old := models.LoginThrottle{Key: AccountKey("user@example.com"), Failures: 2, LastFailureAt: time.Now().Add(-2 * account.Window)}
+	if err := database.DB.Create(&old).Error; err != nil {
+		t.Fatalf("create throttle: %v", err)
+	}
+	if err := tracker.Check("user@example.com", ""); err != nil {
+		t.Fatalf("Check() with stale failures = %v, want nil", err)
+	}
+
+	// The stale failures do not count towards the lockout either
+	tracker.Failure("user@example.com", "")
+	tracker.Failure("user@example.com", "")
+	err := throttled(t, tracker.Check("user@example.com", ""))
+	if err.Locked {
+		t.Errorf("Check() = %+v, want a delay rather than a lockout", err)
+	}
+}
+
+func TestTrackerUnlock(t *testing.T) {
+	account := lenient
+	account.LockAfter = 1
+	tracker := newTestTracker(t, account, lenient)
+
+	tracker.Failure("user@example.com", "")
+	throttled(t, tracker.Check("user@example.com", ""))
+
+	locked, err := tracker.Unlock("user@example.com", &models.AuditEvent{Action: models.AuditUserUnlocked})
+	if err != nil {
+		t.Fatalf("Unlock() error = %v", err)
+	}
+	if !locked {
+		t.Error("Unlock() = false, want true for a locked account")
+	}
+	if err := tracker.Check("user@example.com", ""); err != nil {
+		t.Errorf("Check() after Unlock = %v, want nil", err)
+	}
+
+	locked, err = tracker.Unlock("user@example.com", &models.AuditEvent{Action: models.AuditUserUnlocked})
+	if err != nil || locked {
+		t.Errorf("second Unlock() = %v, %v, want false, nil", locked, err)
+	}
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// APIKey represents the api_keys table. API keys let machine callers use the
+// service without logging in. Only a hash of the key is stored.
+type APIKey struct {
+	ID   uint   `gorm:"primarykey" json:"id"`
+	Name string `gorm:"size:100;not null" json:"name"`
+	// Public part of the key, lgk_<prefix>_<secret>, used to look it up
+	Prefix  string `gorm:"size:12;uniqueIndex;not null" json:"prefix"`
+	KeyHash string `gorm:"size:64;not null" json:"-"`
+	// Space separated UserService method names the key may call
+	Scopes string `gorm:"type:text;not null" json:"scopes"`
+	// User the key acts for
+	OwnerID    uint       `gorm:"index;not null" json:"owner_id"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TableName specifies the table name for APIKey model
+func (APIKey) TableName() string {
+	return "api_keys"
+}
+
+// ScopeList returns the scopes of the key
+func (k *APIKey) ScopeList() []string {
+	return strings.Fields(k.Scopes)
+}
+
+// Expired reports whether the key is past its expiry
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// EmailVerificationToken represents the email_verification_tokens table. A
+// token proves ownership of the email it was sent to, and only while the user
+// still has that email. Only the SHA-256 of a token is stored.
+type EmailVerificationToken struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"`
+	Email     string    `gorm:"size:100;not null" json:"email"`
+	TokenHash string    `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+	// Set once the token has been redeemed or replaced by a newer one
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TableName specifies the table name for EmailVerificationToken model
+func (EmailVerificationToken) TableName() string {
+	return "email_verification_tokens"
+}
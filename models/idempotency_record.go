@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// IdempotencyRecord represents the idempotency_records table. It remembers
+// the outcome of a mutating call made with an idempotency key so a retry of
+// the same call can be answered without running it again. Keys are scoped to
+// the caller that sent them.
+type IdempotencyRecord struct {
+	ID uint `gorm:"primarykey" json:"id"`
+	// Caller owning the key, e.g. "user:42", empty for anonymous callers
+	Principal   string    `gorm:"size:64;not null;default:'';uniqueIndex:idx_idempotency_records_principal_key,priority:1" json:"principal"`
+	Key         string    `gorm:"column:idempotency_key;size:255;not null;uniqueIndex:idx_idempotency_records_principal_key,priority:2" json:"key"`
+	Method      string    `gorm:"size:255;not null" json:"method"`
+	Fingerprint string    `gorm:"size:64;not null" json:"fingerprint"`
+	Completed   bool      `gorm:"not null;default:false" json:"completed"`
+	StatusCode  uint32    `gorm:"not null;default:0" json:"status_code"`
+	Response    []byte    `json:"-"`
+	CreatedAt   time.Time `json:"created_at"`
+	// End of the TTL once completed. While the call is in progress it is the
+	// end of a short lease, so a key left behind by a crash frees up soon.
+	ExpiresAt time.Time `gorm:"index;not null" json:"expires_at"`
+}
+
+// TableName specifies the table name for IdempotencyRecord model
+func (IdempotencyRecord) TableName() string {
+	return "idempotency_records"
+}
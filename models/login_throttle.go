@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// LoginThrottle represents the login_throttles table. It counts the recent
+// failed password checks of an account or a source address, keyed by
+// "account:<email>" or "ip:<address>".
+type LoginThrottle struct {
+	Key           string     `gorm:"column:throttle_key;primaryKey;size:255" json:"key"`
+	Failures      int        `gorm:"not null;default:0" json:"failures"`
+	LastFailureAt time.Time  `gorm:"index;not null" json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until,omitempty"`
+}
+
+// TableName specifies the table name for LoginThrottle model
+func (LoginThrottle) TableName() string {
+	return "login_throttles"
+}
@@ -0,0 +1,57 @@
+package models
+
+import "time"
+
+// TOTPCredential represents the totp_credentials table, the authenticator app
+// secret of a user. The secret is encrypted, it has to be read back to check
+// codes.
+type TOTPCredential struct {
+	ID     uint   `gorm:"primarykey" json:"id"`
+	UserID uint   `gorm:"uniqueIndex;not null" json:"user_id"`
+	Secret string `gorm:"size:255;not null" json:"-"`
+	// Set once the user proved their app produces valid codes. Unconfirmed
+	// credentials are replaced by the next enrollment.
+	ConfirmedAt *time.Time `json:"confirmed_at,omitempty"`
+	// Time step of the last accepted code. Codes of that step and earlier
+	// ones are refused, so each code can only be used once.
+	LastStep  int64     `gorm:"not null;default:0" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name for TOTPCredential model
+func (TOTPCredential) TableName() string {
+	return "totp_credentials"
+}
+
+// RecoveryCode represents the recovery_codes table, single-use codes that
+// stand in for a TOTP code when the authenticator app is lost. Only the
+// SHA-256 of a code is stored.
+type RecoveryCode struct {
+	ID        uint       `gorm:"primarykey" json:"id"`
+	UserID    uint       `gorm:"index;not null" json:"user_id"`
+	CodeHash  string     `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TableName specifies the table name for RecoveryCode model
+func (RecoveryCode) TableName() string {
+	return "recovery_codes"
+}
+
+// MFAChallenge represents the mfa_challenges table. A challenge is handed out
+// when a user with MFA enabled logs in with the right password, and is
+// exchanged with VerifyMfa and a code for the actual tokens. Only the SHA-256
+// of a challenge token is stored.
+type MFAChallenge struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"`
+	TokenHash string    `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name for MFAChallenge model
+func (MFAChallenge) TableName() string {
+	return "mfa_challenges"
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// PasswordResetToken represents the password_reset_tokens table. Only the
+// SHA-256 of a token is stored, the token itself is only sent to the user.
+type PasswordResetToken struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"`
+	TokenHash string    `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+	// Set once the token has been redeemed or replaced by a newer one
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TableName specifies the table name for PasswordResetToken model
+func (PasswordResetToken) TableName() string {
+	return "password_reset_tokens"
+}
@@ -0,0 +1,54 @@
+package models
+
+import "time"
+
+// Reasons a session was revoked
+const (
+	SessionRevokedByUser   = "revoked"
+	SessionRevokedReuse    = "refresh_token_reused"
+	SessionRevokedPassword = "password_changed"
+)
+
+// Session represents the sessions table, one row per login. A session lives
+// as long as its refresh token keeps being used before it expires.
+type Session struct {
+	ID     uint `gorm:"primarykey" json:"id"`
+	UserID uint `gorm:"index;not null" json:"user_id"`
+	// Device and address the session was last refreshed from
+	UserAgent  string    `gorm:"size:255" json:"user_agent"`
+	IPAddress  string    `gorm:"size:45" json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `gorm:"not null" json:"last_used_at"`
+	// Expiry of the current refresh token
+	ExpiresAt    time.Time  `gorm:"not null" json:"expires_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+	RevokeReason string     `gorm:"size:50" json:"revoke_reason,omitempty"`
+}
+
+// TableName specifies the table name for Session model
+func (Session) TableName() string {
+	return "sessions"
+}
+
+// Active reports whether the session is neither revoked nor expired
+func (s *Session) Active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// RefreshToken represents the refresh_tokens table. Every refresh of a
+// session rotates its token, the rotated tokens are kept so that using one
+// again can be detected. Only the SHA-256 of a token is stored.
+type RefreshToken struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	SessionID uint      `gorm:"index;not null" json:"session_id"`
+	TokenHash string    `gorm:"size:64;uniqueIndex;not null" json:"-"`
+	ExpiresAt time.Time `gorm:"not null" json:"expires_at"`
+	// Set once the token has been exchanged for a new one
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// TableName specifies the table name for RefreshToken model
+func (RefreshToken) TableName() string {
+	return "refresh_tokens"
+}
@@ -8,14 +8,32 @@ import (
 
 // User represents the user table in database
 type User struct {
-	ID        uint           `gorm:"primarykey" json:"id" validate:"-"`
-	Name      string         `gorm:"size:100;not null" json:"name" validate:"required,min=2,max=100,alpha_space"`
-	Email     string         `gorm:"size:100;unique;not null" json:"email" validate:"required,email,max=100"`
-	Password  string         `gorm:"size:255;not null" json:"-" validate:"required,min=8,max=255,password_strength"`
-	Age       int            `gorm:"not null" json:"age" validate:"required,min=13,max=120"`
-	CreatedAt time.Time      `json:"created_at" validate:"-"`
-	UpdatedAt time.Time      `json:"updated_at" validate:"-"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-" validate:"-"`
+	ID            uint           `gorm:"primarykey" json:"id" validate:"-"`
+	Name          string         `gorm:"size:100;not null" json:"name" validate:"required,min=2,max=100,alpha_space"`
+	Email         string         `gorm:"size:100;unique;not null" json:"email" validate:"required,email,max=100"`
+	EmailVerified bool           `gorm:"not null;default:false" json:"email_verified" validate:"-"`
+	TOTPEnabled   bool           `gorm:"not null;default:false" json:"totp_enabled" validate:"-"`
+	Password      string         `gorm:"size:255;not null" json:"-" validate:"required,min=8,max=255,password_strength"`
+	Age           int            `gorm:"not null" json:"age" validate:"required,min=13,max=120"`
+	Version       uint           `gorm:"not null;default:1" json:"version" validate:"-"`
+	CreatedAt     time.Time      `json:"created_at" validate:"-"`
+	UpdatedAt     time.Time      `json:"updated_at" validate:"-"`
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-" validate:"-"`
+	Roles         []UserRole     `gorm:"foreignKey:UserID" json:"roles,omitempty" validate:"-"`
+}
+
+// HasRole reports whether the user has a role, counting the implicit
+// self-service role. Roles must have been loaded.
+func (u *User) HasRole(role string) bool {
+	if role == RoleSelfService {
+		return true
+	}
+	for _, granted := range u.Roles {
+		if granted.Role == role {
+			return true
+		}
+	}
+	return false
 }
 
 // TableName specifies the table name for User model
@@ -32,8 +50,88 @@ type CreateUserRequest struct {
 }
 
 type UpdateUserRequest struct {
-	Name     string `json:"name,omitempty" validate:"omitempty,min=2,max=100,alpha_space"`
-	Email    string `json:"email,omitempty" validate:"omitempty,email,max=100"`
-	Password string `json:"password,omitempty" validate:"omitempty,min=8,max=255,password_strength"`
-	Age      int    `json:"age,omitempty" validate:"omitempty,min=13,max=120"`
+	Name  string `json:"name,omitempty" validate:"omitempty,min=2,max=100,alpha_space"`
+	Email string `json:"email,omitempty" validate:"omitempty,email,max=100"`
+	Age   int    `json:"age,omitempty" validate:"omitempty,min=13,max=120"`
+}
+
+type ListUsersRequest struct {
+	PageSize int             `json:"page_size,omitempty" validate:"omitempty,min=0"`
+	OrderBy  string          `json:"order_by,omitempty" validate:"omitempty,oneof=name email age created_at"`
+	Filter   ListUsersFilter `json:"filter"`
+}
+
+type AuthenticateRequest struct {
+	Email    string `json:"email" validate:"required,email,max=100"`
+	Password string `json:"password" validate:"required,max=255"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required,max=255"`
+	NewPassword     string `json:"new_password" validate:"required,min=8,max=255,password_strength"`
+}
+
+type RefreshSessionRequest struct {
+	RefreshToken string `json:"refresh_token" validate:"required,max=100"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" validate:"required,max=100"`
+}
+
+type ResendVerificationEmailRequest struct {
+	Email string `json:"email" validate:"required,email,max=100"`
+}
+
+type RequestPasswordResetRequest struct {
+	Email string `json:"email" validate:"required,email,max=100"`
+}
+
+type ConfirmPasswordResetRequest struct {
+	Token       string `json:"token" validate:"required,max=100"`
+	NewPassword string `json:"new_password" validate:"required,min=8,max=255,password_strength"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code" validate:"required,numeric,len=6"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" validate:"required,max=32"`
+}
+
+type VerifyMFARequest struct {
+	MFAToken string `json:"mfa_token" validate:"required,max=128"`
+	Code     string `json:"code" validate:"required,max=32"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name   string   `json:"name" validate:"required,max=100"`
+	Scopes []string `json:"scopes" validate:"required"`
+}
+
+type RoleChangeRequest struct {
+	UserID int64  `json:"user_id" validate:"required,min=1"`
+	Role   string `json:"role" validate:"required,oneof=admin support"`
+}
+
+type SearchUsersRequest struct {
+	Query    string `json:"query" validate:"required,max=200"`
+	PageSize int    `json:"page_size,omitempty" validate:"omitempty,min=0"`
+}
+
+type ListUsersFilter struct {
+	MinAge      int    `json:"min_age,omitempty" validate:"omitempty,min=0,max=120"`
+	MaxAge      int    `json:"max_age,omitempty" validate:"omitempty,min=0,max=120,gtefield=MinAge"`
+	NamePrefix  string `json:"name_prefix,omitempty" validate:"omitempty,max=100"`
+	EmailDomain string `json:"email_domain,omitempty" validate:"omitempty,fqdn,max=100"`
+}
+
+// PatchUserRequest validates the fields named in an UpdateUser field mask.
+// Unlike UpdateUserRequest the rules apply even to empty values, since a
+// masked field is always written.
+type PatchUserRequest struct {
+	Name  string `json:"name" validate:"required,min=2,max=100,alpha_space"`
+	Email string `json:"email" validate:"required,email,max=100"`
+	Age   int    `json:"age" validate:"required,min=13,max=120"`
 }
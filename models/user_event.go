@@ -0,0 +1,67 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// User event types
+const (
+	UserEventCreated  = "created"
+	UserEventUpdated  = "updated"
+	UserEventDeleted  = "deleted"
+	UserEventRestored = "restored"
+	UserEventPurged   = "purged"
+)
+
+// UserEvent represents the user_events table, an append-only log of user
+// changes. The ID doubles as the event sequence number.
+type UserEvent struct {
+	ID        uint      `gorm:"primarykey" json:"sequence"`
+	Type      string    `gorm:"size:20;not null" json:"type"`
+	UserID    uint      `gorm:"index;not null" json:"user_id"`
+	Payload   string    `gorm:"type:text;not null" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName specifies the table name for UserEvent model
+func (UserEvent) TableName() string {
+	return "user_events"
+}
+
+// userEventPayload is how a user is stored in an event. Unlike the API JSON
+// of a user it includes deleted_at, so delete events say when the user was
+// deleted.
+type userEventPayload struct {
+	*User
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// SetUser stores the state of the user in the event
+func (e *UserEvent) SetUser(user *User) error {
+	payload := userEventPayload{User: user}
+	if user.DeletedAt.Valid {
+		payload.DeletedAt = &user.DeletedAt.Time
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	e.UserID = user.ID
+	e.Payload = string(data)
+	return nil
+}
+
+// User returns the state of the user stored in the event
+func (e *UserEvent) User() (*User, error) {
+	payload := userEventPayload{User: &User{}}
+	if err := json.Unmarshal([]byte(e.Payload), &payload); err != nil {
+		return nil, err
+	}
+	if payload.DeletedAt != nil {
+		payload.User.DeletedAt = gorm.DeletedAt{Time: *payload.DeletedAt, Valid: true}
+	}
+	return payload.User, nil
+}
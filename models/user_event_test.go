@@ -0,0 +1,40 @@
+package models
+
+import (
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+func TestUserEventPayloadKeepsDeletedAt(t *testing.T) {
+	deletedAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	user := &User{ID: 4, Name: "Deleted User", Email: "deleted@example.com", Password: "hash", DeletedAt: gorm.DeletedAt{Time: deletedAt, Valid: true}}
+
+	var event UserEvent
+	if err := event.SetUser(user); err != nil {
+		t.Fatalf("SetUser() error = %v", err)
+	}
+	if event.UserID != user.ID {
+		t.Errorf("UserID = %d, want %d", event.UserID, user.ID)
+	}
+
+	got, err := event.User()
+	if err != nil {
+		t.Fatalf("User() error = %v", err)
+	}
+	if !got.DeletedAt.Valid || !got.DeletedAt.Time.Equal(deletedAt) {
+		t.Errorf("DeletedAt = %+v, want %s", got.DeletedAt, deletedAt)
+	}
+	if got.Email != user.Email || got.Password != "" {
+		t.Errorf("User() = %+v, want the email without the password hash", got)
+	}
+
+	user.DeletedAt = gorm.DeletedAt{}
+	if err := event.SetUser(user); err != nil {
+		t.Fatalf("SetUser() error = %v", err)
+	}
+	if got, _ := event.User(); got.DeletedAt.Valid {
+		t.Errorf("DeletedAt = %+v for a user that is not deleted", got.DeletedAt)
+	}
+}
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Roles. Every user implicitly has the self-service role, which lets them
+// read and update their own record. Admin and support are granted explicitly.
+const (
+	RoleAdmin       = "admin"
+	RoleSupport     = "support"
+	RoleSelfService = "self-service"
+)
+
+// UserRole represents the user_roles table, the roles granted to a user
+type UserRole struct {
+	ID        uint      `gorm:"primarykey" json:"-"`
+	UserID    uint      `gorm:"uniqueIndex:idx_user_role;not null" json:"-"`
+	Role      string    `gorm:"size:20;uniqueIndex:idx_user_role;not null" json:"role"`
+	GrantedBy uint      `json:"granted_by"`
+	CreatedAt time.Time `json:"granted_at"`
+}
+
+// TableName specifies the table name for UserRole model
+func (UserRole) TableName() string {
+	return "user_roles"
+}
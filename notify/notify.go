@@ -0,0 +1,30 @@
+// Package notify delivers emails to users, such as password reset and email
+// verification tokens
+package notify
+
+import (
+	"context"
+	"log"
+)
+
+// Message is an email addressed to a user
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer writes emails to the standard logger. It is meant for local
+// development, message bodies may hold secrets such as reset tokens.
+type LogMailer struct{}
+
+// Send logs the message
+func (LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
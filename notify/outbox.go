@@ -0,0 +1,50 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileOutbox appends emails as JSON lines to a local file, so flows that send
+// emails can be followed without a mail server
+type FileOutbox struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileOutbox creates an outbox writing to path. The file is created on
+// the first message.
+func NewFileOutbox(path string) *FileOutbox {
+	return &FileOutbox{path: path}
+}
+
+// outboxEntry is a line of the outbox file
+type outboxEntry struct {
+	Message
+	SentAt time.Time `json:"sent_at"`
+}
+
+// Send appends the message to the outbox file
+func (o *FileOutbox) Send(ctx context.Context, msg Message) error {
+	line, err := json.Marshal(outboxEntry{Message: msg, SentAt: time.Now().UTC()})
+	if err != nil {
+		return fmt.Errorf("encode message: %w", err)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	f, err := os.OpenFile(o.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open outbox: %w", err)
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return fmt.Errorf("write outbox: %w", err)
+	}
+	return f.Close()
+}
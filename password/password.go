@@ -0,0 +1,67 @@
+package password
+
+import (
+	"errors"
+)
+
+var (
+	// ErrUnknownFormat is returned when no hasher recognizes a stored hash
+	ErrUnknownFormat = errors.New("unknown password hash format")
+	// ErrInvalidHash is returned when a stored hash is recognized but malformed
+	ErrInvalidHash = errors.New("invalid password hash")
+)
+
+// Hasher hashes passwords with one scheme and verifies hashes produced by it
+type Hasher interface {
+	// Hash returns the encoded hash of a password
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the encoded hash
+	Verify(password, encoded string) (bool, error)
+	// Recognizes reports whether the encoded hash belongs to this scheme
+	Recognizes(encoded string) bool
+	// NeedsRehash reports whether the encoded hash should be replaced, e.g.
+	// because it was made with weaker parameters than the current ones
+	NeedsRehash(encoded string) bool
+}
+
+// Manager hashes new passwords with the preferred hasher and verifies hashes
+// made by it or by any of the legacy hashers
+type Manager struct {
+	preferred Hasher
+	legacy    []Hasher
+}
+
+// NewManager creates a manager hashing with preferred and still accepting
+// hashes made by the legacy hashers
+func NewManager(preferred Hasher, legacy ...Hasher) *Manager {
+	return &Manager{preferred: preferred, legacy: legacy}
+}
+
+// NewDefaultManager hashes with argon2id using the default parameters and
+// accepts the unsalted SHA-256 hashes stored by earlier versions
+func NewDefaultManager() *Manager {
+	return NewManager(NewArgon2id(DefaultArgon2idParams), LegacySHA256{})
+}
+
+// Hash returns the encoded hash of a password made by the preferred hasher
+func (m *Manager) Hash(password string) (string, error) {
+	return m.preferred.Hash(password)
+}
+
+// Verify reports whether password matches the encoded hash. When it does,
+// rehash tells whether the caller should store a fresh hash made by Hash,
+// because the stored one uses a legacy scheme or outdated parameters.
+func (m *Manager) Verify(password, encoded string) (match bool, rehash bool, err error) {
+	if m.preferred.Recognizes(encoded) {
+		match, err = m.preferred.Verify(password, encoded)
+		return match, match && m.preferred.NeedsRehash(encoded), err
+	}
+
+	for _, hasher := range m.legacy {
+		if hasher.Recognizes(encoded) {
+			match, err = hasher.Verify(password, encoded)
+			return match, match, err
+		}
+	}
+	return false, false, ErrUnknownFormat
+}
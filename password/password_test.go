@@ -0,0 +1,178 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+// testParams keep the tests fast, argon2 needs at least 8 KiB per lane
+var testParams = Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+// knownHash is the argon2id test vector of golang.org/x/crypto/argon2 for
+// "password" salted with "somesalt", in PHC format
+const knownHash = "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQ$ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7"
+
+func TestArgon2idHash(t *testing.T) {
+	hasher := NewArgon2id(testParams)
+
+	encoded, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("Hash = %q, want the PHC prefix with the configured parameters", encoded)
+	}
+	if !hasher.Recognizes(encoded) {
+		t.Errorf("Recognizes(%q) = false", encoded)
+	}
+
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		t.Fatalf("decodeArgon2id: %v", err)
+	}
+	if params != testParams {
+		t.Errorf("decoded params = %+v, want %+v", params, testParams)
+	}
+	if len(salt) != int(testParams.SaltLength) || len(key) != int(testParams.KeyLength) {
+		t.Errorf("decoded salt and key are %d and %d bytes", len(salt), len(key))
+	}
+
+	again, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	if again == encoded {
+		t.Error("two hashes of the same password are equal, the salt is not random")
+	}
+}
+
+func TestArgon2idVerify(t *testing.T) {
+	hasher := NewArgon2id(DefaultArgon2idParams)
+	fresh, err := NewArgon2id(testParams).Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		password string
+		encoded  string
+		want     bool
+		wantErr  error
+	}{
+		{"known vector", "password", knownHash, true, nil},
+		{"known vector wrong password", "Password", knownHash, false, nil},
+		{"own hash", "correct horse", fresh, true, nil},
+		{"own hash wrong password", "correct horse!", fresh, false, nil},
+		{"empty password", "", fresh, false, nil},
+		{"wrong version", "password", strings.Replace(knownHash, "v=19", "v=16", 1), false, ErrInvalidHash},
+		{"missing version", "password", "$argon2id$m=64,t=1,p=1$c29tZXNhbHQ$ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7", false, ErrInvalidHash},
+		{"zero memory", "password", strings.Replace(knownHash, "m=64", "m=0", 1), false, ErrInvalidHash},
+		{"bad params", "password", strings.Replace(knownHash, "m=64,t=1,p=1", "m=64;t=1;p=1", 1), false, ErrInvalidHash},
+		{"bad salt", "password", strings.Replace(knownHash, "c29tZXNhbHQ", "c29t*XNhbHQ", 1), false, ErrInvalidHash},
+		{"empty key", "password", strings.TrimSuffix(knownHash, "ZVrRXqxlLcWfcXCnMyv0m4Rpvh/bnCi7"), false, ErrInvalidHash},
+		{"argon2i", "password", strings.Replace(knownHash, "argon2id", "argon2i", 1), false, ErrInvalidHash},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hasher.Verify(tt.password, tt.encoded)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Verify = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	hasher := NewArgon2id(testParams)
+	current, err := hasher.Hash("correct horse")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    bool
+	}{
+		{"current params", current, false},
+		{"more iterations", strings.Replace(current, "t=1", "t=2", 1), true},
+		{"shorter key", knownHash, true},
+		{"malformed", "$argon2id$garbage", true},
+	}
+
+	for _, tt := range tests {
+		if got := hasher.NeedsRehash(tt.encoded); got != tt.want {
+			t.Errorf("%s: NeedsRehash = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLegacySHA256(t *testing.T) {
+	// sha256("password123")
+	const encoded = "ef92b778bafe771e89245b89ecbc08a44a4e166c06659911881f383d4473e94f"
+	legacy := LegacySHA256{}
+
+	if !legacy.Recognizes(encoded) {
+		t.Error("Recognizes = false for a SHA-256 hex digest")
+	}
+	for _, other := range []string{knownHash, encoded[:63], strings.Replace(encoded, "e", "x", 1)} {
+		if legacy.Recognizes(other) {
+			t.Errorf("Recognizes(%q) = true", other)
+		}
+	}
+
+	if ok, _ := legacy.Verify("password123", encoded); !ok {
+		t.Error("Verify of the right password = false")
+	}
+	if ok, _ := legacy.Verify("password124", encoded); ok {
+		t.Error("Verify of a wrong password = true")
+	}
+}
+
+func TestManagerVerify(t *testing.T) {
+	manager := NewManager(NewArgon2id(testParams), LegacySHA256{})
+	current, err := manager.Hash("password123")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	outdated, err := NewArgon2id(Argon2idParams{Memory: 64, Iterations: 2, Parallelism: 1, SaltLength: 16, KeyLength: 32}).Hash("password123")
+	if err != nil {
+		t.Fatalf("Hash: %v", err)
+	}
+	legacy, _ := LegacySHA256{}.Hash("password123")
+
+	tests := []struct {
+		name       string
+		password   string
+		encoded    string
+		wantMatch  bool
+		wantRehash bool
+		wantErr    error
+	}{
+		{"current", "password123", current, true, false, nil},
+		{"current wrong password", "password124", current, false, false, nil},
+		{"outdated params", "password123", outdated, true, true, nil},
+		{"outdated params wrong password", "password124", outdated, false, false, nil},
+		{"legacy sha256", "password123", legacy, true, true, nil},
+		{"legacy sha256 wrong password", "password124", legacy, false, false, nil},
+		{"unknown format", "password123", "$2a$10$abcdefghijklmnopqrstuv", false, false, ErrUnknownFormat},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			match, rehash, err := manager.Verify(tt.password, tt.encoded)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Verify error = %v, want %v", err, tt.wantErr)
+			}
+			if match != tt.wantMatch || rehash != tt.wantRehash {
+				t.Errorf("Verify = %v, %v, want %v, %v", match, rehash, tt.wantMatch, tt.wantRehash)
+			}
+		})
+	}
+}
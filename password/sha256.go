@@ -0,0 +1,38 @@
+package password
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// LegacySHA256 verifies the unsalted hex encoded SHA-256 hashes stored before
+// passwords were hashed with argon2id. It must only be used as a legacy
+// hasher so that matching hashes get replaced.
+type LegacySHA256 struct{}
+
+// Hash returns the hex encoded SHA-256 of a password
+func (LegacySHA256) Hash(password string) (string, error) {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Verify reports whether password matches a hex encoded SHA-256 hash
+func (l LegacySHA256) Verify(password, encoded string) (bool, error) {
+	hash, _ := l.Hash(password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(encoded)) == 1, nil
+}
+
+// Recognizes reports whether encoded is a hex encoded SHA-256 hash
+func (LegacySHA256) Recognizes(encoded string) bool {
+	if len(encoded) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(encoded)
+	return err == nil
+}
+
+// NeedsRehash always reports true, SHA-256 hashes should always be replaced
+func (LegacySHA256) NeedsRehash(encoded string) bool {
+	return true
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+)
+
+// APIKeyRepository handles database operations for API keys
+type APIKeyRepository struct{}
+
+// NewAPIKeyRepository creates a new API key repository
+func NewAPIKeyRepository() *APIKeyRepository {
+	return &APIKeyRepository{}
+}
+
+// Create stores an API key and records the audit event in the same
+// transaction
+func (r *APIKeyRepository) Create(key *models.APIKey, audit *models.AuditEvent) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		return tx.Create(audit).Error
+	})
+}
+
+// GetByID retrieves an API key by ID
+func (r *APIKeyRepository) GetByID(id uint) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := database.DB.First(&key, id).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// GetByPrefix retrieves an API key by the public prefix of the key
+func (r *APIKeyRepository) GetByPrefix(prefix string) (*models.APIKey, error) {
+	var key models.APIKey
+	if err := database.DB.Where("prefix = ?", prefix).First(&key).Error; err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// List retrieves API keys, newest first. An ownerID of 0 lists the keys of
+// all users.
+func (r *APIKeyRepository) List(ownerID uint) ([]models.APIKey, error) {
+	query := database.DB.Order("id DESC")
+	if ownerID != 0 {
+		query = query.Where("owner_id = ?", ownerID)
+	}
+
+	var keys []models.APIKey
+	err := query.Find(&keys).Error
+	return keys, err
+}
+
+// Revoke marks an API key as revoked and records the audit event in the same
+// transaction. It reports false without auditing if the key was already
+// revoked.
+func (r *APIKeyRepository) Revoke(key *models.APIKey, audit *models.AuditEvent) (bool, error) {
+	revoked := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&models.APIKey{}).
+			Where("id = ? AND revoked_at IS NULL", key.ID).
+			Update("revoked_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		revoked = true
+		key.RevokedAt = &now
+		return tx.Create(audit).Error
+	})
+	return revoked, err
+}
+
+// TouchLastUsed records that a key was used at now. To avoid a write on every
+// call, the time is only updated when the stored one is older than
+// granularity.
+func (r *APIKeyRepository) TouchLastUsed(id uint, now time.Time, granularity time.Duration) error {
+	return database.DB.Model(&models.APIKey{}).
+		Where("id = ? AND (last_used_at IS NULL OR last_used_at < ?)", id, now.Add(-granularity)).
+		UpdateColumn("last_used_at", now).Error
+}
@@ -0,0 +1,64 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+)
+
+// AuditListOptions describes which page of audit events List should return.
+// Zero values leave a filter unset.
+type AuditListOptions struct {
+	Limit int
+	// Only events older than this ID, for keyset pagination
+	BeforeID uint
+
+	ActorID      uint
+	TargetUserID uint
+	Method       string
+	Action       string
+	Since        time.Time
+	Until        time.Time
+}
+
+// AuditRepository reads the audit log. Events are written by the
+// repositories making the audited changes, in the same transaction.
+type AuditRepository struct{}
+
+// NewAuditRepository creates a new audit repository
+func NewAuditRepository() *AuditRepository {
+	return &AuditRepository{}
+}
+
+// List retrieves audit events matching the options, newest first. Up to
+// Limit+1 events are returned so callers can tell whether there are more.
+func (r *AuditRepository) List(opts AuditListOptions) ([]models.AuditEvent, error) {
+	query := database.DB.Model(&models.AuditEvent{})
+
+	if opts.BeforeID > 0 {
+		query = query.Where("id < ?", opts.BeforeID)
+	}
+	if opts.ActorID > 0 {
+		query = query.Where("actor_id = ?", opts.ActorID)
+	}
+	if opts.TargetUserID > 0 {
+		query = query.Where("target_user_id = ?", opts.TargetUserID)
+	}
+	if opts.Method != "" {
+		query = query.Where("method = ?", opts.Method)
+	}
+	if opts.Action != "" {
+		query = query.Where("action = ?", opts.Action)
+	}
+	if !opts.Since.IsZero() {
+		query = query.Where("created_at >= ?", opts.Since)
+	}
+	if !opts.Until.IsZero() {
+		query = query.Where("created_at < ?", opts.Until)
+	}
+
+	var events []models.AuditEvent
+	err := query.Order("id DESC").Limit(opts.Limit + 1).Find(&events).Error
+	return events, err
+}
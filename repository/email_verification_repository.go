@@ -0,0 +1,113 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidVerificationToken is returned for verification tokens that are
+// unknown, expired, used or sent to an email the user no longer has
+var ErrInvalidVerificationToken = errors.New("invalid or expired verification token")
+
+// EmailVerificationRepository handles database operations for email
+// verification tokens
+type EmailVerificationRepository struct{}
+
+// NewEmailVerificationRepository creates a new email verification repository
+func NewEmailVerificationRepository() *EmailVerificationRepository {
+	return &EmailVerificationRepository{}
+}
+
+// Create stores a verification token, invalidating the user's earlier tokens
+// so only the latest one can be redeemed
+func (r *EmailVerificationRepository) Create(token *models.EmailVerificationToken) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := invalidateVerificationTokens(tx, token.UserID, time.Now()); err != nil {
+			return err
+		}
+		return tx.Create(token).Error
+	})
+}
+
+// Redeem marks a verification token as used and the email of its user as
+// verified, bumping the user's version. Both happen in one transaction, along
+// with the audit event, whose actor and target are set to the user, and the
+// user event if the email was not verified yet. The token is claimed with a
+// conditional update so it can only be redeemed once.
+func (r *EmailVerificationRepository) Redeem(tokenHash string, audit *models.AuditEvent, event *models.UserEvent) (*models.User, error) {
+	var user models.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var token models.EmailVerificationToken
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, now).First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidVerificationToken
+		}
+		if err != nil {
+			return err
+		}
+
+		result := tx.Model(&models.EmailVerificationToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidVerificationToken
+		}
+
+		if err := tx.Preload("Roles").First(&user, token.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidVerificationToken
+			}
+			return err
+		}
+		if user.Email != token.Email {
+			return ErrInvalidVerificationToken
+		}
+
+		if !user.EmailVerified {
+			user.EmailVerified = true
+			user.Version++
+			user.UpdatedAt = now
+			err = tx.Model(&models.User{}).
+				Where("id = ?", user.ID).
+				Updates(map[string]interface{}{
+					"email_verified": true,
+					"version":        user.Version,
+					"updated_at":     user.UpdatedAt,
+				}).Error
+			if err != nil {
+				return err
+			}
+			audit.ActorID = user.ID
+			audit.TargetUserID = user.ID
+			if err := tx.Create(audit).Error; err != nil {
+				return err
+			}
+			if err := appendUserEvent(tx, event, &user); err != nil {
+				return err
+			}
+		}
+
+		return invalidateVerificationTokens(tx, user.ID, now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// invalidateVerificationTokens marks the outstanding verification tokens of
+// a user as used
+func invalidateVerificationTokens(tx *gorm.DB, userID uint, now time.Time) error {
+	return tx.Model(&models.EmailVerificationToken{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Update("used_at", now).Error
+}
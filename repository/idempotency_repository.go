@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyRepository handles database operations for idempotency records
+type IdempotencyRepository struct{}
+
+// NewIdempotencyRepository creates a new idempotency repository
+func NewIdempotencyRepository() *IdempotencyRepository {
+	return &IdempotencyRepository{}
+}
+
+// Claim stores a new record for its principal and key. If an unexpired
+// record already holds them, that record is returned instead and created is
+// false.
+func (r *IdempotencyRepository) Claim(record *models.IdempotencyRecord) (existing *models.IdempotencyRecord, created bool, err error) {
+	// An expired record, or an in-progress one whose lease ran out, no longer
+	// blocks its key
+	err = database.DB.
+		Where("principal = ? AND idempotency_key = ? AND expires_at <= ?", record.Principal, record.Key, time.Now()).
+		Delete(&models.IdempotencyRecord{}).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	// The holder may release the key between our insert and lookup, so try again
+	for attempt := 0; attempt < 3; attempt++ {
+		result := database.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(record)
+		if result.Error != nil {
+			return nil, false, result.Error
+		}
+		if result.RowsAffected > 0 {
+			return nil, true, nil
+		}
+
+		existing = &models.IdempotencyRecord{}
+		err = database.DB.Where("principal = ? AND idempotency_key = ?", record.Principal, record.Key).First(existing).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			record.ID = 0
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return existing, false, nil
+	}
+	return nil, false, errors.New("idempotency key is changing too often")
+}
+
+// Complete stores the outcome of the call that claimed a record and keeps it
+// until expiresAt. Nothing is stored if the lease ran out and the key was
+// claimed again in the meantime.
+func (r *IdempotencyRepository) Complete(id uint, statusCode uint32, response []byte, expiresAt time.Time) error {
+	return database.DB.Model(&models.IdempotencyRecord{}).
+		Where("id = ? AND completed = ?", id, false).
+		Updates(map[string]interface{}{
+			"completed":   true,
+			"status_code": statusCode,
+			"response":    response,
+			"expires_at":  expiresAt,
+		}).Error
+}
+
+// Release drops a claimed record so the call can be attempted again
+func (r *IdempotencyRepository) Release(id uint) error {
+	return database.DB.Where("id = ? AND completed = ?", id, false).Delete(&models.IdempotencyRecord{}).Error
+}
+
+// DeleteExpired removes records whose TTL has passed
+func (r *IdempotencyRepository) DeleteExpired() error {
+	return database.DB.Where("expires_at <= ?", time.Now()).Delete(&models.IdempotencyRecord{}).Error
+}
@@ -0,0 +1,97 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LoginThrottleRepository handles database operations for failed login
+// counters
+type LoginThrottleRepository struct{}
+
+// NewLoginThrottleRepository creates a new login throttle repository
+func NewLoginThrottleRepository() *LoginThrottleRepository {
+	return &LoginThrottleRepository{}
+}
+
+// Get retrieves the counters for the given keys. Keys without failures are
+// left out.
+func (r *LoginThrottleRepository) Get(keys ...string) ([]models.LoginThrottle, error) {
+	var throttles []models.LoginThrottle
+	err := database.DB.Where("throttle_key IN ?", keys).Find(&throttles).Error
+	return throttles, err
+}
+
+// RecordFailure counts a failure for key at now and returns the updated
+// counter. Failures from before windowStart are forgotten first. The counter
+// is updated in a single statement so concurrent failures are all counted.
+func (r *LoginThrottleRepository) RecordFailure(key string, now, windowStart time.Time) (*models.LoginThrottle, error) {
+	throttle := models.LoginThrottle{Key: key, Failures: 1, LastFailureAt: now}
+	err := database.DB.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "throttle_key"}},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"failures":        gorm.Expr("CASE WHEN login_throttles.last_failure_at < ? THEN 1 ELSE login_throttles.failures + 1 END", windowStart),
+			"last_failure_at": now,
+		}),
+	}).Create(&throttle).Error
+	if err != nil {
+		return nil, err
+	}
+
+	if err := database.DB.Where("throttle_key = ?", key).First(&throttle).Error; err != nil {
+		return nil, err
+	}
+	return &throttle, nil
+}
+
+// Lock locks key until the given time and clears its failures, so the
+// counting starts over once the lock expires
+func (r *LoginThrottleRepository) Lock(key string, until time.Time) error {
+	return database.DB.Model(&models.LoginThrottle{}).
+		Where("throttle_key = ?", key).
+		Updates(map[string]interface{}{
+			"failures":     0,
+			"locked_until": until,
+		}).Error
+}
+
+// Reset forgets the failures and lock of key
+func (r *LoginThrottleRepository) Reset(key string) error {
+	return database.DB.Where("throttle_key = ?", key).Delete(&models.LoginThrottle{}).Error
+}
+
+// Unlock forgets the failures and lock of key and records the audit event in
+// the same transaction. It reports whether key was locked.
+func (r *LoginThrottleRepository) Unlock(key string, now time.Time, audit *models.AuditEvent) (bool, error) {
+	locked := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		var throttle models.LoginThrottle
+		err := tx.Where("throttle_key = ?", key).First(&throttle).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		locked = throttle.LockedUntil != nil && throttle.LockedUntil.After(now)
+
+		if err := tx.Where("throttle_key = ?", key).Delete(&models.LoginThrottle{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(audit).Error
+	})
+	return locked, err
+}
+
+// DeleteStale deletes counters without failures since before that are not
+// locked anymore
+func (r *LoginThrottleRepository) DeleteStale(before, now time.Time) error {
+	return database.DB.
+		Where("last_failure_at < ? AND (locked_until IS NULL OR locked_until < ?)", before, now).
+		Delete(&models.LoginThrottle{}).Error
+}
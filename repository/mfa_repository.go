@@ -0,0 +1,226 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrTOTPAlreadyEnabled is returned when enrolling a user whose TOTP is
+	// already confirmed
+	ErrTOTPAlreadyEnabled = errors.New("TOTP is already enabled")
+	// ErrTOTPNotEnrolled is returned when confirming TOTP for a user without
+	// a pending enrollment
+	ErrTOTPNotEnrolled = errors.New("TOTP is not enrolled")
+	// ErrInvalidMFAChallenge is returned for MFA challenge tokens that are
+	// unknown, expired or already used
+	ErrInvalidMFAChallenge = errors.New("invalid or expired MFA challenge")
+)
+
+// MFARepository handles database operations for TOTP credentials, recovery
+// codes and login challenges
+type MFARepository struct{}
+
+// NewMFARepository creates a new MFA repository
+func NewMFARepository() *MFARepository {
+	return &MFARepository{}
+}
+
+// GetCredential returns the TOTP credential of a user, confirmed or not
+func (r *MFARepository) GetCredential(userID uint) (*models.TOTPCredential, error) {
+	var credential models.TOTPCredential
+	if err := database.DB.Where("user_id = ?", userID).First(&credential).Error; err != nil {
+		return nil, err
+	}
+	return &credential, nil
+}
+
+// SaveEnrollment stores a new unconfirmed TOTP credential, replacing an
+// earlier enrollment that was never confirmed. ErrTOTPAlreadyEnabled is
+// returned if the user has a confirmed credential.
+func (r *MFARepository) SaveEnrollment(credential *models.TOTPCredential) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		var confirmed int64
+		err := tx.Model(&models.TOTPCredential{}).
+			Where("user_id = ? AND confirmed_at IS NOT NULL", credential.UserID).
+			Count(&confirmed).Error
+		if err != nil {
+			return err
+		}
+		if confirmed > 0 {
+			return ErrTOTPAlreadyEnabled
+		}
+
+		if err := tx.Where("user_id = ?", credential.UserID).Delete(&models.TOTPCredential{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(credential).Error
+	})
+}
+
+// Confirm enables TOTP for a user whose code of the given step was accepted.
+// It confirms the pending credential, replaces the recovery codes with new
+// ones and sets the user's TOTPEnabled flag, bumping its version, all in one
+// transaction with the audit and user events. ErrTOTPNotEnrolled is returned
+// if there is no pending enrollment.
+func (r *MFARepository) Confirm(user *models.User, step int64, codeHashes []string, audit *models.AuditEvent, event *models.UserEvent) error {
+	loadedVersion := user.Version
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		result := tx.Model(&models.TOTPCredential{}).
+			Where("user_id = ? AND confirmed_at IS NULL", user.ID).
+			Updates(map[string]interface{}{
+				"confirmed_at": now,
+				"last_step":    step,
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTOTPNotEnrolled
+		}
+
+		if err := replaceRecoveryCodes(tx, user.ID, codeHashes); err != nil {
+			return err
+		}
+
+		user.TOTPEnabled = true
+		if err := updateVersioned(tx, user); err != nil {
+			return err
+		}
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		return appendUserEvent(tx, event, user)
+	})
+	if err != nil {
+		user.TOTPEnabled = false
+		user.Version = loadedVersion
+	}
+	return err
+}
+
+// Disable removes the TOTP credential, recovery codes and outstanding login
+// challenges of a user and clears its TOTPEnabled flag, bumping its version.
+// The audit and user events are recorded in the same transaction.
+func (r *MFARepository) Disable(user *models.User, audit *models.AuditEvent, event *models.UserEvent) error {
+	loadedVersion := user.Version
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.TOTPCredential{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.MFAChallenge{}).Error; err != nil {
+			return err
+		}
+
+		user.TOTPEnabled = false
+		if err := updateVersioned(tx, user); err != nil {
+			return err
+		}
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		return appendUserEvent(tx, event, user)
+	})
+	if err != nil {
+		user.TOTPEnabled = true
+		user.Version = loadedVersion
+	}
+	return err
+}
+
+// UseStep records that a TOTP code of the given step was accepted for a
+// user. It reports false if a code of that step or a later one was already
+// used, which means the code is being replayed.
+func (r *MFARepository) UseStep(userID uint, step int64) (bool, error) {
+	result := database.DB.Model(&models.TOTPCredential{}).
+		Where("user_id = ? AND confirmed_at IS NOT NULL AND last_step < ?", userID, step).
+		Update("last_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected > 0, nil
+}
+
+// UseRecoveryCode marks a recovery code of a user as used, reporting false if
+// it is unknown or was already used. The audit event is recorded in the same
+// transaction.
+func (r *MFARepository) UseRecoveryCode(userID uint, codeHash string, audit *models.AuditEvent) (bool, error) {
+	used := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.RecoveryCode{}).
+			Where("user_id = ? AND code_hash = ? AND used_at IS NULL", userID, codeHash).
+			Update("used_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		used = true
+		return tx.Create(audit).Error
+	})
+	return used, err
+}
+
+// CreateChallenge stores a login challenge, clearing out expired ones
+func (r *MFARepository) CreateChallenge(challenge *models.MFAChallenge) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("expires_at < ?", time.Now()).Delete(&models.MFAChallenge{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(challenge).Error
+	})
+}
+
+// GetChallenge returns an unexpired login challenge by the hash of its token
+func (r *MFARepository) GetChallenge(tokenHash string) (*models.MFAChallenge, error) {
+	var challenge models.MFAChallenge
+	err := database.DB.Where("token_hash = ? AND expires_at > ?", tokenHash, time.Now()).First(&challenge).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidMFAChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
+
+// CompleteChallenge deletes a login challenge once it has been answered, so
+// it cannot be used for a second login. ErrInvalidMFAChallenge is returned if
+// it was already used.
+func (r *MFARepository) CompleteChallenge(challenge *models.MFAChallenge) error {
+	result := database.DB.Delete(&models.MFAChallenge{}, challenge.ID)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrInvalidMFAChallenge
+	}
+	return nil
+}
+
+// replaceRecoveryCodes deletes the recovery codes of a user and stores new
+// ones
+func replaceRecoveryCodes(tx *gorm.DB, userID uint, codeHashes []string) error {
+	if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+		return err
+	}
+
+	codes := make([]models.RecoveryCode, len(codeHashes))
+	for i, hash := range codeHashes {
+		codes[i] = models.RecoveryCode{UserID: userID, CodeHash: hash}
+	}
+	if len(codes) == 0 {
+		return nil
+	}
+	return tx.Create(&codes).Error
+}
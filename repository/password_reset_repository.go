@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"errors"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidResetToken is returned for reset tokens that are unknown,
+// expired or already used
+var ErrInvalidResetToken = errors.New("invalid or expired reset token")
+
+// PasswordResetRepository handles database operations for password reset
+// tokens
+type PasswordResetRepository struct{}
+
+// NewPasswordResetRepository creates a new password reset repository
+func NewPasswordResetRepository() *PasswordResetRepository {
+	return &PasswordResetRepository{}
+}
+
+// Create stores a reset token, invalidating the user's earlier tokens so
+// only the latest one can be redeemed
+func (r *PasswordResetRepository) Create(token *models.PasswordResetToken) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := invalidateResetTokens(tx, token.UserID, time.Now()); err != nil {
+			return err
+		}
+		return tx.Create(token).Error
+	})
+}
+
+// Redeem marks a reset token as used and sets the password hash of its user,
+// bumping the user's version. Both happen in one transaction with the user
+// event and the audit event, whose actor and target are set to the user, and
+// the token is claimed with a conditional update so it can only be redeemed
+// once. ErrInvalidResetToken is returned if the token is unknown, expired,
+// used or belongs to a deleted user.
+func (r *PasswordResetRepository) Redeem(tokenHash, passwordHash string, audit *models.AuditEvent, event *models.UserEvent) (*models.User, error) {
+	var user models.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var token models.PasswordResetToken
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, now).First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidResetToken
+		}
+		if err != nil {
+			return err
+		}
+
+		result := tx.Model(&models.PasswordResetToken{}).
+			Where("id = ? AND used_at IS NULL", token.ID).
+			Update("used_at", now)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrInvalidResetToken
+		}
+
+		if err := tx.Preload("Roles").First(&user, token.UserID).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidResetToken
+			}
+			return err
+		}
+
+		user.Password = passwordHash
+		user.Version++
+		user.UpdatedAt = now
+		err = tx.Model(&models.User{}).
+			Where("id = ?", user.ID).
+			Updates(map[string]interface{}{
+				"password":   user.Password,
+				"version":    user.Version,
+				"updated_at": user.UpdatedAt,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		if err := invalidateResetTokens(tx, user.ID, now); err != nil {
+			return err
+		}
+		audit.ActorID = user.ID
+		audit.TargetUserID = user.ID
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		return appendUserEvent(tx, event, &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// invalidateResetTokens marks the outstanding reset tokens of a user as used
+func invalidateResetTokens(tx *gorm.DB, userID uint, now time.Time) error {
+	return tx.Model(&models.PasswordResetToken{}).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Update("used_at", now).Error
+}
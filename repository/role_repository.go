@@ -0,0 +1,80 @@
+package repository
+
+import (
+	"errors"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrLastAdmin is returned when revoking the admin role from the only admin
+var ErrLastAdmin = errors.New("cannot revoke the last admin")
+
+// RoleRepository handles database operations for user roles
+type RoleRepository struct{}
+
+// NewRoleRepository creates a new role repository
+func NewRoleRepository() *RoleRepository {
+	return &RoleRepository{}
+}
+
+// Grant gives a user a role and records the audit event in the same
+// transaction. It reports false without auditing if the user already had the
+// role.
+func (r *RoleRepository) Grant(role *models.UserRole, audit *models.AuditEvent) (bool, error) {
+	granted := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(role)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		granted = true
+		return tx.Create(audit).Error
+	})
+	return granted, err
+}
+
+// Revoke takes a role away from a user and records the audit event in the
+// same transaction. It reports false without auditing if the user did not
+// have the role, and refuses to remove the last admin.
+func (r *RoleRepository) Revoke(userID uint, role string, audit *models.AuditEvent) (bool, error) {
+	revoked := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if role == models.RoleAdmin {
+			// Soft-deleted users keep their roles but cannot act on them
+			var admins int64
+			err := tx.Model(&models.UserRole{}).
+				Joins("JOIN users ON users.id = user_roles.user_id AND users.deleted_at IS NULL").
+				Where("user_roles.role = ? AND user_roles.user_id <> ?", models.RoleAdmin, userID).
+				Count(&admins).Error
+			if err != nil {
+				return err
+			}
+			if admins == 0 {
+				var held int64
+				if err := tx.Model(&models.UserRole{}).Where("role = ? AND user_id = ?", models.RoleAdmin, userID).Count(&held).Error; err != nil {
+					return err
+				}
+				if held > 0 {
+					return ErrLastAdmin
+				}
+			}
+		}
+
+		result := tx.Where("user_id = ? AND role = ?", userID, role).Delete(&models.UserRole{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		revoked = true
+		return tx.Create(audit).Error
+	})
+	return revoked, err
+}
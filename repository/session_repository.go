@@ -0,0 +1,251 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+)
+
+var (
+	// ErrInvalidRefreshToken is returned for refresh tokens that are unknown,
+	// expired or belong to a revoked session or a deleted user
+	ErrInvalidRefreshToken = errors.New("invalid or expired refresh token")
+	// ErrRefreshTokenReused is returned when a refresh token that was already
+	// rotated is used again. The token has probably been stolen, so the whole
+	// session has been revoked.
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// SessionRepository handles database operations for login sessions and their
+// refresh tokens
+type SessionRepository struct{}
+
+// NewSessionRepository creates a new session repository
+func NewSessionRepository() *SessionRepository {
+	return &SessionRepository{}
+}
+
+// Create stores a new session along with its first refresh token
+func (r *SessionRepository) Create(session *models.Session, token *models.RefreshToken) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(session).Error; err != nil {
+			return err
+		}
+		token.SessionID = session.ID
+		return tx.Create(token).Error
+	})
+}
+
+// GetUserByRefreshToken retrieves the user of a refresh token that has not
+// been exchanged yet, is not expired and belongs to an active session. Any
+// other token gives ErrInvalidRefreshToken.
+func (r *SessionRepository) GetUserByRefreshToken(tokenHash string, now time.Time) (*models.User, error) {
+	var token models.RefreshToken
+	err := database.DB.Where("token_hash = ? AND rotated_at IS NULL", tokenHash).First(&token).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !now.Before(token.ExpiresAt)) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session models.Session
+	err = database.DB.First(&session, token.SessionID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && !session.Active(now)) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	err = database.DB.First(&user, session.UserID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Rotate exchanges a refresh token for next, which must have its hash and
+// expiry set, and records where the session was used from. The old token is
+// claimed with a conditional update so it can only be exchanged once; using
+// it again revokes the session, records reuseAudit with the actor, target and
+// details filled in, and returns ErrRefreshTokenReused.
+func (r *SessionRepository) Rotate(tokenHash string, next *models.RefreshToken, userAgent, ipAddress string, reuseAudit *models.AuditEvent) (*models.Session, *models.User, error) {
+	var session models.Session
+	var user models.User
+	reused := false
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+
+		var token models.RefreshToken
+		err := tx.Where("token_hash = ?", tokenHash).First(&token).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := tx.First(&session, token.SessionID).Error; err != nil {
+			return err
+		}
+		if session.RevokedAt != nil {
+			return ErrInvalidRefreshToken
+		}
+
+		if token.RotatedAt == nil {
+			if !now.Before(token.ExpiresAt) {
+				return ErrInvalidRefreshToken
+			}
+			result := tx.Model(&models.RefreshToken{}).
+				Where("id = ? AND rotated_at IS NULL", token.ID).
+				Update("rotated_at", now)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected == 1 {
+				return rotate(tx, &session, &user, next, userAgent, ipAddress, now)
+			}
+		}
+
+		// The token was exchanged before, by this caller or by whoever it
+		// leaked to. Either way the session can no longer be trusted.
+		reused = true
+		err = tx.Model(&models.Session{}).
+			Where("id = ?", session.ID).
+			Updates(map[string]interface{}{"revoked_at": now, "revoke_reason": models.SessionRevokedReuse}).Error
+		if err != nil {
+			return err
+		}
+		details, _ := json.Marshal(map[string]interface{}{
+			"session_id": session.ID,
+			"ip_address": ipAddress,
+		})
+		reuseAudit.ActorID = session.UserID
+		reuseAudit.TargetUserID = session.UserID
+		reuseAudit.Details = string(details)
+		return tx.Create(reuseAudit).Error
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if reused {
+		return nil, nil, ErrRefreshTokenReused
+	}
+	return &session, &user, nil
+}
+
+// rotate stores the next refresh token of a session and loads its user
+func rotate(tx *gorm.DB, session *models.Session, user *models.User, next *models.RefreshToken, userAgent, ipAddress string, now time.Time) error {
+	if err := tx.Preload("Roles").First(user, session.UserID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrInvalidRefreshToken
+		}
+		return err
+	}
+
+	next.SessionID = session.ID
+	if err := tx.Create(next).Error; err != nil {
+		return err
+	}
+
+	session.UserAgent = userAgent
+	session.IPAddress = ipAddress
+	session.LastUsedAt = now
+	session.ExpiresAt = next.ExpiresAt
+	return tx.Model(&models.Session{}).
+		Where("id = ?", session.ID).
+		Updates(map[string]interface{}{
+			"user_agent":   session.UserAgent,
+			"ip_address":   session.IPAddress,
+			"last_used_at": session.LastUsedAt,
+			"expires_at":   session.ExpiresAt,
+		}).Error
+}
+
+// GetByID retrieves a session by ID
+func (r *SessionRepository) GetByID(id uint) (*models.Session, error) {
+	var session models.Session
+	if err := database.DB.First(&session, id).Error; err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// IsActive reports whether a session exists and is neither revoked nor
+// expired
+func (r *SessionRepository) IsActive(id uint, now time.Time) (bool, error) {
+	var count int64
+	err := database.DB.Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", id, now).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// ListActive retrieves the sessions of a user that are neither revoked nor
+// expired, most recently used first
+func (r *SessionRepository) ListActive(userID uint, now time.Time) ([]models.Session, error) {
+	var sessions []models.Session
+	err := database.DB.
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, now).
+		Order("last_used_at DESC, id DESC").
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// Revoke revokes a session and records the audit event in the same
+// transaction. It reports false without auditing if the session was already
+// revoked.
+func (r *SessionRepository) Revoke(session *models.Session, reason string, audit *models.AuditEvent) (bool, error) {
+	revoked := false
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		now := time.Now()
+		result := tx.Model(&models.Session{}).
+			Where("id = ? AND revoked_at IS NULL", session.ID).
+			Updates(map[string]interface{}{"revoked_at": now, "revoke_reason": reason})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		revoked = true
+		session.RevokedAt = &now
+		session.RevokeReason = reason
+		return tx.Create(audit).Error
+	})
+	return revoked, err
+}
+
+// RevokeAll revokes the sessions of a user except the one with exceptID, if
+// not zero, and returns how many were revoked. The audit event, if any, is
+// recorded in the same transaction when at least one session was revoked.
+func (r *SessionRepository) RevokeAll(userID, exceptID uint, reason string, audit *models.AuditEvent) (int64, error) {
+	var revoked int64
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		query := tx.Model(&models.Session{}).Where("user_id = ? AND revoked_at IS NULL", userID)
+		if exceptID != 0 {
+			query = query.Where("id <> ?", exceptID)
+		}
+
+		result := query.Updates(map[string]interface{}{"revoked_at": time.Now(), "revoke_reason": reason})
+		if result.Error != nil {
+			return result.Error
+		}
+		revoked = result.RowsAffected
+		if revoked == 0 || audit == nil {
+			return nil
+		}
+		return tx.Create(audit).Error
+	})
+	return revoked, err
+}
@@ -0,0 +1,44 @@
+package repository
+
+import (
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+)
+
+// UserEventRepository handles database operations for user events
+type UserEventRepository struct{}
+
+// NewUserEventRepository creates a new user event repository
+func NewUserEventRepository() *UserEventRepository {
+	return &UserEventRepository{}
+}
+
+// ListAfter retrieves up to limit events with a sequence greater than afterSequence
+func (r *UserEventRepository) ListAfter(afterSequence uint, limit int) ([]models.UserEvent, error) {
+	var events []models.UserEvent
+	err := database.DB.
+		Where("id > ?", afterSequence).
+		Order("id ASC").
+		Limit(limit).
+		Find(&events).Error
+	return events, err
+}
+
+// LastSequence returns the sequence of the newest event, 0 if there is none
+func (r *UserEventRepository) LastSequence() (uint, error) {
+	var sequence uint
+	err := database.DB.Model(&models.UserEvent{}).Select("COALESCE(MAX(id), 0)").Scan(&sequence).Error
+	return sequence, err
+}
+
+// appendUserEvent stores an event with the new state of the user within the
+// transaction making the change, so every committed change is in the log.
+// SQLite runs one write transaction at a time, so sequences are handed out in
+// commit order.
+func appendUserEvent(tx *gorm.DB, event *models.UserEvent, user *models.User) error {
+	if err := event.SetUser(user); err != nil {
+		return err
+	}
+	return tx.Create(event).Error
+}
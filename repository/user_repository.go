@@ -1,10 +1,44 @@
 package repository
 
 import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/riskykurniawan15/learn-grpc/database"
 	"github.com/riskykurniawan15/learn-grpc/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// ErrVersionConflict is returned when a conditional write finds the user at a
+// different version than expected
+var ErrVersionConflict = errors.New("version conflict")
+
+// UserListOptions describes which page of users List should return
+type UserListOptions struct {
+	Limit   int
+	OrderBy string // one of name, email, age, created_at, deleted_at
+	Desc    bool
+	After   *UserCursor
+	// List soft-deleted users instead of active ones
+	Deleted bool
+
+	MinAge        int
+	MaxAge        int
+	NamePrefix    string
+	EmailDomain   string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// UserCursor marks the last row of a previous page for keyset pagination
+type UserCursor struct {
+	Value interface{}
+	ID    uint
+}
+
 // UserRepository handles database operations for users
 type UserRepository struct{}
 
@@ -13,15 +47,47 @@ func NewUserRepository() *UserRepository {
 	return &UserRepository{}
 }
 
-// Create creates a new user
-func (r *UserRepository) Create(user *models.User) error {
-	return database.DB.Create(user).Error
+// Create creates a new user and records the audit event, targeting the new
+// user, and the user event in the same transaction
+func (r *UserRepository) Create(user *models.User, audit *models.AuditEvent, event *models.UserEvent) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(user).Error; err != nil {
+			return err
+		}
+		audit.TargetUserID = user.ID
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		return appendUserEvent(tx, event, user)
+	})
+}
+
+// CreateBatch creates users in a single transaction along with their audit
+// and user events, audits[i] and events[i] recording the creation of users[i]
+func (r *UserRepository) CreateBatch(users []*models.User, audits []*models.AuditEvent, events []*models.UserEvent) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(users).Error; err != nil {
+			return err
+		}
+		for i, user := range users {
+			audits[i].TargetUserID = user.ID
+		}
+		if err := tx.Create(audits).Error; err != nil {
+			return err
+		}
+		for i, user := range users {
+			if err := appendUserEvent(tx, events[i], user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // GetByID retrieves a user by ID
 func (r *UserRepository) GetByID(id uint) (*models.User, error) {
 	var user models.User
-	err := database.DB.First(&user, id).Error
+	err := database.DB.Preload("Roles").First(&user, id).Error
 	if err != nil {
 		return nil, err
 	}
@@ -31,26 +97,353 @@ func (r *UserRepository) GetByID(id uint) (*models.User, error) {
 // GetByEmail retrieves a user by email
 func (r *UserRepository) GetByEmail(email string) (*models.User, error) {
 	var user models.User
-	err := database.DB.Where("email = ?", email).First(&user).Error
+	err := database.DB.Preload("Roles").Where("email = ?", email).First(&user).Error
 	if err != nil {
 		return nil, err
 	}
 	return &user, nil
 }
 
+// GetExistingEmails returns which of the given emails already belong to a user
+func (r *UserRepository) GetExistingEmails(emails []string) ([]string, error) {
+	var existing []string
+	err := database.DB.Model(&models.User{}).Where("email IN ?", emails).Pluck("email", &existing).Error
+	return existing, err
+}
+
 // GetAll retrieves all users
 func (r *UserRepository) GetAll() ([]models.User, error) {
 	var users []models.User
-	err := database.DB.Find(&users).Error
+	err := database.DB.Preload("Roles").Find(&users).Error
 	return users, err
 }
 
-// Update updates a user
-func (r *UserRepository) Update(user *models.User) error {
-	return database.DB.Save(user).Error
+// List retrieves a filtered and ordered page of users along with the number
+// of users matching the filters across all pages. The page holds at most
+// opts.Limit rows, plus one extra row when more results follow.
+func (r *UserRepository) List(opts UserListOptions) ([]models.User, int64, error) {
+	query := database.DB.Model(&models.User{})
+	if opts.Deleted {
+		query = query.Unscoped().Where("deleted_at IS NOT NULL")
+	}
+
+	if opts.MinAge > 0 {
+		query = query.Where("age >= ?", opts.MinAge)
+	}
+	if opts.MaxAge > 0 {
+		query = query.Where("age <= ?", opts.MaxAge)
+	}
+	if opts.NamePrefix != "" {
+		query = query.Where("name LIKE ? ESCAPE '\\'", escapeLike(opts.NamePrefix)+"%")
+	}
+	if opts.EmailDomain != "" {
+		query = query.Where("LOWER(email) LIKE ? ESCAPE '\\'", "%@"+escapeLike(strings.ToLower(opts.EmailDomain)))
+	}
+	if !opts.CreatedAfter.IsZero() {
+		query = query.Where("created_at > ?", opts.CreatedAfter)
+	}
+	if !opts.CreatedBefore.IsZero() {
+		query = query.Where("created_at < ?", opts.CreatedBefore)
+	}
+
+	// Share the filters between the count and the page query
+	query = query.Session(&gorm.Session{})
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	direction, cmp := "ASC", ">"
+	if opts.Desc {
+		direction, cmp = "DESC", "<"
+	}
+
+	if opts.After != nil {
+		query = query.Where(
+			fmt.Sprintf("(%[1]s %[2]s ?) OR (%[1]s = ? AND id %[2]s ?)", opts.OrderBy, cmp),
+			opts.After.Value, opts.After.Value, opts.After.ID,
+		)
+	}
+
+	var users []models.User
+	err := query.
+		Preload("Roles").
+		Order(fmt.Sprintf("%s %s, id %s", opts.OrderBy, direction, direction)).
+		Limit(opts.Limit + 1).
+		Find(&users).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	return users, total, nil
+}
+
+// UserSearchResult is a user matching a search along with its relevance.
+// Higher scores rank first.
+type UserSearchResult struct {
+	models.User `gorm:"embedded"`
+	Score       float64
+}
+
+// Search finds active users whose name or email contain words starting with
+// each of the terms, best matches first. It uses the users_fts index when
+// available and LIKE otherwise.
+func (r *UserRepository) Search(terms []string, limit int) ([]UserSearchResult, error) {
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var results []UserSearchResult
+	query := database.DB.Unscoped().Model(&models.User{}).Where("users.deleted_at IS NULL")
+
+	if database.UserSearchFTS {
+		// Quote every term so FTS5 operators in the input are matched literally
+		match := make([]string, len(terms))
+		for i, term := range terms {
+			match[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+		}
+
+		// bm25 is lower for better matches; name matches weigh twice as much
+		err := query.
+			Select("users.*, -bm25(users_fts, 2.0, 1.0) AS score").
+			Joins("JOIN users_fts ON users_fts.rowid = users.id").
+			Where("users_fts MATCH ?", strings.Join(match, " ")).
+			Order("score DESC, users.id").
+			Limit(limit).
+			Scan(&results).Error
+		if err != nil {
+			return nil, err
+		}
+		return results, attachRoles(results)
+	}
+
+	// Without FTS every term must appear in the name or email. Terms starting
+	// a word of the name score highest, then terms starting a part of the
+	// email.
+	var (
+		scores []string
+		args   []interface{}
+	)
+	for _, term := range terms {
+		term = escapeLike(strings.ToLower(term))
+		query = query.Where("(LOWER(users.name) LIKE ? ESCAPE '\\' OR LOWER(users.email) LIKE ? ESCAPE '\\')", "%"+term+"%", "%"+term+"%")
+		scores = append(scores, "CASE WHEN LOWER(users.name) LIKE ? ESCAPE '\\' OR LOWER(users.name) LIKE ? ESCAPE '\\' THEN 2 "+
+			"WHEN LOWER(users.email) LIKE ? ESCAPE '\\' OR LOWER(users.email) LIKE ? ESCAPE '\\' OR LOWER(users.email) LIKE ? ESCAPE '\\' THEN 1 ELSE 0.5 END")
+		args = append(args, term+"%", "% "+term+"%", term+"%", "%@"+term+"%", "%."+term+"%")
+	}
+
+	err := query.
+		Select("users.*, ("+strings.Join(scores, " + ")+") AS score", args...).
+		Order("score DESC, users.id").
+		Limit(limit).
+		Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, attachRoles(results)
+}
+
+// attachRoles loads the roles of search results, which Preload cannot do for
+// scanned rows
+func attachRoles(results []UserSearchResult) error {
+	if len(results) == 0 {
+		return nil
+	}
+
+	ids := make([]uint, len(results))
+	for i := range results {
+		ids[i] = results[i].ID
+	}
+
+	var roles []models.UserRole
+	if err := database.DB.Where("user_id IN ?", ids).Order("role").Find(&roles).Error; err != nil {
+		return err
+	}
+
+	byUser := make(map[uint][]models.UserRole)
+	for _, role := range roles {
+		byUser[role.UserID] = append(byUser[role.UserID], role)
+	}
+	for i := range results {
+		results[i].Roles = byUser[results[i].ID]
+	}
+	return nil
+}
+
+// escapeLike escapes the LIKE wildcards in s so it is matched literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// Update saves a user and bumps its version. The write only succeeds if the
+// row is still at the version the user was loaded with, otherwise
+// ErrVersionConflict is returned and the user is left unchanged. The audit
+// and user events are recorded in the same transaction.
+func (r *UserRepository) Update(user *models.User, audit *models.AuditEvent, event *models.UserEvent) error {
+	loadedVersion := user.Version
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := updateVersioned(tx, user); err != nil {
+			return err
+		}
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		return appendUserEvent(tx, event, user)
+	})
+	if err != nil {
+		user.Version = loadedVersion
+	}
+	return err
+}
+
+// updateVersioned saves a user within a transaction and bumps its version,
+// returning ErrVersionConflict if the row is no longer at the version the
+// user was loaded with. Callers restore the version if the transaction fails.
+func updateVersioned(tx *gorm.DB, user *models.User) error {
+	loadedVersion := user.Version
+	user.Version++
+
+	result := tx.Model(user).
+		Where("version = ?", loadedVersion).
+		Select("*").
+		Omit("created_at", "deleted_at", clause.Associations).
+		Updates(user)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrVersionConflict
+	}
+	return nil
+}
+
+// Delete deletes a user. When expectedVersion is not zero the user is only
+// deleted if it is still at that version, otherwise ErrVersionConflict is
+// returned. The audit and user events are recorded in the same transaction.
+func (r *UserRepository) Delete(user *models.User, expectedVersion uint, audit *models.AuditEvent, event *models.UserEvent) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		query := tx
+		if expectedVersion > 0 {
+			query = query.Where("version = ?", expectedVersion)
+		}
+
+		result := query.Delete(&models.User{}, user.ID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			if expectedVersion > 0 {
+				return ErrVersionConflict
+			}
+			// Deleted by someone else in the meantime, nothing to record
+			return nil
+		}
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		// Reload to pick up the deletion time for the event
+		if err := tx.Unscoped().First(user, user.ID).Error; err != nil {
+			return err
+		}
+		return appendUserEvent(tx, event, user)
+	})
+}
+
+// GetDeletedByID retrieves a soft-deleted user by ID
+func (r *UserRepository) GetDeletedByID(id uint) (*models.User, error) {
+	var user models.User
+	err := database.DB.Unscoped().Preload("Roles").Where("deleted_at IS NOT NULL").First(&user, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ReplacePasswordHash swaps the stored password hash for an equivalent one,
+// e.g. after upgrading the hashing scheme. It leaves the version and
+// updated_at alone since the password itself did not change, and does nothing
+// if the password was changed in the meantime.
+func (r *UserRepository) ReplacePasswordHash(id uint, oldHash, newHash string) error {
+	return database.DB.Model(&models.User{}).
+		Where("id = ? AND password = ?", id, oldHash).
+		UpdateColumn("password", newHash).Error
+}
+
+// Restore clears the deletion mark of a soft-deleted user and returns the
+// restored user. The audit event and the user event are recorded in the same
+// transaction.
+func (r *UserRepository) Restore(id uint, audit *models.AuditEvent, event *models.UserEvent) (*models.User, error) {
+	var user models.User
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Unscoped().
+			Model(&models.User{}).
+			Where("id = ? AND deleted_at IS NOT NULL", id).
+			Updates(map[string]interface{}{
+				"deleted_at": nil,
+				"version":    gorm.Expr("version + 1"),
+			})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+
+		if err := tx.Preload("Roles").First(&user, id).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		return appendUserEvent(tx, event, &user)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
 }
 
-// Delete deletes a user by ID
-func (r *UserRepository) Delete(id uint) error {
-	return database.DB.Delete(&models.User{}, id).Error
+// Purge permanently removes a user along with its roles, password reset and
+// email verification tokens, API keys, sessions and MFA credentials, and
+// records the audit event and the purge event in the same transaction. Audit
+// events and earlier change events of the user are kept, the log is only
+// ever appended to.
+func (r *UserRepository) Purge(id uint, audit *models.AuditEvent, event *models.UserEvent) error {
+	return database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", id).Delete(&models.UserRole{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.PasswordResetToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.EmailVerificationToken{}).Error; err != nil {
+			return err
+		}
+		sessions := tx.Model(&models.Session{}).Select("id").Where("user_id = ?", id)
+		if err := tx.Where("session_id IN (?)", sessions).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.Session{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("owner_id = ?", id).Delete(&models.APIKey{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.TOTPCredential{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", id).Delete(&models.MFAChallenge{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Unscoped().Delete(&models.User{}, id).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(audit).Error; err != nil {
+			return err
+		}
+		return appendUserEvent(tx, event, &models.User{ID: id})
+	})
 }
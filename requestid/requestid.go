@@ -0,0 +1,56 @@
+// Package requestid tags each call with an ID that ties together the logs,
+// audit events and error reports it produces. Callers may send their own ID,
+// e.g. one the HTTP gateway passed on, otherwise a random one is generated.
+package requestid
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// Metadata is the gRPC metadata key, and HTTP header, carrying request IDs
+const Metadata = "x-request-id"
+
+// maxLength is the longest request ID accepted from callers
+const maxLength = 64
+
+// New returns a random request ID
+func New() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand does not fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Valid reports whether an ID sent by a caller can be used as is. IDs end up
+// in logs, so only short IDs of letters, digits, '-', '_' and '.' are
+// accepted.
+func Valid(id string) bool {
+	if id == "" || len(id) > maxLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+type requestIDKey struct{}
+
+// NewContext returns a copy of ctx carrying the request ID
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// FromContext returns the request ID stored in ctx, or ""
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,82 @@
+// Package rpcerror translates errors from the repositories into gRPC statuses
+// that are safe to return. Driver messages can contain SQL and user data, so
+// the cause is only logged, tagged with the request ID that the caller
+// receives in the message and in google.rpc.ErrorInfo metadata.
+package rpcerror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/requestid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// Domain identifies this service in google.rpc.ErrorInfo details
+	Domain = "user.UserService"
+
+	// StorageReason is the ErrorInfo reason of failed database operations.
+	// Its request_id metadata finds the cause in the server logs.
+	StorageReason = "STORAGE_ERROR"
+)
+
+// Storage translates a failed database operation. action says what failed,
+// e.g. "Failed to create user", and starts the returned message.
+//
+//   - canceled or timed out calls become Canceled or DeadlineExceeded
+//   - missing records become NotFound
+//   - unique constraint violations become AlreadyExists
+//   - a busy or locked database becomes Unavailable, the call can be retried
+//   - anything else becomes Internal
+func Storage(ctx context.Context, action string, err error) *status.Status {
+	code, message := codes.Internal, action
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		code, message = codes.Canceled, action+": request was canceled"
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		code, message = codes.DeadlineExceeded, action+": request timed out"
+	case repository.IsNotFound(err):
+		code, message = codes.NotFound, action+": not found"
+	case repository.IsUniqueViolation(err):
+		code, message = codes.AlreadyExists, action+": a conflicting record already exists"
+	case repository.IsBusy(err):
+		code, message = codes.Unavailable, action+": database is busy, try again"
+	}
+
+	id := requestid.FromContext(ctx)
+	if id == "" {
+		// Calls that bypassed the request ID interceptor still get an ID to
+		// match the log line with
+		id = requestid.New()
+	}
+	log.Printf("%s [request %s, %s]: %v", action, id, code, err)
+
+	st := status.New(code, fmt.Sprintf("%s (request ID %s)", message, id))
+	detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   StorageReason,
+		Domain:   Domain,
+		Metadata: map[string]string{"request_id": id},
+	})
+	if detailErr != nil {
+		return st
+	}
+	return detailed
+}
+
+// Lookup translates a failed fetch of a record the caller asked for. A
+// missing record is reported with the notFound message, e.g. "User not
+// found", anything else as in Storage.
+func Lookup(ctx context.Context, notFound string, err error) *status.Status {
+	if repository.IsNotFound(err) {
+		return status.New(codes.NotFound, notFound)
+	}
+	what := strings.ToLower(strings.TrimSuffix(notFound, " not found"))
+	return Storage(ctx, "Failed to look up "+what, err)
+}
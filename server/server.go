@@ -1,37 +1,375 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"log"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/config"
 	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/encryption"
+	"github.com/riskykurniawan15/learn-grpc/interceptor"
+	"github.com/riskykurniawan15/learn-grpc/lockout"
+	"github.com/riskykurniawan15/learn-grpc/notify"
+	"github.com/riskykurniawan15/learn-grpc/password"
 	"github.com/riskykurniawan15/learn-grpc/proto"
 	"github.com/riskykurniawan15/learn-grpc/service"
+	"github.com/riskykurniawan15/learn-grpc/tlsconfig"
 	"github.com/riskykurniawan15/learn-grpc/validation"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
+// authPolicy lists who may call each RPC. RPCs missing here are rejected.
+var authPolicy = interceptor.AuthPolicy{
+	// Signing up, verifying the email, logging in (with the MFA step),
+	// refreshing a session and resetting a forgotten password
+	proto.UserService_CreateUser_FullMethodName:              interceptor.Public,
+	proto.UserService_VerifyEmail_FullMethodName:             interceptor.Public,
+	proto.UserService_ResendVerificationEmail_FullMethodName: interceptor.Public,
+	proto.UserService_Authenticate_FullMethodName:            interceptor.Public,
+	proto.UserService_RequestPasswordReset_FullMethodName:    interceptor.Public,
+	proto.UserService_ConfirmPasswordReset_FullMethodName:    interceptor.Public,
+	proto.UserService_RefreshSession_FullMethodName:          interceptor.Public,
+	proto.UserService_VerifyMfa_FullMethodName:               interceptor.Public,
+
+	proto.UserService_BulkCreateUsers_FullMethodName:   interceptor.Authenticated,
+	proto.UserService_GetUser_FullMethodName:           interceptor.Authenticated,
+	proto.UserService_GetAllUsers_FullMethodName:       interceptor.Authenticated,
+	proto.UserService_ListUsers_FullMethodName:         interceptor.Authenticated,
+	proto.UserService_SearchUsers_FullMethodName:       interceptor.Authenticated,
+	proto.UserService_UpdateUser_FullMethodName:        interceptor.Authenticated,
+	proto.UserService_DeleteUser_FullMethodName:        interceptor.Authenticated,
+	proto.UserService_UndeleteUser_FullMethodName:      interceptor.Authenticated,
+	proto.UserService_ListDeletedUsers_FullMethodName:  interceptor.Authenticated,
+	proto.UserService_WatchUsers_FullMethodName:        interceptor.Authenticated,
+	proto.UserService_GrantRole_FullMethodName:         interceptor.Authenticated,
+	proto.UserService_RevokeRole_FullMethodName:        interceptor.Authenticated,
+	proto.UserService_ChangePassword_FullMethodName:    interceptor.Authenticated,
+	proto.UserService_CreateApiKey_FullMethodName:      interceptor.Authenticated,
+	proto.UserService_ListApiKeys_FullMethodName:       interceptor.Authenticated,
+	proto.UserService_RevokeApiKey_FullMethodName:      interceptor.Authenticated,
+	proto.UserService_UnlockUser_FullMethodName:        interceptor.Authenticated,
+	proto.UserService_ListSessions_FullMethodName:      interceptor.Authenticated,
+	proto.UserService_RevokeSession_FullMethodName:     interceptor.Authenticated,
+	proto.UserService_RevokeAllSessions_FullMethodName: interceptor.Authenticated,
+	proto.UserService_ListAuditEvents_FullMethodName:   interceptor.Authenticated,
+	proto.UserService_EnrollTotp_FullMethodName:        interceptor.Authenticated,
+	proto.UserService_ConfirmTotp_FullMethodName:       interceptor.Authenticated,
+	proto.UserService_DisableTotp_FullMethodName:       interceptor.Authenticated,
+	// Also requires the admin key
+	proto.UserService_PurgeUser_FullMethodName: interceptor.Authenticated,
+
+	// Probed by load balancers and orchestrators
+	healthpb.Health_Check_FullMethodName: interceptor.Public,
+	healthpb.Health_Watch_FullMethodName: interceptor.Public,
+}
+
 func main() {
+	cfg, err := config.LoadServer(os.Args[1:])
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	log.Printf("Configuration:\n%s", config.Redacted(cfg))
+
+	// Cancelled on SIGINT or SIGTERM to start a graceful shutdown
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	// Initialize database
-	database.InitDatabase()
+	database.InitDatabase(cfg.DatabasePath)
+
+	// Make mutating calls safe to retry with an idempotency key
+	idempotency := interceptor.NewIdempotency(cfg.IdempotencyTTL,
+		proto.UserService_CreateUser_FullMethodName,
+		proto.UserService_UpdateUser_FullMethodName,
+		proto.UserService_DeleteUser_FullMethodName,
+		proto.UserService_UndeleteUser_FullMethodName,
+		proto.UserService_PurgeUser_FullMethodName,
+	)
+
+	// Check access tokens right after a request ID is assigned, before the
+	// idempotency check and the handlers run
+	tokens := tokenManager(cfg.Auth)
+	authenticator := interceptor.NewAuthenticator(tokens, authPolicy)
 
 	// Create gRPC server
-	grpcServer := grpc.NewServer()
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			interceptor.RequestIDUnaryServerInterceptor(),
+			authenticator.UnaryServerInterceptor(),
+			idempotency.UnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			interceptor.RequestIDStreamServerInterceptor(),
+			authenticator.StreamServerInterceptor(),
+		),
+	}
+	if creds := serverCredentials(ctx, cfg.TLS); creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	grpcServer := grpc.NewServer(opts...)
 
 	// Register user service
 	userService := service.NewUserService(validation.NewValidator())
+	userService.SetAdminKey(cfg.AdminAPIKey)
+	userService.SetPasswordHasher(password.NewArgon2id(argon2idParams(cfg.Argon2id)))
+	userService.SetTokenManager(tokens)
+	userService.SetMFACipher(mfaCipher(cfg.Auth))
+	userService.SetMailer(mailer(cfg.Mail))
+	userService.SetLockoutPolicies(lockoutPolicies(cfg.Lockout))
+	proxies, err := cfg.TrustedProxyPrefixes()
+	if err != nil {
+		log.Fatalf("Invalid configuration: trusted_proxies: %v", err)
+	}
+	userService.SetTrustedProxies(proxies)
+	userService.SetPasswordResetTTL(cfg.Auth.PasswordResetTTL)
+	userService.SetRefreshTokenTTL(cfg.Auth.RefreshTokenTTL)
+	userService.SetEmailVerificationTTL(cfg.Auth.EmailVerificationTTL)
+	if cfg.Auth.RequireVerifiedEmail {
+		userService.SetRequireVerifiedEmail(true)
+		log.Println("Users must verify their email before logging in")
+	}
+	if !cfg.Auth.RequireAdminMFA {
+		userService.SetRequireAdminMFA(false)
+		log.Println("REQUIRE_ADMIN_MFA is false, admins can act without MFA")
+	}
 	proto.RegisterUserServiceServer(grpcServer, userService)
 
-	// Start listening on port 50051
-	lis, err := net.Listen("tcp", ":50051")
+	// Standard gRPC health checks, for the server as a whole ("") and the
+	// user service
+	healthServer := newHealthService()
+	healthServer.SetServingStatus(proto.UserService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+
+	lis, err := net.Listen("tcp", cfg.ListenAddr)
 	if err != nil {
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	log.Println("gRPC server starting on port 50051...")
+	log.Printf("gRPC server starting on %s...", cfg.ListenAddr)
 
 	// Start serving
-	if err := grpcServer.Serve(lis); err != nil {
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- grpcServer.Serve(lis)
+	}()
+	select {
+	case err := <-serveErr:
 		log.Fatalf("Failed to serve: %v", err)
+	case <-ctx.Done():
+	}
+	// A second signal kills the process right away
+	stop()
+
+	shutdown(grpcServer, healthServer, userService, cfg.ShutdownDrainDelay, cfg.ShutdownTimeout)
+}
+
+// shutdown stops the server gracefully. Health checks report NOT_SERVING and
+// calls are still served for the drain delay, giving load balancers time to
+// stop routing new calls here. Then watch streams are ended, and in-flight
+// calls get until the timeout to finish before they are cancelled. The
+// database is closed last, once no call can use it anymore.
+func shutdown(grpcServer *grpc.Server, healthServer *healthService, userService *service.UserService, drainDelay, timeout time.Duration) {
+	healthServer.Shutdown()
+	if drainDelay > 0 {
+		log.Printf("Shutting down, serving for another %s while load balancers drain...", drainDelay)
+		time.Sleep(drainDelay)
+	}
+
+	log.Printf("Stopping, waiting up to %s for in-flight calls...", timeout)
+	userService.CloseWatchers()
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		log.Println("All calls finished")
+	case <-time.After(timeout):
+		log.Println("Shutdown timeout reached, cancelling the remaining calls")
+		grpcServer.Stop()
+		<-stopped
+	}
+
+	if err := database.Close(); err != nil {
+		log.Printf("Failed to close database: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// healthService is the standard health server, except that Watch streams end
+// once shutdown starts. Otherwise clients watching the health would hold up
+// GracefulStop until the timeout.
+type healthService struct {
+	*health.Server
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+func newHealthService() *healthService {
+	return &healthService{Server: health.NewServer(), done: make(chan struct{})}
+}
+
+// Shutdown reports NOT_SERVING for every service and ends all Watch streams
+func (h *healthService) Shutdown() {
+	h.Server.Shutdown()
+	h.doneOnce.Do(func() { close(h.done) })
+}
+
+func (h *healthService) Watch(req *healthpb.HealthCheckRequest, stream healthpb.Health_WatchServer) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- h.Server.Watch(req, watchStream{Health_WatchServer: stream, ctx: ctx})
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-h.done:
+		cancel()
+		<-result
+		// The status may not have been sent before the stream was cancelled
+		stream.Send(&healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_NOT_SERVING})
+		return status.Error(codes.Unavailable, "Server is shutting down")
+	}
+}
+
+// watchStream replaces the context of a Watch stream
+type watchStream struct {
+	healthpb.Health_WatchServer
+	ctx context.Context
+}
+
+func (s watchStream) Context() context.Context {
+	return s.ctx
+}
+
+// argon2idParams applies the configured password hashing costs to the
+// defaults
+func argon2idParams(cfg config.Argon2id) password.Argon2idParams {
+	params := password.DefaultArgon2idParams
+	params.Memory = cfg.Memory
+	params.Iterations = cfg.Iterations
+	params.Parallelism = cfg.Parallelism
+	return params
+}
+
+// tokenManager signs access tokens with the JWT secret. Without a secret a
+// random one is generated, so tokens stop working on restart.
+func tokenManager(cfg config.Auth) *auth.TokenManager {
+	secret := []byte(cfg.JWTSecret)
+	if len(secret) == 0 {
+		log.Println("JWT_SECRET is not set, using a random secret; tokens will not survive a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			log.Fatalf("Failed to generate JWT secret: %v", err)
+		}
 	}
+
+	return auth.NewTokenManager(secret, "learn-grpc", cfg.JWTTTL)
+}
+
+// mfaCipher encrypts TOTP secrets with the MFA encryption key. Without a key
+// a random one is generated, so authenticator apps enrolled before a restart
+// stop working and only recovery codes are left.
+func mfaCipher(cfg config.Auth) *encryption.Cipher {
+	key, err := cfg.MFAKey()
+	if err != nil {
+		log.Fatalf("Invalid MFA_ENCRYPTION_KEY: %v", err)
+	}
+	if key == nil {
+		log.Println("MFA_ENCRYPTION_KEY is not set, using a random key; enrolled authenticator apps will not survive a restart")
+		key = make([]byte, encryption.KeySize)
+		if _, err := rand.Read(key); err != nil {
+			log.Fatalf("Failed to generate MFA encryption key: %v", err)
+		}
+	}
+
+	cipher, err := encryption.NewCipher(key)
+	if err != nil {
+		log.Fatalf("Invalid MFA_ENCRYPTION_KEY: %v", err)
+	}
+	return cipher
+}
+
+// mailer delivers emails such as password reset tokens. With an SMTP address
+// they are sent through that SMTP server, authenticating with the username
+// and password if given. Otherwise they are appended to the outbox file when
+// it is set, or logged.
+func mailer(cfg config.Mail) notify.Mailer {
+	if cfg.SMTPAddr != "" {
+		smtpMailer, err := notify.NewSMTPMailer(notify.SMTPConfig{
+			Addr:     cfg.SMTPAddr,
+			Username: cfg.SMTPUsername,
+			Password: cfg.SMTPPassword,
+			From:     cfg.SMTPFrom,
+		})
+		if err != nil {
+			log.Fatalf("Invalid SMTP settings: %v", err)
+		}
+		log.Printf("Sending emails through %s", cfg.SMTPAddr)
+		return smtpMailer
+	}
+	if cfg.Outbox != "" {
+		log.Printf("Writing emails to %s", cfg.Outbox)
+		return notify.NewFileOutbox(cfg.Outbox)
+	}
+	return notify.LogMailer{}
+}
+
+// serverCredentials serves TLS with the configured key pair, requiring client
+// certificates issued by the client CA when it is set. The files are checked
+// for changes every reload interval until ctx is done. Without a certificate
+// the server listens in plaintext and nil is returned.
+func serverCredentials(ctx context.Context, cfg config.ServerTLS) credentials.TransportCredentials {
+	if !cfg.Enabled() {
+		log.Println("TLS_CERT_FILE is not set, serving plaintext")
+		return nil
+	}
+
+	reloader, err := tlsconfig.NewReloader(cfg.CertFile, cfg.KeyFile, cfg.ClientCAFile)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificates: %v", err)
+	}
+	tlsCfg, err := tlsconfig.Server(reloader)
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	go reloader.Watch(ctx, cfg.ReloadInterval)
+
+	if reloader.HasCA() {
+		log.Println("Serving TLS, client certificates required")
+	} else {
+		log.Println("Serving TLS")
+	}
+	return credentials.NewTLS(tlsCfg)
+}
+
+// lockoutPolicies applies the configured thresholds, the failures that lock
+// out an account or a client address, and the lock duration to the default
+// policies. config.Server.Validate checks that the thresholds come after the
+// delays start.
+func lockoutPolicies(cfg config.Lockout) (lockout.Policy, lockout.Policy) {
+	account, address := lockout.DefaultAccountPolicy, lockout.DefaultAddressPolicy
+	account.LockAfter = cfg.AccountThreshold
+	address.LockAfter = cfg.AddressThreshold
+	account.LockDuration = cfg.Duration
+	address.LockDuration = cfg.Duration
+	return account, address
 }
@@ -0,0 +1,37 @@
+package service
+
+import (
+	"context"
+	"crypto/subtle"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// AdminKeyMetadata is the metadata key carrying the admin key for admin-only RPCs
+const AdminKeyMetadata = "x-admin-key"
+
+// SetAdminKey sets the key callers must present to use admin-only RPCs. Admin
+// RPCs are rejected while no key is set.
+func (s *UserService) SetAdminKey(key string) {
+	s.adminKey = key
+}
+
+// requireAdminKey checks that the caller presented the admin key
+func (s *UserService) requireAdminKey(ctx context.Context) error {
+	if s.adminKey == "" {
+		return status.Error(codes.PermissionDenied, "Admin operations are disabled")
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	keys := md.Get(AdminKeyMetadata)
+	if len(keys) == 0 {
+		return status.Error(codes.PermissionDenied, "Admin key required")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(keys[0]), []byte(s.adminKey)) != 1 {
+		return status.Error(codes.PermissionDenied, "Invalid admin key")
+	}
+	return nil
+}
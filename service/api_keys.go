@@ -0,0 +1,299 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"github.com/riskykurniawan15/learn-grpc/validation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// apiKeyExcludedScopes are the UserService methods API keys may never call,
+// since managing credentials needs a logged in user
+var apiKeyExcludedScopes = map[string]bool{
+	"Authenticate":      true,
+	"ChangePassword":    true,
+	"CreateApiKey":      true,
+	"ListApiKeys":       true,
+	"RevokeApiKey":      true,
+	"RefreshSession":    true,
+	"ListSessions":      true,
+	"RevokeSession":     true,
+	"RevokeAllSessions": true,
+	"EnrollTotp":        true,
+	"ConfirmTotp":       true,
+	"DisableTotp":       true,
+	"VerifyMfa":         true,
+}
+
+// validAPIKeyScope reports whether scope names a UserService method that API
+// keys may be allowed to call
+func validAPIKeyScope(scope string) bool {
+	if apiKeyExcludedScopes[scope] {
+		return false
+	}
+	for _, method := range proto.UserService_ServiceDesc.Methods {
+		if method.MethodName == scope {
+			return true
+		}
+	}
+	for _, stream := range proto.UserService_ServiceDesc.Streams {
+		if stream.StreamName == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// toProtoAPIKey converts an API key model to its proto message
+func toProtoAPIKey(key *models.APIKey) *proto.ApiKey {
+	protoKey := &proto.ApiKey{
+		Id:        int64(key.ID),
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.ScopeList(),
+		OwnerId:   int64(key.OwnerID),
+		CreatedAt: timestamppb.New(key.CreatedAt),
+	}
+	if key.ExpiresAt != nil {
+		protoKey.ExpiresAt = timestamppb.New(*key.ExpiresAt)
+	}
+	if key.LastUsedAt != nil {
+		protoKey.LastUsedAt = timestamppb.New(*key.LastUsedAt)
+	}
+	if key.RevokedAt != nil {
+		protoKey.RevokedAt = timestamppb.New(*key.RevokedAt)
+	}
+	return protoKey
+}
+
+// CreateApiKey creates an API key acting for the caller
+func (s *UserService) CreateApiKey(ctx context.Context, req *proto.CreateApiKeyRequest) (*proto.CreateApiKeyResponse, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.CreateApiKeyResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	var scopes []string
+	for _, scope := range req.Scopes {
+		scope = strings.TrimSpace(scope)
+		if scope != "" && !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	slices.Sort(scopes)
+
+	createReq := models.CreateAPIKeyRequest{
+		Name:   strings.TrimSpace(req.Name),
+		Scopes: scopes,
+	}
+
+	if err := s.validator.ValidateStruct(createReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.CreateApiKeyResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	var violations []validation.FieldViolation
+	for _, scope := range scopes {
+		if !validAPIKeyScope(scope) {
+			violations = append(violations, validation.FieldViolation{
+				Field:   "scopes",
+				Rule:    "unknown_scope",
+				Message: fmt.Sprintf("scope %q is not a UserService method API keys may call", scope),
+			})
+		}
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresAt != nil {
+		if err := req.ExpiresAt.CheckValid(); err != nil || !req.ExpiresAt.AsTime().After(time.Now()) {
+			violations = append(violations, validation.FieldViolation{
+				Field:   "expires_at",
+				Rule:    "future",
+				Message: "expires_at must be in the future",
+			})
+		} else {
+			t := req.ExpiresAt.AsTime()
+			expiresAt = &t
+		}
+	}
+
+	if len(violations) > 0 {
+		messages := make([]string, len(violations))
+		for i, violation := range violations {
+			messages[i] = violation.Message
+		}
+		return &proto.CreateApiKeyResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(messages, "; "),
+		}, validationFailed(violations)
+	}
+
+	secret, prefix, err := auth.GenerateAPIKey()
+	if err != nil {
+		log.Printf("Failed to generate API key for user %d: %v", caller.ID, err)
+		return &proto.CreateApiKeyResponse{
+			Success: false,
+			Message: "Failed to create API key",
+		}, status.Error(codes.Internal, "Failed to create API key")
+	}
+
+	key := &models.APIKey{
+		Name:      createReq.Name,
+		Prefix:    prefix,
+		KeyHash:   auth.HashAPIKey(secret),
+		Scopes:    strings.Join(scopes, " "),
+		OwnerID:   caller.ID,
+		ExpiresAt: expiresAt,
+	}
+	audit := s.auditContext(ctx, apiKeyAuditEvent(models.AuditAPIKeyCreated, caller, key))
+
+	if err := s.apiKeyRepo.Create(key, audit); err != nil {
+		st := rpcerror.Storage(ctx, "Failed to create API key", err)
+		return &proto.CreateApiKeyResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	return &proto.CreateApiKeyResponse{
+		ApiKey:  toProtoAPIKey(key),
+		Key:     secret,
+		Message: "API key created successfully, store the key now as it cannot be shown again",
+		Success: true,
+	}, nil
+}
+
+// ListApiKeys lists the caller's API keys, or the keys of all users for
+// admins
+func (s *UserService) ListApiKeys(ctx context.Context, req *proto.ListApiKeysRequest) (*proto.ListApiKeysResponse, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.ListApiKeysResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	ownerID := caller.ID
+	if s.hasRole(caller, models.RoleAdmin) {
+		ownerID = 0
+	}
+
+	keys, err := s.apiKeyRepo.List(ownerID)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to list API keys", err)
+		return &proto.ListApiKeysResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	protoKeys := make([]*proto.ApiKey, len(keys))
+	for i := range keys {
+		protoKeys[i] = toProtoAPIKey(&keys[i])
+	}
+
+	return &proto.ListApiKeysResponse{
+		ApiKeys: protoKeys,
+		Message: "API keys retrieved successfully",
+		Success: true,
+	}, nil
+}
+
+// RevokeApiKey revokes an API key. Owners may revoke their own keys and
+// admins any key.
+func (s *UserService) RevokeApiKey(ctx context.Context, req *proto.RevokeApiKeyRequest) (*proto.RevokeApiKeyResponse, error) {
+	if req.Id <= 0 {
+		return &proto.RevokeApiKeyResponse{
+			Success: false,
+			Message: "Invalid API key ID",
+		}, status.Error(codes.InvalidArgument, "Invalid API key ID")
+	}
+
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.RevokeApiKeyResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	key, err := s.apiKeyRepo.GetByID(uint(req.Id))
+	if err != nil {
+		if repository.IsNotFound(err) {
+			return &proto.RevokeApiKeyResponse{
+				Success: false,
+				Message: "API key not found",
+			}, status.Error(codes.NotFound, "API key not found")
+		}
+		st := rpcerror.Storage(ctx, "Failed to get API key", err)
+		return &proto.RevokeApiKeyResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	if key.OwnerID != caller.ID && !s.hasRole(caller, models.RoleAdmin) {
+		return &proto.RevokeApiKeyResponse{
+			Success: false,
+			Message: "You can only revoke your own API keys",
+		}, status.Error(codes.PermissionDenied, "You can only revoke your own API keys")
+	}
+
+	audit := s.auditContext(ctx, apiKeyAuditEvent(models.AuditAPIKeyRevoked, caller, key))
+
+	revoked, err := s.apiKeyRepo.Revoke(key, audit)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to revoke API key", err)
+		return &proto.RevokeApiKeyResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	message := "API key revoked successfully"
+	if !revoked {
+		message = "API key was already revoked"
+	}
+
+	return &proto.RevokeApiKeyResponse{
+		ApiKey:  toProtoAPIKey(key),
+		Message: message,
+		Success: true,
+	}, nil
+}
+
+// apiKeyAuditEvent builds the audit event recording a change to an API key
+func apiKeyAuditEvent(action string, caller *models.User, key *models.APIKey) *models.AuditEvent {
+	data, _ := json.Marshal(map[string]interface{}{
+		"api_key_prefix": key.Prefix,
+		"name":           key.Name,
+		"scopes":         key.ScopeList(),
+	})
+
+	return &models.AuditEvent{
+		ActorID:      caller.ID,
+		Action:       action,
+		TargetUserID: key.OwnerID,
+		Details:      string(data),
+	}
+}
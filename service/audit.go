@@ -0,0 +1,297 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/requestid"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"github.com/riskykurniawan15/learn-grpc/validation"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// auditContext fills in where an audit event came from: the method, the API
+// key the actor called with, the client address and the request ID
+func (s *UserService) auditContext(ctx context.Context, event *models.AuditEvent) *models.AuditEvent {
+	if method, ok := grpc.Method(ctx); ok {
+		event.Method = method[strings.LastIndex(method, "/")+1:]
+	}
+	if principal, ok := auth.FromContext(ctx); ok {
+		event.ActorAPIKeyID = principal.APIKeyID
+	}
+	event.IPAddress = s.clientAddress(ctx)
+	event.RequestID = requestid.FromContext(ctx)
+	return event
+}
+
+// userAuditEvent builds the audit event recording a change to a user made by
+// the caller. before is nil for created users and after for deleted ones.
+func (s *UserService) userAuditEvent(ctx context.Context, action string, before, after *models.User) *models.AuditEvent {
+	event := &models.AuditEvent{Action: action}
+	if principal, ok := auth.FromContext(ctx); ok {
+		event.ActorID = principal.UserID
+	}
+	if before != nil {
+		event.TargetUserID = before.ID
+	} else {
+		event.TargetUserID = after.ID
+	}
+	event.SetChanges(userChanges(before, after))
+	return s.auditContext(ctx, event)
+}
+
+// userChanges returns the fields that differ between two states of a user.
+// Password hashes are never recorded, only that the password changed.
+func userChanges(before, after *models.User) map[string]models.FieldChange {
+	changes := map[string]models.FieldChange{}
+	add := func(field string, get func(*models.User) interface{}) {
+		change := models.FieldChange{}
+		if before != nil {
+			change.Before = get(before)
+		}
+		if after != nil {
+			change.After = get(after)
+		}
+		if change.Before != change.After {
+			changes[field] = change
+		}
+	}
+
+	add("name", func(u *models.User) interface{} { return u.Name })
+	add("email", func(u *models.User) interface{} { return u.Email })
+	add("age", func(u *models.User) interface{} { return u.Age })
+	add("email_verified", func(u *models.User) interface{} { return u.EmailVerified })
+	add("totp_enabled", func(u *models.User) interface{} { return u.TOTPEnabled })
+
+	if before == nil || after == nil || before.Password != after.Password {
+		change := models.FieldChange{}
+		if before != nil {
+			change.Before = models.RedactedValue
+		}
+		if after != nil {
+			change.After = models.RedactedValue
+		}
+		changes["password"] = change
+	}
+
+	return changes
+}
+
+// ListAuditEvents lists audit events, newest first, optionally filtered by
+// actor, target user, method, action and time range
+func (s *UserService) ListAuditEvents(ctx context.Context, req *proto.ListAuditEventsRequest) (*proto.ListAuditEventsResponse, error) {
+	if _, err := s.requireRole(ctx, models.RoleAdmin); err != nil {
+		return &proto.ListAuditEventsResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	listReq := models.ListAuditEventsRequest{
+		PageSize: int(req.PageSize),
+		Method:   strings.TrimSpace(req.Method),
+		Action:   strings.TrimSpace(req.Action),
+	}
+
+	if err := s.validator.ValidateStruct(listReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.ListAuditEventsResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	var violations []validation.FieldViolation
+	if req.ActorId < 0 {
+		violations = append(violations, validation.FieldViolation{
+			Field:   "actor_id",
+			Rule:    "min",
+			Message: "actor_id must not be negative",
+		})
+	}
+	if req.TargetUserId < 0 {
+		violations = append(violations, validation.FieldViolation{
+			Field:   "target_user_id",
+			Rule:    "min",
+			Message: "target_user_id must not be negative",
+		})
+	}
+	if req.StartTime != nil && req.EndTime != nil && !req.EndTime.AsTime().After(req.StartTime.AsTime()) {
+		violations = append(violations, validation.FieldViolation{
+			Field:   "end_time",
+			Rule:    "after",
+			Message: "end_time must be after start_time",
+		})
+	}
+	if len(violations) > 0 {
+		messages := make([]string, len(violations))
+		for i, violation := range violations {
+			messages[i] = violation.Message
+		}
+		return &proto.ListAuditEventsResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(messages, "; "),
+		}, validationFailed(violations)
+	}
+
+	opts := repository.AuditListOptions{
+		Limit:        listReq.PageSize,
+		ActorID:      uint(req.ActorId),
+		TargetUserID: uint(req.TargetUserId),
+		Method:       listReq.Method,
+		Action:       listReq.Action,
+	}
+	if opts.Limit == 0 {
+		opts.Limit = defaultPageSize
+	}
+	if opts.Limit > maxPageSize {
+		opts.Limit = maxPageSize
+	}
+
+	// Timestamps are stored in local time, so compare them in local time too
+	if req.StartTime != nil {
+		opts.Since = req.StartTime.AsTime().Local()
+	}
+	if req.EndTime != nil {
+		opts.Until = req.EndTime.AsTime().Local()
+	}
+
+	if req.PageToken != "" {
+		beforeID, err := decodeAuditPageToken(req.PageToken, opts)
+		if err != nil {
+			return &proto.ListAuditEventsResponse{
+				Success: false,
+				Message: "Invalid page token",
+			}, status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+		opts.BeforeID = beforeID
+	}
+
+	events, err := s.auditRepo.List(opts)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to retrieve audit events", err)
+		return &proto.ListAuditEventsResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	// The repository returns one extra event when another page follows
+	var nextPageToken string
+	if len(events) > opts.Limit {
+		events = events[:opts.Limit]
+		nextPageToken = encodeAuditPageToken(opts, events[len(events)-1].ID)
+	}
+
+	protoEvents := make([]*proto.AuditEvent, len(events))
+	for i := range events {
+		protoEvents[i] = toProtoAuditEvent(&events[i])
+	}
+
+	return &proto.ListAuditEventsResponse{
+		Events:        protoEvents,
+		NextPageToken: nextPageToken,
+		Message:       "Audit events retrieved successfully",
+		Success:       true,
+	}, nil
+}
+
+// toProtoAuditEvent converts an audit event model to its proto message
+func toProtoAuditEvent(event *models.AuditEvent) *proto.AuditEvent {
+	protoEvent := &proto.AuditEvent{
+		Id:            int64(event.ID),
+		ActorId:       int64(event.ActorID),
+		ActorApiKeyId: int64(event.ActorAPIKeyID),
+		Action:        event.Action,
+		Method:        event.Method,
+		TargetUserId:  int64(event.TargetUserID),
+		IpAddress:     event.IPAddress,
+		RequestId:     event.RequestID,
+		CreatedAt:     timestamppb.New(event.CreatedAt),
+	}
+
+	changes, err := event.ChangeSet()
+	if err != nil {
+		log.Printf("Audit event %d has malformed changes: %v", event.ID, err)
+	}
+	fields := make([]string, 0, len(changes))
+	for field := range changes {
+		fields = append(fields, field)
+	}
+	slices.Sort(fields)
+	for _, field := range fields {
+		change := &proto.FieldChange{Field: field}
+		// Values come from JSON, so they always convert
+		if changes[field].Before != nil {
+			change.Before, _ = structpb.NewValue(changes[field].Before)
+		}
+		if changes[field].After != nil {
+			change.After, _ = structpb.NewValue(changes[field].After)
+		}
+		protoEvent.Changes = append(protoEvent.Changes, change)
+	}
+
+	if event.Details != "" {
+		var details map[string]interface{}
+		if err := json.Unmarshal([]byte(event.Details), &details); err == nil {
+			protoEvent.Details, _ = structpb.NewStruct(details)
+		} else {
+			log.Printf("Audit event %d has malformed details: %v", event.ID, err)
+		}
+	}
+
+	return protoEvent
+}
+
+// auditFilterFingerprint summarizes the filters of an audit event query
+func auditFilterFingerprint(opts repository.AuditListOptions) string {
+	key := fmt.Sprintf("%d|%d|%s|%s|%d|%d",
+		opts.ActorID, opts.TargetUserID, opts.Method, opts.Action,
+		unixNanoOrZero(opts.Since), unixNanoOrZero(opts.Until))
+	sum := sha256.Sum256([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// encodeAuditPageToken builds the token pointing just past the event with the
+// given ID. It reuses the ListUsers token format, ordered by id descending.
+func encodeAuditPageToken(opts repository.AuditListOptions, lastID uint) string {
+	data, _ := json.Marshal(pageToken{
+		OrderBy: "id",
+		Desc:    true,
+		Filter:  auditFilterFingerprint(opts),
+		ID:      lastID,
+	})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeAuditPageToken returns the ID an audit event page token points past,
+// rejecting tokens issued for different filters
+func decodeAuditPageToken(raw string, opts repository.AuditListOptions) (uint, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return 0, errInvalidPageToken
+	}
+
+	var token pageToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return 0, errInvalidPageToken
+	}
+	if token.OrderBy != "id" || !token.Desc || token.Filter != auditFilterFingerprint(opts) || token.ID == 0 {
+		return 0, errInvalidPageToken
+	}
+	return token.ID, nil
+}
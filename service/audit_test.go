@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+// lastAuditEvent returns the newest audit event with the action
+func lastAuditEvent(t *testing.T, action string) *models.AuditEvent {
+	t.Helper()
+	var event models.AuditEvent
+	if err := database.DB.Where("action = ?", action).Order("id DESC").First(&event).Error; err != nil {
+		t.Fatalf("no %s audit event: %v", action, err)
+	}
+	return &event
+}
+
+func TestConfirmPasswordResetIsAudited(t *testing.T) {
+	s := newTestService(t)
+	user := createTestUser(t, "reset@example.com")
+
+	token := "reset-token"
+	err := s.resetRepo.Create(&models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hashOneTimeToken(token),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("create reset token: %v", err)
+	}
+
+	if _, err := s.ConfirmPasswordReset(context.Background(), &proto.ConfirmPasswordResetRequest{Token: token, NewPassword: "NewPassw0rd!"}); err != nil {
+		t.Fatalf("ConfirmPasswordReset: %v", err)
+	}
+
+	event := lastAuditEvent(t, models.AuditPasswordReset)
+	if event.ActorID != user.ID || event.TargetUserID != user.ID {
+		t.Errorf("actor %d, target %d, want both %d", event.ActorID, event.TargetUserID, user.ID)
+	}
+	changes, _ := event.ChangeSet()
+	if changes["password"].After != models.RedactedValue {
+		t.Errorf("changes = %s, want a redacted password change", event.Changes)
+	}
+}
+
+func TestVerifyEmailIsAudited(t *testing.T) {
+	s := newTestService(t)
+	user := createTestUser(t, "verify@example.com")
+
+	token := "verification-token"
+	err := s.verificationRepo.Create(&models.EmailVerificationToken{
+		UserID:    user.ID,
+		Email:     user.Email,
+		TokenHash: hashOneTimeToken(token),
+		ExpiresAt: time.Now().Add(time.Hour),
+	})
+	if err != nil {
+		t.Fatalf("create verification token: %v", err)
+	}
+
+	if _, err := s.VerifyEmail(context.Background(), &proto.VerifyEmailRequest{Token: token}); err != nil {
+		t.Fatalf("VerifyEmail: %v", err)
+	}
+
+	event := lastAuditEvent(t, models.AuditEmailVerified)
+	if event.ActorID != user.ID || event.TargetUserID != user.ID {
+		t.Errorf("actor %d, target %d, want both %d", event.ActorID, event.TargetUserID, user.ID)
+	}
+	changes, _ := event.ChangeSet()
+	if changes["email_verified"].After != true {
+		t.Errorf("changes = %s, want email_verified set", event.Changes)
+	}
+}
+
+func TestUndeleteAndPurgeAreAudited(t *testing.T) {
+	s := newTestService(t)
+	s.SetRequireAdminMFA(false)
+	s.SetAdminKey("admin-key")
+
+	admin := createTestUser(t, "admin@example.com")
+	if err := database.DB.Create(&models.UserRole{UserID: admin.ID, Role: models.RoleAdmin}).Error; err != nil {
+		t.Fatalf("grant admin: %v", err)
+	}
+	ctx := auth.NewContext(context.Background(), &auth.Principal{UserID: admin.ID, Email: admin.Email})
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(AdminKeyMetadata, "admin-key"))
+
+	user := createTestUser(t, "deleted@example.com")
+	if err := database.DB.Delete(user).Error; err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+
+	if _, err := s.UndeleteUser(ctx, &proto.UndeleteUserRequest{Id: int64(user.ID)}); err != nil {
+		t.Fatalf("UndeleteUser: %v", err)
+	}
+	event := lastAuditEvent(t, models.AuditUserRestored)
+	if event.ActorID != admin.ID || event.TargetUserID != user.ID {
+		t.Errorf("restore actor %d, target %d, want %d, %d", event.ActorID, event.TargetUserID, admin.ID, user.ID)
+	}
+
+	if err := database.DB.Delete(user).Error; err != nil {
+		t.Fatalf("delete user: %v", err)
+	}
+	if _, err := s.PurgeUser(ctx, &proto.PurgeUserRequest{Id: int64(user.ID)}); err != nil {
+		t.Fatalf("PurgeUser: %v", err)
+	}
+	event = lastAuditEvent(t, models.AuditUserPurged)
+	if event.ActorID != admin.ID || event.TargetUserID != user.ID {
+		t.Errorf("purge actor %d, target %d, want %d, %d", event.ActorID, event.TargetUserID, admin.ID, user.ID)
+	}
+
+	var audited int64
+	database.DB.Model(&models.AuditEvent{}).Where("target_user_id = ?", user.ID).Count(&audited)
+	if audited != 2 {
+		t.Errorf("%d audit events about the purged user, want 2", audited)
+	}
+}
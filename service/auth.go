@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// SetTokenManager sets the manager issuing access tokens. Authenticate is
+// rejected while no manager is set.
+func (s *UserService) SetTokenManager(tokens *auth.TokenManager) {
+	s.tokens = tokens
+}
+
+// Authenticate checks an email and password, starts a session and issues an
+// access token and refresh token for it. Users with MFA enabled get an MFA
+// challenge instead, completed with VerifyMfa.
+func (s *UserService) Authenticate(ctx context.Context, req *proto.AuthenticateRequest) (*proto.AuthenticateResponse, error) {
+	if s.tokens == nil {
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: "Authentication is disabled",
+		}, status.Error(codes.Unavailable, "Authentication is disabled")
+	}
+
+	authReq := models.AuthenticateRequest{
+		Email:    req.Email,
+		Password: req.Password,
+	}
+
+	if err := s.validator.ValidateStruct(authReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	// Refuse before looking at the password, so a locked account cannot be
+	// used to test guesses
+	if err := s.checkLoginAllowed(ctx, authReq.Email); err != nil {
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	user, err := s.userRepo.GetByEmail(authReq.Email)
+	if err != nil {
+		// Spend about as long as checking a real password so response times
+		// do not reveal which emails are registered
+		s.passwords.Hash(authReq.Password)
+		s.lockout.Failure(authReq.Email, s.clientAddress(ctx))
+		return invalidCredentials()
+	}
+
+	if !s.checkPassword(user, authReq.Password) {
+		s.lockout.Failure(authReq.Email, s.clientAddress(ctx))
+		return invalidCredentials()
+	}
+	// With MFA the failures are only cleared once the code checks out too,
+	// so alternating between the two steps cannot reset the lockout
+	if !user.TOTPEnabled {
+		s.lockout.Success(authReq.Email)
+	}
+
+	// Checked after the password so it does not reveal which emails exist
+	if s.requireVerifiedEmail && !user.EmailVerified {
+		return emailNotVerified()
+	}
+
+	if user.TOTPEnabled {
+		return s.startMFAChallenge(ctx, user)
+	}
+	return s.completeLogin(ctx, user)
+}
+
+// completeLogin starts a session for a user who proved who they are and
+// issues its tokens
+func (s *UserService) completeLogin(ctx context.Context, user *models.User) (*proto.AuthenticateResponse, error) {
+	session, refreshToken, err := s.startSession(ctx, user)
+	if err != nil {
+		log.Printf("Failed to start session for user %d: %v", user.ID, err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: "Failed to start session",
+		}, status.Error(codes.Internal, "Failed to start session")
+	}
+
+	token, expiresAt, err := s.tokens.Issue(user.ID, user.Email, session.ID)
+	if err != nil {
+		log.Printf("Failed to issue token for user %d: %v", user.ID, err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: "Failed to issue token",
+		}, status.Error(codes.Internal, "Failed to issue token")
+	}
+
+	return &proto.AuthenticateResponse{
+		AccessToken:           token,
+		TokenType:             auth.TokenType,
+		ExpiresAt:             timestamppb.New(expiresAt),
+		User:                  toProtoUser(user),
+		Message:               "Authenticated successfully",
+		Success:               true,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: timestamppb.New(session.ExpiresAt),
+		SessionId:             int64(session.ID),
+	}, nil
+}
+
+// invalidCredentials is the single answer for unknown emails and wrong
+// passwords, so callers cannot tell the two apart
+func invalidCredentials() (*proto.AuthenticateResponse, error) {
+	return &proto.AuthenticateResponse{
+		Success: false,
+		Message: "Invalid email or password",
+	}, status.Error(codes.Unauthenticated, "Invalid email or password")
+}
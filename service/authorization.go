@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"slices"
+	"strings"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// currentCaller loads the authenticated user making a request along with
+// their roles. Roles are read on every call so grants and revocations apply
+// to tokens that were already issued.
+func (s *UserService) currentCaller(ctx context.Context) (*models.User, error) {
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Authentication required")
+	}
+
+	caller, err := s.userRepo.GetByID(principal.UserID)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "The authenticated user no longer exists")
+	}
+	return caller, nil
+}
+
+// hasRole reports whether the caller may act with a role. Admins only count
+// as such once they have enabled MFA, unless that requirement is turned off.
+func (s *UserService) hasRole(caller *models.User, role string) bool {
+	if role == models.RoleAdmin && s.requireAdminMFA && !caller.TOTPEnabled {
+		return false
+	}
+	return caller.HasRole(role)
+}
+
+// requireRole checks that the caller has one of the roles
+func (s *UserService) requireRole(ctx context.Context, roles ...string) (*models.User, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, role := range roles {
+		if s.hasRole(caller, role) {
+			return caller, nil
+		}
+	}
+	return nil, s.roleDenied(caller, roles)
+}
+
+// requireSelfOrRole checks that the caller is acting on their own record or
+// has one of the roles
+func (s *UserService) requireSelfOrRole(ctx context.Context, userID uint, roles ...string) (*models.User, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if caller.ID == userID {
+		return caller, nil
+	}
+	for _, role := range roles {
+		if s.hasRole(caller, role) {
+			return caller, nil
+		}
+	}
+	if adminWithoutMFA(caller, roles) {
+		return nil, s.roleDenied(caller, roles)
+	}
+	return nil, status.Error(codes.PermissionDenied, "You can only access your own user")
+}
+
+// roleDenied explains why a caller lacking all of the roles was refused,
+// pointing admins who have not enabled MFA at how to do so
+func (s *UserService) roleDenied(caller *models.User, roles []string) error {
+	if s.requireAdminMFA && adminWithoutMFA(caller, roles) {
+		return status.Error(codes.PermissionDenied, "Admins must enable MFA first, set it up with EnrollTotp and ConfirmTotp")
+	}
+	return status.Errorf(codes.PermissionDenied, "This operation requires the %s role", strings.Join(roles, " or "))
+}
+
+// adminWithoutMFA reports whether the admin role would have let the caller
+// in, were it not for MFA
+func adminWithoutMFA(caller *models.User, roles []string) bool {
+	return slices.Contains(roles, models.RoleAdmin) && caller.HasRole(models.RoleAdmin) && !caller.TOTPEnabled
+}
+
+// supportRestrictedFields are the fields support staff may not change on
+// other users' records
+var supportRestrictedFields = map[string]string{
+	"email": "Support cannot change emails",
+}
+
+// checkUpdateFields checks that the caller may change the given fields of a
+// user. Users may change anything on their own record and admins anything on
+// any record, while support may not change emails of others.
+func (s *UserService) checkUpdateFields(caller *models.User, userID uint, paths []string) error {
+	if caller.ID == userID || s.hasRole(caller, models.RoleAdmin) {
+		return nil
+	}
+	for _, path := range paths {
+		if reason, restricted := supportRestrictedFields[path]; restricted {
+			return status.Error(codes.PermissionDenied, reason)
+		}
+	}
+	return nil
+}
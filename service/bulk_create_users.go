@@ -0,0 +1,319 @@
+package service
+
+import (
+	"io"
+	"log"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultBulkBatchSize = 100
+	maxBulkBatchSize     = 1000
+	// Rows held in memory until the end of an all-or-nothing stream
+	maxAllOrNothingRows = 10000
+)
+
+type bulkCreateStream = grpc.BidiStreamingServer[proto.BulkCreateUsersRequest, proto.BulkCreateUsersResult]
+
+// bulkCreate tracks the state of one BulkCreateUsers stream
+type bulkCreate struct {
+	service      *UserService
+	stream       bulkCreateStream
+	batchSize    int
+	allOrNothing bool
+
+	pending []pendingUser
+	// Emails seen earlier in the stream, to reject duplicates between rows
+	emails map[string]bool
+	failed bool
+}
+
+// pendingUser is a validated row waiting to be committed
+type pendingUser struct {
+	index int64
+	user  *models.User
+}
+
+// BulkCreateUsers creates the users streamed by the client. Each row gets the
+// same validation and email uniqueness checks as CreateUser and a result is
+// streamed back for it once it fails or its batch is committed.
+func (s *UserService) BulkCreateUsers(stream bulkCreateStream) error {
+	if _, err := s.requireRole(stream.Context(), models.RoleAdmin); err != nil {
+		return err
+	}
+
+	bulk := &bulkCreate{
+		service:   s,
+		stream:    stream,
+		batchSize: defaultBulkBatchSize,
+		emails:    make(map[string]bool),
+	}
+
+	var index int64
+	optionsAllowed := true
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch payload := req.Payload.(type) {
+		case *proto.BulkCreateUsersRequest_Options:
+			if !optionsAllowed {
+				return status.Error(codes.InvalidArgument, "Options must be the first message of the stream")
+			}
+			if err := bulk.applyOptions(payload.Options); err != nil {
+				return err
+			}
+		case *proto.BulkCreateUsersRequest_User:
+			if err := bulk.add(index, payload.User); err != nil {
+				return err
+			}
+			index++
+		default:
+			return status.Error(codes.InvalidArgument, "Empty bulk create message")
+		}
+		optionsAllowed = false
+	}
+
+	if bulk.allOrNothing {
+		return bulk.commitAll()
+	}
+	return bulk.flush()
+}
+
+func (b *bulkCreate) applyOptions(options *proto.BulkCreateUsersOptions) error {
+	if options.BatchSize < 0 {
+		return status.Error(codes.InvalidArgument, "Invalid batch_size")
+	}
+	if options.BatchSize > 0 {
+		b.batchSize = int(options.BatchSize)
+	}
+	if b.batchSize > maxBulkBatchSize {
+		b.batchSize = maxBulkBatchSize
+	}
+	b.allOrNothing = options.AllOrNothing
+	return nil
+}
+
+// add validates a row and queues it for the next commit
+func (b *bulkCreate) add(index int64, req *proto.CreateUserRequest) error {
+	createReq := models.CreateUserRequest{
+		Name:     req.Name,
+		Email:    req.Email,
+		Password: req.Password,
+		Age:      int(req.Age),
+	}
+
+	if err := b.service.validator.ValidateStruct(createReq); err != nil {
+		return b.fail(index, b.service.validator.GetValidationErrors(err)...)
+	}
+
+	if b.emails[req.Email] {
+		return b.fail(index, "Email already exists earlier in the stream")
+	}
+	hashedPassword, err := b.service.passwords.Hash(req.Password)
+	if err != nil {
+		return b.fail(index, "Failed to hash password")
+	}
+	b.emails[req.Email] = true
+
+	b.pending = append(b.pending, pendingUser{
+		index: index,
+		user: &models.User{
+			Name:     req.Name,
+			Email:    req.Email,
+			Password: hashedPassword,
+			Age:      int(req.Age),
+		},
+	})
+
+	if b.allOrNothing {
+		if len(b.pending) > maxAllOrNothingRows {
+			return status.Errorf(codes.ResourceExhausted, "All-or-nothing streams are limited to %d rows", maxAllOrNothingRows)
+		}
+		return nil
+	}
+
+	if len(b.pending) >= b.batchSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// flush commits the pending rows in one transaction. If the transaction
+// fails, the rows are retried one by one so each gets its own result.
+func (b *bulkCreate) flush() error {
+	rows, err := b.rejectExistingEmails(b.pending)
+	b.pending = nil
+	if err != nil || len(rows) == 0 {
+		return err
+	}
+
+	events := newUserEvents(len(rows))
+	if err := b.service.userRepo.CreateBatch(usersOf(rows), b.auditEvents(rows), events); err != nil {
+		log.Printf("Bulk create batch failed, retrying rows individually: %v", err)
+		for _, row := range rows {
+			row.user.ID = 0
+			event := newUserEvent(models.UserEventCreated)
+			if err := b.service.userRepo.Create(row.user, b.auditEvent(row), event); err != nil {
+				message := rpcerror.Storage(b.stream.Context(), "Failed to create user", err).Message()
+				if err := b.fail(row.index, message); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := b.succeed(row, event); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for i, row := range rows {
+		if err := b.succeed(row, events[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commitAll creates every pending row in a single transaction, unless any row
+// of the stream failed, in which case nothing is created
+func (b *bulkCreate) commitAll() error {
+	rows, err := b.rejectExistingEmails(b.pending)
+	b.pending = nil
+	if err != nil {
+		return err
+	}
+
+	events := newUserEvents(len(rows))
+	if !b.failed && len(rows) > 0 {
+		if err := b.service.userRepo.CreateBatch(usersOf(rows), b.auditEvents(rows), events); err != nil {
+			message := rpcerror.Storage(b.stream.Context(), "Failed to create users", err).Message()
+			for _, row := range rows {
+				if err := b.fail(row.index, message); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}
+
+	for i, row := range rows {
+		if b.failed {
+			if err := b.fail(row.index, "Not created because another row failed"); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := b.succeed(row, events[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rejectExistingEmails fails the rows whose email is already taken, checking
+// the whole batch with a single query
+func (b *bulkCreate) rejectExistingEmails(rows []pendingUser) ([]pendingUser, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	emails := make([]string, len(rows))
+	for i, row := range rows {
+		emails[i] = row.user.Email
+	}
+
+	existing, err := b.service.userRepo.GetExistingEmails(emails)
+	if err != nil {
+		return nil, rpcerror.Storage(b.stream.Context(), "Failed to check existing emails", err).Err()
+	}
+	if len(existing) == 0 {
+		return rows, nil
+	}
+
+	taken := make(map[string]bool, len(existing))
+	for _, email := range existing {
+		taken[email] = true
+	}
+
+	var remaining []pendingUser
+	for _, row := range rows {
+		if taken[row.user.Email] {
+			if err := b.fail(row.index, "Email already exists"); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		remaining = append(remaining, row)
+	}
+	return remaining, nil
+}
+
+func (b *bulkCreate) succeed(row pendingUser, event *models.UserEvent) error {
+	b.service.events.publish(event)
+
+	// As in CreateUser the row stays created, the token can be sent again
+	// with ResendVerificationEmail
+	if err := b.service.sendVerificationEmail(b.stream.Context(), row.user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", row.user.ID, err)
+	}
+
+	return b.stream.Send(&proto.BulkCreateUsersResult{
+		Index:   row.index,
+		User:    toProtoUser(row.user),
+		Success: true,
+	})
+}
+
+func (b *bulkCreate) fail(index int64, errors ...string) error {
+	b.failed = true
+
+	return b.stream.Send(&proto.BulkCreateUsersResult{
+		Index:   index,
+		Errors:  errors,
+		Success: false,
+	})
+}
+
+// auditEvent builds the audit event recording the creation of a row
+func (b *bulkCreate) auditEvent(row pendingUser) *models.AuditEvent {
+	return b.service.userAuditEvent(b.stream.Context(), models.AuditUserCreated, nil, row.user)
+}
+
+// auditEvents builds the audit events of rows created together
+func (b *bulkCreate) auditEvents(rows []pendingUser) []*models.AuditEvent {
+	audits := make([]*models.AuditEvent, len(rows))
+	for i, row := range rows {
+		audits[i] = b.auditEvent(row)
+	}
+	return audits
+}
+
+// newUserEvents starts the user events of rows created together
+func newUserEvents(n int) []*models.UserEvent {
+	events := make([]*models.UserEvent, n)
+	for i := range events {
+		events[i] = newUserEvent(models.UserEventCreated)
+	}
+	return events
+}
+
+func usersOf(rows []pendingUser) []*models.User {
+	users := make([]*models.User, len(rows))
+	for i, row := range rows {
+		users[i] = row.user
+	}
+	return users
+}
@@ -0,0 +1,98 @@
+package service
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// ForwardedForMetadata is the metadata key proxies such as the HTTP gateway
+// use to pass on the address of the client, as a comma separated chain like
+// the X-Forwarded-For header
+const ForwardedForMetadata = "x-forwarded-for"
+
+// ForwardedUserAgentMetadata is the metadata key proxies use to pass on the
+// User-Agent of the client, since the gRPC user-agent is the proxy's own
+const ForwardedUserAgentMetadata = "x-forwarded-user-agent"
+
+// maxUserAgentLength is how much of a user agent is kept
+const maxUserAgentLength = 255
+
+// defaultTrustedProxies trusts the HTTP gateway running on the same host
+var defaultTrustedProxies = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+// SetTrustedProxies sets the peers whose x-forwarded-for and
+// x-forwarded-user-agent metadata is trusted.
+// Calls from other peers are attributed to the peer address.
+func (s *UserService) SetTrustedProxies(proxies []netip.Prefix) {
+	s.trustedProxies = proxies
+}
+
+// clientAddress returns the address of the client making a call, or "" when
+// it is unknown. Behind a trusted proxy this is the last address the proxy
+// appended to x-forwarded-for, earlier entries could be forged by the client.
+func (s *UserService) clientAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addrPort, err := netip.ParseAddrPort(p.Addr.String())
+	if err != nil {
+		return ""
+	}
+	addr := addrPort.Addr().Unmap()
+
+	if !s.trustedProxy(addr) {
+		return addr.String()
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(ForwardedForMetadata)
+	if len(values) == 0 {
+		return addr.String()
+	}
+	chain := strings.Split(values[len(values)-1], ",")
+	forwarded, err := netip.ParseAddr(strings.TrimSpace(chain[len(chain)-1]))
+	if err != nil {
+		return addr.String()
+	}
+	return forwarded.Unmap().String()
+}
+
+// clientUserAgent returns the user agent of the client making a call, as
+// passed on by a trusted proxy or sent by the client itself
+func (s *UserService) clientUserAgent(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	userAgent := ""
+	if values := md.Get("user-agent"); len(values) > 0 {
+		userAgent = values[0]
+	}
+
+	if forwarded := md.Get(ForwardedUserAgentMetadata); len(forwarded) > 0 {
+		if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+			if addrPort, err := netip.ParseAddrPort(p.Addr.String()); err == nil && s.trustedProxy(addrPort.Addr().Unmap()) {
+				userAgent = forwarded[len(forwarded)-1]
+			}
+		}
+	}
+
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = strings.ToValidUTF8(userAgent[:maxUserAgentLength], "")
+	}
+	return userAgent
+}
+
+func (s *UserService) trustedProxy(addr netip.Addr) bool {
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
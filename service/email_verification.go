@@ -0,0 +1,149 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/notify"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultEmailVerificationTTL is how long email verification tokens stay
+// valid unless configured
+const DefaultEmailVerificationTTL = 24 * time.Hour
+
+// verificationEmailRequested is the answer to every ResendVerificationEmail,
+// so callers cannot tell which emails are registered or verified
+const verificationEmailRequested = "If the email belongs to an unverified user, a verification token has been sent to it"
+
+// SetEmailVerificationTTL sets how long email verification tokens stay valid
+func (s *UserService) SetEmailVerificationTTL(ttl time.Duration) {
+	s.verificationTTL = ttl
+}
+
+// SetRequireVerifiedEmail sets whether Authenticate refuses users that have
+// not verified their email yet
+func (s *UserService) SetRequireVerifiedEmail(require bool) {
+	s.requireVerifiedEmail = require
+}
+
+// VerifyEmail marks the email of a user as verified using the token sent to it
+func (s *UserService) VerifyEmail(ctx context.Context, req *proto.VerifyEmailRequest) (*proto.VerifyEmailResponse, error) {
+	verifyReq := models.VerifyEmailRequest{Token: req.Token}
+
+	if err := s.validator.ValidateStruct(verifyReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.VerifyEmailResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	// The actor and target are filled in once the token is redeemed
+	audit := s.auditContext(ctx, &models.AuditEvent{Action: models.AuditEmailVerified})
+	audit.SetChanges(map[string]models.FieldChange{
+		"email_verified": {Before: false, After: true},
+	})
+	event := newUserEvent(models.UserEventUpdated)
+	user, err := s.verificationRepo.Redeem(hashOneTimeToken(req.Token), audit, event)
+	if errors.Is(err, repository.ErrInvalidVerificationToken) {
+		return &proto.VerifyEmailResponse{
+			Success: false,
+			Message: "Invalid or expired verification token",
+		}, status.Error(codes.InvalidArgument, "Invalid or expired verification token")
+	}
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to verify email", err)
+		return &proto.VerifyEmailResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	s.events.publish(event)
+
+	return &proto.VerifyEmailResponse{
+		User:    toProtoUser(user),
+		Message: "Email verified successfully",
+		Success: true,
+	}, nil
+}
+
+// ResendVerificationEmail sends a new verification token to a user whose
+// email is not verified yet. The response is the same whether or not the
+// email is registered, and is returned before the token is mailed.
+func (s *UserService) ResendVerificationEmail(ctx context.Context, req *proto.ResendVerificationEmailRequest) (*proto.ResendVerificationEmailResponse, error) {
+	resendReq := models.ResendVerificationEmailRequest{Email: req.Email}
+
+	if err := s.validator.ValidateStruct(resendReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.ResendVerificationEmailResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	user, err := s.userRepo.GetByEmail(req.Email)
+	if err == nil && !user.EmailVerified {
+		// Sent in the background so that registered emails do not take
+		// longer to answer than unknown ones
+		go func(ctx context.Context) {
+			if err := s.sendVerificationEmail(ctx, user); err != nil {
+				// Not reported to the caller, that would reveal the email is registered
+				log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+			}
+		}(context.WithoutCancel(ctx))
+	}
+
+	return &proto.ResendVerificationEmailResponse{
+		Message: verificationEmailRequested,
+		Success: true,
+	}, nil
+}
+
+// sendVerificationEmail issues a verification token for the current email of
+// a user and mails it, replacing any token sent before
+func (s *UserService) sendVerificationEmail(ctx context.Context, user *models.User) error {
+	token, err := newOneTimeToken()
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(s.verificationTTL)
+	record := &models.EmailVerificationToken{
+		UserID:    user.ID,
+		Email:     user.Email,
+		TokenHash: hashOneTimeToken(token),
+		ExpiresAt: expiresAt,
+	}
+	if err := s.verificationRepo.Create(record); err != nil {
+		return err
+	}
+
+	msg := notify.Message{
+		To:      user.Email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf("Use this token to verify your email with VerifyEmail:\n\n%s\n\n"+
+			"It can be used once and expires at %s. If you did not sign up you can ignore this message.",
+			token, expiresAt.UTC().Format(time.RFC3339)),
+	}
+	return s.mailer.Send(ctx, msg)
+}
+
+// emailNotVerified reports an Authenticate by a user that still has to
+// verify their email
+func emailNotVerified() (*proto.AuthenticateResponse, error) {
+	return &proto.AuthenticateResponse{
+		Success: false,
+		Message: "Email address is not verified",
+	}, status.Error(codes.FailedPrecondition, "Email address is not verified")
+}
@@ -0,0 +1,75 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"github.com/riskykurniawan15/learn-grpc/validation"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// errorDomain identifies this service in google.rpc.ErrorInfo details
+	errorDomain = rpcerror.Domain
+
+	// VersionConflictReason is the ErrorInfo reason of version conflicts
+	VersionConflictReason = "VERSION_CONFLICT"
+)
+
+// validationFailed builds the InvalidArgument status returned when a request
+// fails validation. It carries a BadRequest detail with one field violation
+// per failing field so clients can point at the offending input.
+func validationFailed(violations []validation.FieldViolation) error {
+	st := status.New(codes.InvalidArgument, "Validation failed")
+
+	badRequest := &errdetails.BadRequest{}
+	for _, violation := range violations {
+		badRequest.FieldViolations = append(badRequest.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       violation.Field,
+			Reason:      violation.Rule,
+			Description: violation.Message,
+		})
+	}
+
+	detailed, err := st.WithDetails(badRequest)
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// versionConflictMessage describes a write that was based on a stale version
+func versionConflictMessage(currentVersion uint) string {
+	return fmt.Sprintf("User has been modified, current version is %d", currentVersion)
+}
+
+// versionConflict builds the Aborted status returned when an update or delete
+// expected a different version of the user. The current version is attached
+// as ErrorInfo metadata so clients can reload and retry.
+func versionConflict(currentVersion uint) error {
+	st := status.New(codes.Aborted, versionConflictMessage(currentVersion))
+
+	detailed, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: VersionConflictReason,
+		Domain: errorDomain,
+		Metadata: map[string]string{
+			"current_version": strconv.FormatUint(uint64(currentVersion), 10),
+		},
+	})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// currentVersion looks up the version a user is at now, 0 if it is gone
+func (s *UserService) currentVersion(id uint) uint {
+	user, err := s.userRepo.GetByID(id)
+	if err != nil {
+		return 0
+	}
+	return user.Version
+}
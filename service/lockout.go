@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/lockout"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// SetLockoutPolicies sets how failed password checks are punished per
+// account and per client address
+func (s *UserService) SetLockoutPolicies(account, address lockout.Policy) {
+	s.lockout = lockout.NewTracker(account, address)
+}
+
+// checkLoginAllowed returns the status to fail a password check of email
+// with when the account or the client address has to wait, nil otherwise
+func (s *UserService) checkLoginAllowed(ctx context.Context, email string) error {
+	err := s.lockout.Check(email, s.clientAddress(ctx))
+	var throttled *lockout.ThrottledError
+	if errors.As(err, &throttled) {
+		return loginThrottled(throttled)
+	}
+	return nil
+}
+
+// loginThrottled builds the status returned for throttled password checks.
+// Locked accounts get PermissionDenied and everything else ResourceExhausted.
+// A RetryInfo detail says when to try again.
+func loginThrottled(throttled *lockout.ThrottledError) error {
+	// Round up, "try again in 0s" would be wrong
+	retryAfter := (throttled.RetryAfter + time.Second - 1).Truncate(time.Second)
+
+	code := codes.ResourceExhausted
+	message := fmt.Sprintf("Too many failed attempts, try again in %s", retryAfter)
+	switch {
+	case throttled.Locked && throttled.Scope == lockout.ScopeAccount:
+		code = codes.PermissionDenied
+		message = fmt.Sprintf("Account is temporarily locked after too many failed attempts, try again in %s", retryAfter)
+	case throttled.Locked:
+		message = fmt.Sprintf("Too many failed attempts from your address, try again in %s", retryAfter)
+	}
+
+	st := status.New(code, message)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retryAfter)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// UnlockUser lifts the lockout of a user and forgets their failed attempts,
+// admin only
+func (s *UserService) UnlockUser(ctx context.Context, req *proto.UnlockUserRequest) (*proto.UnlockUserResponse, error) {
+	caller, err := s.requireRole(ctx, models.RoleAdmin)
+	if err != nil {
+		return &proto.UnlockUserResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	if req.Id <= 0 {
+		return &proto.UnlockUserResponse{
+			Success: false,
+			Message: "Invalid user ID",
+		}, status.Error(codes.InvalidArgument, "Invalid user ID")
+	}
+
+	user, err := s.userRepo.GetByID(uint(req.Id))
+	if err != nil {
+		st := rpcerror.Lookup(ctx, "User not found", err)
+		return &proto.UnlockUserResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	details, _ := json.Marshal(map[string]interface{}{"email": user.Email})
+	audit := s.auditContext(ctx, &models.AuditEvent{
+		ActorID:      caller.ID,
+		Action:       models.AuditUserUnlocked,
+		TargetUserID: user.ID,
+		Details:      string(details),
+	})
+
+	locked, err := s.lockout.Unlock(user.Email, audit)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to unlock user", err)
+		return &proto.UnlockUserResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	message := "User unlocked successfully"
+	if !locked {
+		message = "User was not locked"
+	}
+
+	return &proto.UnlockUserResponse{
+		User:    toProtoUser(user),
+		Message: message,
+		Success: true,
+	}, nil
+}
@@ -0,0 +1,526 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/encryption"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"github.com/riskykurniawan15/learn-grpc/totp"
+	"github.com/riskykurniawan15/learn-grpc/validation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// totpIssuer names the service in authenticator apps
+	totpIssuer = "learn-grpc"
+
+	// mfaChallengeTTL is how long users have to enter their code after
+	// their password
+	mfaChallengeTTL = 5 * time.Minute
+
+	// recoveryCodeCount is how many recovery codes ConfirmTotp hands out
+	recoveryCodeCount = 10
+)
+
+// recoveryCodeEncoding writes recovery codes in lowercase base32, which is
+// easy to read back and type
+var recoveryCodeEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// SetMFACipher sets the cipher TOTP secrets are encrypted with. MFA cannot
+// be enrolled while no cipher is set.
+func (s *UserService) SetMFACipher(cipher *encryption.Cipher) {
+	s.mfaCipher = cipher
+}
+
+// SetRequireAdminMFA sets whether admins must have MFA enabled to use the
+// admin role
+func (s *UserService) SetRequireAdminMFA(require bool) {
+	s.requireAdminMFA = require
+}
+
+// EnrollTotp starts setting up an authenticator app for the caller. The
+// returned secret only takes effect once ConfirmTotp proves the app has it.
+func (s *UserService) EnrollTotp(ctx context.Context, req *proto.EnrollTotpRequest) (*proto.EnrollTotpResponse, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.EnrollTotpResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	if s.mfaCipher == nil {
+		return &proto.EnrollTotpResponse{
+			Success: false,
+			Message: "MFA is disabled",
+		}, status.Error(codes.Unavailable, "MFA is disabled")
+	}
+	if caller.TOTPEnabled {
+		return mfaAlreadyEnabled()
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		log.Printf("Failed to generate TOTP secret: %v", err)
+		return &proto.EnrollTotpResponse{
+			Success: false,
+			Message: "Failed to generate TOTP secret",
+		}, status.Error(codes.Internal, "Failed to generate TOTP secret")
+	}
+	sealed, err := s.mfaCipher.Seal(secret, totpAssociatedData(caller.ID))
+	if err != nil {
+		log.Printf("Failed to encrypt TOTP secret: %v", err)
+		return &proto.EnrollTotpResponse{
+			Success: false,
+			Message: "Failed to encrypt TOTP secret",
+		}, status.Error(codes.Internal, "Failed to encrypt TOTP secret")
+	}
+
+	err = s.mfaRepo.SaveEnrollment(&models.TOTPCredential{UserID: caller.ID, Secret: sealed})
+	if errors.Is(err, repository.ErrTOTPAlreadyEnabled) {
+		return mfaAlreadyEnabled()
+	}
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to enroll TOTP", err)
+		return &proto.EnrollTotpResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	return &proto.EnrollTotpResponse{
+		Secret:     secret,
+		OtpauthUri: totp.URI(totpIssuer, caller.Email, secret),
+		Message:    "Add the secret to an authenticator app, then call ConfirmTotp with a code from it",
+		Success:    true,
+	}, nil
+}
+
+// mfaAlreadyEnabled answers an enrollment for a user who already has MFA
+func mfaAlreadyEnabled() (*proto.EnrollTotpResponse, error) {
+	message := "MFA is already enabled, disable it first to switch to another app"
+	return &proto.EnrollTotpResponse{
+		Success: false,
+		Message: message,
+	}, status.Error(codes.FailedPrecondition, message)
+}
+
+// totpNotEnrolled answers a confirmation for a user without a pending
+// enrollment
+func totpNotEnrolled() (*proto.ConfirmTotpResponse, error) {
+	message := "No pending TOTP enrollment, call EnrollTotp first"
+	return &proto.ConfirmTotpResponse{
+		Success: false,
+		Message: message,
+	}, status.Error(codes.FailedPrecondition, message)
+}
+
+// ConfirmTotp enables MFA for the caller once they send a valid code from
+// the app they enrolled, and hands out recovery codes
+func (s *UserService) ConfirmTotp(ctx context.Context, req *proto.ConfirmTotpRequest) (*proto.ConfirmTotpResponse, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.ConfirmTotpResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	codeReq := models.TOTPCodeRequest{Code: strings.TrimSpace(req.Code)}
+	if err := s.validator.ValidateStruct(codeReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.ConfirmTotpResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	credential, err := s.mfaRepo.GetCredential(caller.ID)
+	if caller.TOTPEnabled || repository.IsNotFound(err) || (err == nil && credential.ConfirmedAt != nil) {
+		return totpNotEnrolled()
+	}
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to confirm TOTP", err)
+		return &proto.ConfirmTotpResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	secret, err := s.openTOTPSecret(credential)
+	if err != nil {
+		log.Printf("Failed to decrypt TOTP secret of user %d: %v", caller.ID, err)
+		return &proto.ConfirmTotpResponse{
+			Success: false,
+			Message: "Failed to decrypt TOTP secret",
+		}, status.Error(codes.Internal, "Failed to decrypt TOTP secret")
+	}
+	step, ok := totp.Validate(secret, codeReq.Code, time.Now())
+	if !ok {
+		message := "code does not match the enrolled secret, check the time on the device"
+		return &proto.ConfirmTotpResponse{
+			Success: false,
+			Message: "Validation failed: " + message,
+		}, validationFailed([]validation.FieldViolation{{
+			Field:   "code",
+			Rule:    "mismatch",
+			Message: message,
+		}})
+	}
+
+	recoveryCodes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		log.Printf("Failed to generate recovery codes: %v", err)
+		return &proto.ConfirmTotpResponse{
+			Success: false,
+			Message: "Failed to generate recovery codes",
+		}, status.Error(codes.Internal, "Failed to generate recovery codes")
+	}
+
+	after := *caller
+	after.TOTPEnabled = true
+	audit := s.userAuditEvent(ctx, models.AuditMFAEnabled, caller, &after)
+	event := newUserEvent(models.UserEventUpdated)
+	if err := s.mfaRepo.Confirm(caller, step, hashes, audit, event); err != nil {
+		if errors.Is(err, repository.ErrTOTPNotEnrolled) {
+			// Enrollment was replaced or confirmed by a concurrent call
+			return totpNotEnrolled()
+		}
+		if errors.Is(err, repository.ErrVersionConflict) {
+			currentVersion := s.currentVersion(caller.ID)
+			return &proto.ConfirmTotpResponse{
+				Success: false,
+				Message: versionConflictMessage(currentVersion),
+			}, versionConflict(currentVersion)
+		}
+		st := rpcerror.Storage(ctx, "Failed to confirm TOTP", err)
+		return &proto.ConfirmTotpResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	s.events.publish(event)
+
+	return &proto.ConfirmTotpResponse{
+		RecoveryCodes: recoveryCodes,
+		User:          toProtoUser(caller),
+		Message:       "MFA enabled, store the recovery codes somewhere safe",
+		Success:       true,
+	}, nil
+}
+
+// DisableTotp turns MFA off. Users confirm with a TOTP or recovery code,
+// admins may turn it off for others without one.
+func (s *UserService) DisableTotp(ctx context.Context, req *proto.DisableTotpRequest) (*proto.DisableTotpResponse, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.DisableTotpResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	target := caller
+	if req.UserId != 0 && uint(req.UserId) != caller.ID {
+		if _, err := s.requireRole(ctx, models.RoleAdmin); err != nil {
+			return &proto.DisableTotpResponse{
+				Success: false,
+				Message: status.Convert(err).Message(),
+			}, err
+		}
+		target, err = s.userRepo.GetByID(uint(req.UserId))
+		if err != nil {
+			st := rpcerror.Lookup(ctx, "User not found", err)
+			return &proto.DisableTotpResponse{
+				Success: false,
+				Message: st.Message(),
+			}, st.Err()
+		}
+	}
+
+	if !target.TOTPEnabled {
+		message := "MFA is not enabled"
+		return &proto.DisableTotpResponse{
+			Success: false,
+			Message: message,
+		}, status.Error(codes.FailedPrecondition, message)
+	}
+
+	if target == caller {
+		codeReq := models.MFACodeRequest{Code: strings.TrimSpace(req.Code)}
+		if err := s.validator.ValidateStruct(codeReq); err != nil {
+			validationErrors := s.validator.GetValidationErrors(err)
+			return &proto.DisableTotpResponse{
+				Success: false,
+				Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+			}, validationFailed(s.validator.GetFieldViolations(err))
+		}
+
+		// Guessing codes is throttled like guessing passwords, in case the
+		// access token was stolen
+		if err := s.checkLoginAllowed(ctx, caller.Email); err != nil {
+			return &proto.DisableTotpResponse{
+				Success: false,
+				Message: status.Convert(err).Message(),
+			}, err
+		}
+		ok, err := s.verifyMFACode(ctx, caller, codeReq.Code)
+		if err != nil {
+			st := rpcerror.Storage(ctx, "Failed to check code", err)
+			return &proto.DisableTotpResponse{
+				Success: false,
+				Message: st.Message(),
+			}, st.Err()
+		}
+		if !ok {
+			s.lockout.Failure(caller.Email, s.clientAddress(ctx))
+			message := "Invalid code"
+			return &proto.DisableTotpResponse{
+				Success: false,
+				Message: message,
+			}, status.Error(codes.PermissionDenied, message)
+		}
+		s.lockout.Success(caller.Email)
+	}
+
+	after := *target
+	after.TOTPEnabled = false
+	audit := s.userAuditEvent(ctx, models.AuditMFADisabled, target, &after)
+	event := newUserEvent(models.UserEventUpdated)
+	if err := s.mfaRepo.Disable(target, audit, event); err != nil {
+		if errors.Is(err, repository.ErrVersionConflict) {
+			currentVersion := s.currentVersion(target.ID)
+			return &proto.DisableTotpResponse{
+				Success: false,
+				Message: versionConflictMessage(currentVersion),
+			}, versionConflict(currentVersion)
+		}
+		st := rpcerror.Storage(ctx, "Failed to disable MFA", err)
+		return &proto.DisableTotpResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	s.events.publish(event)
+
+	return &proto.DisableTotpResponse{
+		User:    toProtoUser(target),
+		Message: "MFA disabled",
+		Success: true,
+	}, nil
+}
+
+// VerifyMfa completes the login of a user with MFA enabled, exchanging the
+// mfa_token from Authenticate and a TOTP or recovery code for the tokens
+func (s *UserService) VerifyMfa(ctx context.Context, req *proto.VerifyMfaRequest) (*proto.AuthenticateResponse, error) {
+	if s.tokens == nil {
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: "Authentication is disabled",
+		}, status.Error(codes.Unavailable, "Authentication is disabled")
+	}
+
+	verifyReq := models.VerifyMFARequest{
+		MFAToken: req.MfaToken,
+		Code:     strings.TrimSpace(req.Code),
+	}
+
+	if err := s.validator.ValidateStruct(verifyReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	challenge, err := s.mfaRepo.GetChallenge(hashOneTimeToken(verifyReq.MFAToken))
+	if errors.Is(err, repository.ErrInvalidMFAChallenge) {
+		return invalidMFAChallenge()
+	}
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to check MFA token", err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	user, err := s.userRepo.GetByID(challenge.UserID)
+	if repository.IsNotFound(err) {
+		return invalidMFAChallenge()
+	}
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to check MFA token", err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	// Failed codes count towards the same lockout as failed passwords
+	if err := s.checkLoginAllowed(ctx, user.Email); err != nil {
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+	ok, err := s.verifyMFACode(ctx, user, verifyReq.Code)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to check code", err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+	if !ok {
+		s.lockout.Failure(user.Email, s.clientAddress(ctx))
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: "Invalid code",
+		}, status.Error(codes.Unauthenticated, "Invalid code")
+	}
+
+	// Each challenge logs in once
+	if err := s.mfaRepo.CompleteChallenge(challenge); err != nil {
+		if errors.Is(err, repository.ErrInvalidMFAChallenge) {
+			return invalidMFAChallenge()
+		}
+		st := rpcerror.Storage(ctx, "Failed to complete login", err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+	s.lockout.Success(user.Email)
+
+	return s.completeLogin(ctx, user)
+}
+
+// invalidMFAChallenge answers an mfa_token that is unknown, expired or used
+func invalidMFAChallenge() (*proto.AuthenticateResponse, error) {
+	return &proto.AuthenticateResponse{
+		Success: false,
+		Message: "Invalid or expired MFA token, log in again",
+	}, status.Error(codes.Unauthenticated, "Invalid or expired MFA token, log in again")
+}
+
+// startMFAChallenge answers a correct password of a user with MFA enabled
+// with a challenge to pass to VerifyMfa, instead of tokens
+func (s *UserService) startMFAChallenge(ctx context.Context, user *models.User) (*proto.AuthenticateResponse, error) {
+	token, err := newOneTimeToken()
+	if err != nil {
+		log.Printf("Failed to generate MFA token for user %d: %v", user.ID, err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: "Failed to start MFA challenge",
+		}, status.Error(codes.Internal, "Failed to start MFA challenge")
+	}
+
+	challenge := &models.MFAChallenge{
+		UserID:    user.ID,
+		TokenHash: hashOneTimeToken(token),
+		ExpiresAt: time.Now().Add(mfaChallengeTTL),
+	}
+	if err := s.mfaRepo.CreateChallenge(challenge); err != nil {
+		st := rpcerror.Storage(ctx, "Failed to start MFA challenge", err)
+		return &proto.AuthenticateResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	return &proto.AuthenticateResponse{
+		MfaRequired:       true,
+		MfaToken:          token,
+		MfaTokenExpiresAt: timestamppb.New(challenge.ExpiresAt),
+		Message:           "MFA required, call VerifyMfa with the mfa_token and a code from the authenticator app",
+		Success:           true,
+	}, nil
+}
+
+// verifyMFACode checks a code from the authenticator app of a user or, if it
+// does not look like one, a recovery code. Either can only be used once.
+func (s *UserService) verifyMFACode(ctx context.Context, user *models.User, code string) (bool, error) {
+	if len(code) != totp.Digits || strings.Trim(code, "0123456789") != "" {
+		audit := s.auditContext(ctx, &models.AuditEvent{
+			ActorID:      user.ID,
+			Action:       models.AuditRecoveryCodeUsed,
+			TargetUserID: user.ID,
+		})
+		return s.mfaRepo.UseRecoveryCode(user.ID, hashRecoveryCode(code), audit)
+	}
+
+	credential, err := s.mfaRepo.GetCredential(user.ID)
+	if repository.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if credential.ConfirmedAt == nil {
+		return false, nil
+	}
+
+	secret, err := s.openTOTPSecret(credential)
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+	// Refuses a code that was already used, e.g. one seen over a shoulder
+	return s.mfaRepo.UseStep(user.ID, step)
+}
+
+// openTOTPSecret decrypts the secret of a TOTP credential
+func (s *UserService) openTOTPSecret(credential *models.TOTPCredential) (string, error) {
+	if s.mfaCipher == nil {
+		return "", errors.New("no MFA cipher configured")
+	}
+	return s.mfaCipher.Open(credential.Secret, totpAssociatedData(credential.UserID))
+}
+
+// totpAssociatedData binds an encrypted TOTP secret to its user, so it cannot
+// be copied over to another user
+func totpAssociatedData(userID uint) []byte {
+	return []byte(fmt.Sprintf("totp:%d", userID))
+}
+
+// newRecoveryCodes returns a fresh set of recovery codes, formatted as
+// xxxxx-xxxxx, along with their hashes
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := recoveryCodeEncoding.EncodeToString(b)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash a recovery code is stored as, ignoring
+// case, dashes and spaces so codes can be typed back loosely
+func hashRecoveryCode(code string) string {
+	normalized := strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	return hashOneTimeToken(normalized)
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+	defaultOrderBy  = "created_at"
+)
+
+var errInvalidPageToken = errors.New("invalid page token")
+
+// pageToken is the decoded form of the opaque ListUsers page token. It pins
+// the ordering and filters it was issued for so it cannot be replayed against
+// a different query.
+type pageToken struct {
+	OrderBy string `json:"o"`
+	Desc    bool   `json:"d,omitempty"`
+	Filter  string `json:"f"`
+	Value   string `json:"v"`
+	ID      uint   `json:"i"`
+}
+
+// parseOrderBy parses an order_by value such as "name" or "created_at desc"
+func parseOrderBy(orderBy string) (string, bool, error) {
+	parts := strings.Fields(strings.ToLower(orderBy))
+	switch len(parts) {
+	case 0:
+		return defaultOrderBy, false, nil
+	case 1:
+		return parts[0], false, nil
+	case 2:
+		if parts[1] != "asc" && parts[1] != "desc" {
+			return "", false, fmt.Errorf("order_by direction must be asc or desc")
+		}
+		return parts[0], parts[1] == "desc", nil
+	default:
+		return "", false, fmt.Errorf("order_by must be a field name optionally followed by asc or desc")
+	}
+}
+
+// filterFingerprint summarizes the filters of a list query
+func filterFingerprint(opts repository.UserListOptions) string {
+	key := fmt.Sprintf("%t|%d|%d|%s|%s|%d|%d",
+		opts.Deleted, opts.MinAge, opts.MaxAge, opts.NamePrefix, strings.ToLower(opts.EmailDomain),
+		unixNanoOrZero(opts.CreatedAfter), unixNanoOrZero(opts.CreatedBefore))
+	sum := sha256.Sum256([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+func unixNanoOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// encodePageToken builds the token pointing just past the given user
+func encodePageToken(opts repository.UserListOptions, last models.User) string {
+	token := pageToken{
+		OrderBy: opts.OrderBy,
+		Desc:    opts.Desc,
+		Filter:  filterFingerprint(opts),
+		ID:      last.ID,
+	}
+
+	switch opts.OrderBy {
+	case "name":
+		token.Value = last.Name
+	case "email":
+		token.Value = last.Email
+	case "age":
+		token.Value = strconv.Itoa(last.Age)
+	case "created_at":
+		token.Value = last.CreatedAt.Format(time.RFC3339Nano)
+	case "deleted_at":
+		token.Value = last.DeletedAt.Time.Format(time.RFC3339Nano)
+	}
+
+	data, _ := json.Marshal(token)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodePageToken turns a page token back into a cursor, rejecting tokens
+// issued for a different ordering or filter
+func decodePageToken(raw string, opts repository.UserListOptions) (*repository.UserCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errInvalidPageToken
+	}
+
+	var token pageToken
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, errInvalidPageToken
+	}
+
+	if token.OrderBy != opts.OrderBy || token.Desc != opts.Desc || token.Filter != filterFingerprint(opts) {
+		return nil, errInvalidPageToken
+	}
+
+	cursor := &repository.UserCursor{ID: token.ID}
+	switch token.OrderBy {
+	case "age":
+		age, err := strconv.Atoi(token.Value)
+		if err != nil {
+			return nil, errInvalidPageToken
+		}
+		cursor.Value = age
+	case "created_at", "deleted_at":
+		value, err := time.Parse(time.RFC3339Nano, token.Value)
+		if err != nil {
+			return nil, errInvalidPageToken
+		}
+		cursor.Value = value
+	default:
+		cursor.Value = token.Value
+	}
+
+	return cursor, nil
+}
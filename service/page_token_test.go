@@ -0,0 +1,152 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+)
+
+func TestPageTokenRoundTrip(t *testing.T) {
+	createdAt := time.Date(2024, 5, 1, 12, 30, 0, 123456789, time.UTC)
+	user := models.User{ID: 42, Name: "Jane Doe", Email: "jane@example.com", Age: 31, CreatedAt: createdAt}
+
+	tests := []struct {
+		orderBy string
+		want    interface{}
+	}{
+		{"name", "Jane Doe"},
+		{"email", "jane@example.com"},
+		{"age", 31},
+		{"created_at", createdAt},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.orderBy, func(t *testing.T) {
+			opts := repository.UserListOptions{OrderBy: tt.orderBy, Desc: true, MinAge: 18, EmailDomain: "example.com"}
+
+			cursor, err := decodePageToken(encodePageToken(opts, user), opts)
+			if err != nil {
+				t.Fatalf("decodePageToken: %v", err)
+			}
+			if cursor.ID != user.ID {
+				t.Errorf("cursor ID = %d, want %d", cursor.ID, user.ID)
+			}
+			if got, ok := cursor.Value.(time.Time); ok {
+				if !got.Equal(tt.want.(time.Time)) {
+					t.Errorf("cursor value = %v, want %v", got, tt.want)
+				}
+			} else if cursor.Value != tt.want {
+				t.Errorf("cursor value = %v, want %v", cursor.Value, tt.want)
+			}
+		})
+	}
+}
+
+func TestPageTokenRejectsOtherQueries(t *testing.T) {
+	issued := repository.UserListOptions{OrderBy: "name", MinAge: 18, EmailDomain: "example.com"}
+	token := encodePageToken(issued, models.User{ID: 7, Name: "Jane Doe"})
+
+	tests := []struct {
+		name   string
+		change func(*repository.UserListOptions)
+	}{
+		{"order by", func(o *repository.UserListOptions) { o.OrderBy = "email" }},
+		{"direction", func(o *repository.UserListOptions) { o.Desc = true }},
+		{"min age", func(o *repository.UserListOptions) { o.MinAge = 21 }},
+		{"max age", func(o *repository.UserListOptions) { o.MaxAge = 60 }},
+		{"name prefix", func(o *repository.UserListOptions) { o.NamePrefix = "J" }},
+		{"email domain", func(o *repository.UserListOptions) { o.EmailDomain = "example.org" }},
+		{"created after", func(o *repository.UserListOptions) { o.CreatedAfter = time.Unix(1700000000, 0) }},
+		{"deleted", func(o *repository.UserListOptions) { o.Deleted = true }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := issued
+			tt.change(&opts)
+			if _, err := decodePageToken(token, opts); err != errInvalidPageToken {
+				t.Errorf("decodePageToken error = %v, want %v", err, errInvalidPageToken)
+			}
+		})
+	}
+
+	// Email domains are matched case-insensitively, so the token stays valid
+	opts := issued
+	opts.EmailDomain = "EXAMPLE.com"
+	if _, err := decodePageToken(token, opts); err != nil {
+		t.Errorf("decodePageToken with differently cased domain: %v", err)
+	}
+}
+
+func TestPageTokenRejectsTampering(t *testing.T) {
+	opts := repository.UserListOptions{OrderBy: "age"}
+	valid := encodePageToken(opts, models.User{ID: 3, Age: 40})
+
+	encode := func(token pageToken) string {
+		data, _ := json.Marshal(token)
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	var decoded pageToken
+	data, _ := base64.RawURLEncoding.DecodeString(valid)
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("decode valid token: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"not base64", valid + "!"},
+		{"padded base64", base64.URLEncoding.EncodeToString(data)},
+		{"not json", base64.RawURLEncoding.EncodeToString([]byte("not json"))},
+		{"truncated", valid[:len(valid)/2]},
+		{"order by", encode(pageToken{OrderBy: "name", Filter: decoded.Filter, Value: "40", ID: 3})},
+		{"filter", encode(pageToken{OrderBy: "age", Filter: "AAAAAAAAAAA", Value: "40", ID: 3})},
+		{"age value", encode(pageToken{OrderBy: "age", Filter: decoded.Filter, Value: "forty", ID: 3})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodePageToken(tt.token, opts); err != errInvalidPageToken {
+				t.Errorf("decodePageToken error = %v, want %v", err, errInvalidPageToken)
+			}
+		})
+	}
+
+	timeOpts := repository.UserListOptions{OrderBy: "created_at"}
+	badTime := encode(pageToken{OrderBy: "created_at", Filter: filterFingerprint(timeOpts), Value: "yesterday", ID: 3})
+	if _, err := decodePageToken(badTime, timeOpts); err != errInvalidPageToken {
+		t.Errorf("decodePageToken with invalid time error = %v, want %v", err, errInvalidPageToken)
+	}
+}
+
+func TestParseOrderBy(t *testing.T) {
+	tests := []struct {
+		in      string
+		field   string
+		desc    bool
+		wantErr bool
+	}{
+		{"", defaultOrderBy, false, false},
+		{"name", "name", false, false},
+		{"Email DESC", "email", true, false},
+		{"  age   asc ", "age", false, false},
+		{"name sideways", "", false, true},
+		{"name desc extra", "", false, true},
+	}
+
+	for _, tt := range tests {
+		field, desc, err := parseOrderBy(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseOrderBy(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if field != tt.field || desc != tt.desc {
+			t.Errorf("parseOrderBy(%q) = %q, %v, want %q, %v", tt.in, field, desc, tt.field, tt.desc)
+		}
+	}
+}
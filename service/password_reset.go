@@ -0,0 +1,267 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/notify"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"github.com/riskykurniawan15/learn-grpc/validation"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultPasswordResetTTL is how long password reset tokens stay valid
+// unless configured
+const DefaultPasswordResetTTL = time.Hour
+
+// passwordResetRequested is the answer to every RequestPasswordReset, so
+// callers cannot tell which emails are registered
+const passwordResetRequested = "If the email belongs to a user, a password reset token has been sent to it"
+
+// SetMailer sets how emails such as password reset tokens are delivered to
+// users
+func (s *UserService) SetMailer(mailer notify.Mailer) {
+	s.mailer = mailer
+}
+
+// SetPasswordResetTTL sets how long password reset tokens stay valid
+func (s *UserService) SetPasswordResetTTL(ttl time.Duration) {
+	s.resetTTL = ttl
+}
+
+// ChangePassword changes the password of the caller, who must provide their
+// current password
+func (s *UserService) ChangePassword(ctx context.Context, req *proto.ChangePasswordRequest) (*proto.ChangePasswordResponse, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.ChangePasswordResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	changeReq := models.ChangePasswordRequest{
+		CurrentPassword: req.CurrentPassword,
+		NewPassword:     req.NewPassword,
+	}
+
+	if err := s.validator.ValidateStruct(changeReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.ChangePasswordResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	if err := s.checkLoginAllowed(ctx, caller.Email); err != nil {
+		return &proto.ChangePasswordResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+	if !s.checkPassword(caller, req.CurrentPassword) {
+		s.lockout.Failure(caller.Email, s.clientAddress(ctx))
+		return changePasswordRejected("current_password", "mismatch", "current_password is incorrect")
+	}
+	s.lockout.Success(caller.Email)
+	if req.NewPassword == req.CurrentPassword {
+		return changePasswordRejected("new_password", "unchanged", "new_password must differ from current_password")
+	}
+
+	hashedPassword, err := s.passwords.Hash(req.NewPassword)
+	if err != nil {
+		return &proto.ChangePasswordResponse{
+			Success: false,
+			Message: "Failed to hash password",
+		}, status.Error(codes.Internal, "Failed to hash password")
+	}
+	before := *caller
+	caller.Password = hashedPassword
+
+	event := newUserEvent(models.UserEventUpdated)
+	if err := s.userRepo.Update(caller, s.userAuditEvent(ctx, models.AuditPasswordChanged, &before, caller), event); err != nil {
+		if errors.Is(err, repository.ErrVersionConflict) {
+			currentVersion := s.currentVersion(caller.ID)
+			return &proto.ChangePasswordResponse{
+				Success: false,
+				Message: versionConflictMessage(currentVersion),
+			}, versionConflict(currentVersion)
+		}
+		st := rpcerror.Storage(ctx, "Failed to change password", err)
+		return &proto.ChangePasswordResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	s.events.publish(event)
+
+	// Log out everywhere else, in case the old password leaked
+	s.revokeSessionsAfterPasswordChange(ctx, caller, caller.ID, currentSessionID(ctx))
+
+	return &proto.ChangePasswordResponse{
+		Message: "Password changed successfully",
+		Success: true,
+	}, nil
+}
+
+// changePasswordRejected reports a ChangePassword input that passed
+// validation but cannot be accepted
+func changePasswordRejected(field, rule, message string) (*proto.ChangePasswordResponse, error) {
+	return &proto.ChangePasswordResponse{
+		Success: false,
+		Message: "Validation failed: " + message,
+	}, validationFailed([]validation.FieldViolation{{
+		Field:   field,
+		Rule:    rule,
+		Message: message,
+	}})
+}
+
+// RequestPasswordReset sends a single-use password reset token to a user.
+// The response is the same whether or not the email is registered, and is
+// returned before the token is mailed.
+func (s *UserService) RequestPasswordReset(ctx context.Context, req *proto.RequestPasswordResetRequest) (*proto.RequestPasswordResetResponse, error) {
+	resetReq := models.RequestPasswordResetRequest{Email: req.Email}
+
+	if err := s.validator.ValidateStruct(resetReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.RequestPasswordResetResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	user, err := s.userRepo.GetByEmail(req.Email)
+	if err != nil {
+		return &proto.RequestPasswordResetResponse{
+			Message: passwordResetRequested,
+			Success: true,
+		}, nil
+	}
+
+	// Created and mailed in the background so that registered emails do not
+	// take longer to answer than unknown ones
+	go s.sendPasswordReset(context.WithoutCancel(ctx), user)
+
+	return &proto.RequestPasswordResetResponse{
+		Message: passwordResetRequested,
+		Success: true,
+	}, nil
+}
+
+// sendPasswordReset stores a new reset token for a user and mails it to
+// them. Failures are only logged, reporting them would reveal that the email
+// is registered.
+func (s *UserService) sendPasswordReset(ctx context.Context, user *models.User) {
+	token, err := newOneTimeToken()
+	if err != nil {
+		log.Printf("Failed to generate reset token for user %d: %v", user.ID, err)
+		return
+	}
+
+	expiresAt := time.Now().Add(s.resetTTL)
+	record := &models.PasswordResetToken{
+		UserID:    user.ID,
+		TokenHash: hashOneTimeToken(token),
+		ExpiresAt: expiresAt,
+	}
+	if err := s.resetRepo.Create(record); err != nil {
+		log.Printf("Failed to store reset token for user %d: %v", user.ID, err)
+		return
+	}
+
+	msg := notify.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Use this token to choose a new password with ConfirmPasswordReset:\n\n%s\n\n"+
+			"It can be used once and expires at %s. If you did not ask to reset your password you can ignore this message.",
+			token, expiresAt.UTC().Format(time.RFC3339)),
+	}
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		log.Printf("Failed to deliver reset token to user %d: %v", user.ID, err)
+	}
+}
+
+// ConfirmPasswordReset sets a new password using a reset token
+func (s *UserService) ConfirmPasswordReset(ctx context.Context, req *proto.ConfirmPasswordResetRequest) (*proto.ConfirmPasswordResetResponse, error) {
+	confirmReq := models.ConfirmPasswordResetRequest{
+		Token:       req.Token,
+		NewPassword: req.NewPassword,
+	}
+
+	if err := s.validator.ValidateStruct(confirmReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.ConfirmPasswordResetResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	hashedPassword, err := s.passwords.Hash(req.NewPassword)
+	if err != nil {
+		return &proto.ConfirmPasswordResetResponse{
+			Success: false,
+			Message: "Failed to hash password",
+		}, status.Error(codes.Internal, "Failed to hash password")
+	}
+
+	// The actor and target are filled in once the token is redeemed
+	audit := s.auditContext(ctx, &models.AuditEvent{Action: models.AuditPasswordReset})
+	audit.SetChanges(map[string]models.FieldChange{
+		"password": {Before: models.RedactedValue, After: models.RedactedValue},
+	})
+	event := newUserEvent(models.UserEventUpdated)
+	user, err := s.resetRepo.Redeem(hashOneTimeToken(req.Token), hashedPassword, audit, event)
+	if errors.Is(err, repository.ErrInvalidResetToken) {
+		return &proto.ConfirmPasswordResetResponse{
+			Success: false,
+			Message: "Invalid or expired reset token",
+		}, status.Error(codes.InvalidArgument, "Invalid or expired reset token")
+	}
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to reset password", err)
+		return &proto.ConfirmPasswordResetResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	s.events.publish(event)
+
+	s.revokeSessionsAfterPasswordChange(ctx, user, user.ID, 0)
+
+	return &proto.ConfirmPasswordResetResponse{
+		Message: "Password reset successfully",
+		Success: true,
+	}, nil
+}
+
+// newOneTimeToken returns a random URL safe token for password resets and
+// email verification
+func newOneTimeToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashOneTimeToken returns the hex encoded SHA-256 of a one-time token as
+// stored in the database. Tokens are random enough that a plain hash is safe.
+func hashOneTimeToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
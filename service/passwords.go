@@ -0,0 +1,43 @@
+package service
+
+import (
+	"log"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/password"
+)
+
+// SetPasswordHasher sets the hasher used for new passwords. Legacy SHA-256
+// hashes and hashes made with other parameters are still accepted and
+// upgraded on the next successful password check.
+func (s *UserService) SetPasswordHasher(hasher password.Hasher) {
+	s.passwords = password.NewManager(hasher, password.LegacySHA256{})
+}
+
+// checkPassword reports whether plain is the password of the user. A stored
+// hash using a legacy scheme or outdated parameters is replaced by a fresh
+// one once the password is known to be right.
+func (s *UserService) checkPassword(user *models.User, plain string) bool {
+	match, rehash, err := s.passwords.Verify(plain, user.Password)
+	if err != nil {
+		log.Printf("Failed to verify password of user %d: %v", user.ID, err)
+		return false
+	}
+	if !match {
+		return false
+	}
+
+	if rehash {
+		hashed, err := s.passwords.Hash(plain)
+		if err != nil {
+			log.Printf("Failed to rehash password of user %d: %v", user.ID, err)
+			return true
+		}
+		if err := s.userRepo.ReplacePasswordHash(user.ID, user.Password, hashed); err != nil {
+			log.Printf("Failed to store rehashed password of user %d: %v", user.ID, err)
+			return true
+		}
+		user.Password = hashed
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/password"
+	"github.com/riskykurniawan15/learn-grpc/validation"
+)
+
+// newTestService returns a service backed by a fresh in-memory database and
+// hashing passwords with cheap argon2id parameters
+func newTestService(t *testing.T) *UserService {
+	t.Helper()
+	database.InitDatabase(fmt.Sprintf("file:%s?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_")))
+	t.Cleanup(func() { database.Close() })
+
+	s := NewUserService(validation.NewValidator())
+	s.SetPasswordHasher(password.NewArgon2id(password.Argon2idParams{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}))
+	return s
+}
+
+func TestCheckPasswordUpgradesLegacyHash(t *testing.T) {
+	s := newTestService(t)
+
+	legacy, _ := password.LegacySHA256{}.Hash("password123")
+	user := &models.User{Name: "Legacy User", Email: "legacy@example.com", Password: legacy, Age: 30}
+	if err := database.DB.Create(user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+
+	if s.checkPassword(user, "password124") {
+		t.Fatal("checkPassword accepted a wrong password")
+	}
+	if user.Password != legacy {
+		t.Fatal("a wrong password replaced the stored hash")
+	}
+
+	if !s.checkPassword(user, "password123") {
+		t.Fatal("checkPassword rejected the right password")
+	}
+	if !strings.HasPrefix(user.Password, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash after login = %q, want an argon2id hash", user.Password)
+	}
+
+	stored, err := s.userRepo.GetByID(user.ID)
+	if err != nil {
+		t.Fatalf("reload user: %v", err)
+	}
+	if stored.Password != user.Password {
+		t.Errorf("stored hash = %q, want the upgraded %q", stored.Password, user.Password)
+	}
+	if stored.Version != user.Version {
+		t.Errorf("version = %d, the upgrade must not count as a change", stored.Version)
+	}
+
+	// The upgraded hash keeps working and is not replaced again
+	if !s.checkPassword(stored, "password123") {
+		t.Fatal("checkPassword rejected the right password after the upgrade")
+	}
+	if stored.Password != user.Password {
+		t.Error("an up to date hash was replaced")
+	}
+}
@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GrantRole grants a role to a user
+func (s *UserService) GrantRole(ctx context.Context, req *proto.GrantRoleRequest) (*proto.GrantRoleResponse, error) {
+	caller, viaAdminKey, err := s.authorizeRoleChange(ctx)
+	if err != nil {
+		return &proto.GrantRoleResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	changeReq := models.RoleChangeRequest{UserID: req.UserId, Role: req.Role}
+	if err := s.validator.ValidateStruct(changeReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.GrantRoleResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	if _, err := s.userRepo.GetByID(uint(req.UserId)); err != nil {
+		st := rpcerror.Lookup(ctx, "User not found", err)
+		return &proto.GrantRoleResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	role := &models.UserRole{
+		UserID:    uint(req.UserId),
+		Role:      req.Role,
+		GrantedBy: caller.ID,
+	}
+	audit := s.auditContext(ctx, roleAuditEvent(models.AuditRoleGranted, caller, role.UserID, req.Role, viaAdminKey))
+
+	granted, err := s.roleRepo.Grant(role, audit)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to grant role", err)
+		return &proto.GrantRoleResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	user, err := s.userRepo.GetByID(uint(req.UserId))
+	if err != nil {
+		st := rpcerror.Lookup(ctx, "User not found", err)
+		return &proto.GrantRoleResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	message := "Role granted successfully"
+	if !granted {
+		message = "User already has the role"
+	}
+
+	return &proto.GrantRoleResponse{
+		User:    toProtoUser(user),
+		Message: message,
+		Success: true,
+	}, nil
+}
+
+// RevokeRole revokes a role from a user
+func (s *UserService) RevokeRole(ctx context.Context, req *proto.RevokeRoleRequest) (*proto.RevokeRoleResponse, error) {
+	caller, viaAdminKey, err := s.authorizeRoleChange(ctx)
+	if err != nil {
+		return &proto.RevokeRoleResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	changeReq := models.RoleChangeRequest{UserID: req.UserId, Role: req.Role}
+	if err := s.validator.ValidateStruct(changeReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.RevokeRoleResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	if _, err := s.userRepo.GetByID(uint(req.UserId)); err != nil {
+		st := rpcerror.Lookup(ctx, "User not found", err)
+		return &proto.RevokeRoleResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	audit := s.auditContext(ctx, roleAuditEvent(models.AuditRoleRevoked, caller, uint(req.UserId), req.Role, viaAdminKey))
+
+	revoked, err := s.roleRepo.Revoke(uint(req.UserId), req.Role, audit)
+	if err != nil {
+		if errors.Is(err, repository.ErrLastAdmin) {
+			return &proto.RevokeRoleResponse{
+				Success: false,
+				Message: "Cannot revoke the admin role from the last admin",
+			}, status.Error(codes.FailedPrecondition, "Cannot revoke the admin role from the last admin")
+		}
+		st := rpcerror.Storage(ctx, "Failed to revoke role", err)
+		return &proto.RevokeRoleResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	user, err := s.userRepo.GetByID(uint(req.UserId))
+	if err != nil {
+		st := rpcerror.Lookup(ctx, "User not found", err)
+		return &proto.RevokeRoleResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	message := "Role revoked successfully"
+	if !revoked {
+		message = "User does not have the role"
+	}
+
+	return &proto.RevokeRoleResponse{
+		User:    toProtoUser(user),
+		Message: message,
+		Success: true,
+	}, nil
+}
+
+// authorizeRoleChange checks that the caller may grant and revoke roles.
+// Admins may, and so may callers presenting the admin key, which is how the
+// first admin gets appointed.
+func (s *UserService) authorizeRoleChange(ctx context.Context) (*models.User, bool, error) {
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if s.hasRole(caller, models.RoleAdmin) {
+		return caller, false, nil
+	}
+	if s.requireAdminKey(ctx) == nil {
+		return caller, true, nil
+	}
+	return nil, false, status.Error(codes.PermissionDenied, "Changing roles requires the admin role or the admin key")
+}
+
+// roleAuditEvent describes a role change for the audit log
+func roleAuditEvent(action string, caller *models.User, userID uint, role string, viaAdminKey bool) *models.AuditEvent {
+	details := map[string]interface{}{"role": role}
+	if viaAdminKey {
+		details["via"] = "admin_key"
+	}
+	data, _ := json.Marshal(details)
+
+	return &models.AuditEvent{
+		ActorID:      caller.ID,
+		Action:       action,
+		TargetUserID: userID,
+		Details:      string(data),
+	}
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// createTestUser stores a user directly, without auditing its creation
+func createTestUser(t *testing.T, email string) *models.User {
+	t.Helper()
+	user := &models.User{Name: "Test User", Email: email, Password: "unused", Age: 30}
+	if err := database.DB.Create(user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	return user
+}
+
+// createTestUserWithRole stores a user holding a role
+func createTestUserWithRole(t *testing.T, email, role string) *models.User {
+	t.Helper()
+	user := createTestUser(t, email)
+	if err := database.DB.Create(&models.UserRole{UserID: user.ID, Role: role}).Error; err != nil {
+		t.Fatalf("grant %s: %v", role, err)
+	}
+	return user
+}
+
+// callerContext returns a context authenticated as the user
+func callerContext(user *models.User) context.Context {
+	return auth.NewContext(context.Background(), &auth.Principal{UserID: user.ID, Email: user.Email})
+}
+
+func updateField(userID uint, field, value string) *proto.UpdateUserRequest {
+	req := &proto.UpdateUserRequest{Id: int64(userID), UpdateMask: &fieldmaskpb.FieldMask{Paths: []string{field}}}
+	switch field {
+	case "name":
+		req.Name = value
+	case "email":
+		req.Email = value
+	}
+	return req
+}
+
+func TestSupportCannotChangeEmails(t *testing.T) {
+	s := newTestService(t)
+	support := createTestUserWithRole(t, "support@example.com", models.RoleSupport)
+	user := createTestUser(t, "user@example.com")
+	ctx := callerContext(support)
+
+	_, err := s.UpdateUser(ctx, updateField(user.ID, "email", "taken@example.com"))
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("support changing another user's email: %v, want PermissionDenied", err)
+	}
+	if _, err := s.UpdateUser(ctx, updateField(user.ID, "name", "Renamed User")); err != nil {
+		t.Errorf("support changing another user's name: %v", err)
+	}
+	if _, err := s.UpdateUser(ctx, updateField(support.ID, "email", "helpdesk@example.com")); err != nil {
+		t.Errorf("support changing their own email: %v", err)
+	}
+}
+
+func TestSelfServiceOnlyOnOwnRecord(t *testing.T) {
+	s := newTestService(t)
+	user := createTestUser(t, "user@example.com")
+	other := createTestUser(t, "other@example.com")
+	ctx := callerContext(user)
+
+	if _, err := s.GetUser(ctx, &proto.GetUserRequest{Id: int64(user.ID)}); err != nil {
+		t.Errorf("GetUser of own record: %v", err)
+	}
+	if _, err := s.UpdateUser(ctx, updateField(user.ID, "email", "renamed@example.com")); err != nil {
+		t.Errorf("UpdateUser of own email: %v", err)
+	}
+
+	if _, err := s.GetUser(ctx, &proto.GetUserRequest{Id: int64(other.ID)}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("GetUser of another user: %v, want PermissionDenied", err)
+	}
+	if _, err := s.UpdateUser(ctx, updateField(other.ID, "name", "Renamed User")); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("UpdateUser of another user: %v, want PermissionDenied", err)
+	}
+	if _, err := s.DeleteUser(ctx, &proto.DeleteUserRequest{Id: int64(other.ID)}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("DeleteUser of another user: %v, want PermissionDenied", err)
+	}
+	if _, err := s.ListUsers(ctx, &proto.ListUsersRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("ListUsers without a role: %v, want PermissionDenied", err)
+	}
+}
+
+func TestAdminNeedsMFA(t *testing.T) {
+	s := newTestService(t)
+	admin := createTestUserWithRole(t, "admin@example.com", models.RoleAdmin)
+	user := createTestUser(t, "user@example.com")
+	ctx := callerContext(admin)
+
+	_, err := s.ListUsers(ctx, &proto.ListUsersRequest{})
+	if status.Code(err) != codes.PermissionDenied || !strings.Contains(status.Convert(err).Message(), "enable MFA") {
+		t.Errorf("ListUsers by an admin without MFA: %v, want PermissionDenied pointing at MFA", err)
+	}
+	_, err = s.GetUser(ctx, &proto.GetUserRequest{Id: int64(user.ID)})
+	if status.Code(err) != codes.PermissionDenied || !strings.Contains(status.Convert(err).Message(), "enable MFA") {
+		t.Errorf("GetUser by an admin without MFA: %v, want PermissionDenied pointing at MFA", err)
+	}
+
+	if err := database.DB.Model(admin).Update("totp_enabled", true).Error; err != nil {
+		t.Fatalf("enable MFA: %v", err)
+	}
+	if _, err := s.ListUsers(ctx, &proto.ListUsersRequest{}); err != nil {
+		t.Errorf("ListUsers by an admin with MFA: %v", err)
+	}
+
+	if err := database.DB.Model(admin).Update("totp_enabled", false).Error; err != nil {
+		t.Fatalf("disable MFA: %v", err)
+	}
+	s.SetRequireAdminMFA(false)
+	if _, err := s.ListUsers(ctx, &proto.ListUsersRequest{}); err != nil {
+		t.Errorf("ListUsers by an admin without MFA when it is not required: %v", err)
+	}
+}
@@ -0,0 +1,389 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// DefaultRefreshTokenTTL is how long refresh tokens stay valid unless
+// configured. A session ends once its refresh token expires unused.
+const DefaultRefreshTokenTTL = 30 * 24 * time.Hour
+
+// SetRefreshTokenTTL sets how long refresh tokens stay valid
+func (s *UserService) SetRefreshTokenTTL(ttl time.Duration) {
+	s.refreshTTL = ttl
+}
+
+// toProtoSession converts a session model to its proto message. current is
+// the session of the caller's access token.
+func toProtoSession(session *models.Session, current uint) *proto.Session {
+	protoSession := &proto.Session{
+		Id:         int64(session.ID),
+		UserId:     int64(session.UserID),
+		UserAgent:  session.UserAgent,
+		IpAddress:  session.IPAddress,
+		CreatedAt:  timestamppb.New(session.CreatedAt),
+		LastUsedAt: timestamppb.New(session.LastUsedAt),
+		ExpiresAt:  timestamppb.New(session.ExpiresAt),
+		Current:    session.ID == current,
+	}
+	if session.RevokedAt != nil {
+		protoSession.RevokedAt = timestamppb.New(*session.RevokedAt)
+	}
+	return protoSession
+}
+
+// newRefreshToken returns a new refresh token and its record, which still
+// needs the session set
+func (s *UserService) newRefreshToken() (string, *models.RefreshToken, error) {
+	token, err := newOneTimeToken()
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &models.RefreshToken{
+		TokenHash: hashOneTimeToken(token),
+		ExpiresAt: time.Now().Add(s.refreshTTL),
+	}, nil
+}
+
+// startSession creates the login session of a user who just authenticated
+// and returns it with its first refresh token
+func (s *UserService) startSession(ctx context.Context, user *models.User) (*models.Session, string, error) {
+	token, record, err := s.newRefreshToken()
+	if err != nil {
+		return nil, "", err
+	}
+
+	session := &models.Session{
+		UserID:     user.ID,
+		UserAgent:  s.clientUserAgent(ctx),
+		IPAddress:  s.clientAddress(ctx),
+		LastUsedAt: time.Now(),
+		ExpiresAt:  record.ExpiresAt,
+	}
+	if err := s.sessionRepo.Create(session, record); err != nil {
+		return nil, "", err
+	}
+	return session, token, nil
+}
+
+// RefreshSession exchanges a refresh token for a new access token and a new
+// refresh token. A refresh token can only be exchanged once, using it again
+// revokes its session.
+func (s *UserService) RefreshSession(ctx context.Context, req *proto.RefreshSessionRequest) (*proto.RefreshSessionResponse, error) {
+	if s.tokens == nil {
+		return &proto.RefreshSessionResponse{
+			Success: false,
+			Message: "Authentication is disabled",
+		}, status.Error(codes.Unavailable, "Authentication is disabled")
+	}
+
+	refreshReq := models.RefreshSessionRequest{RefreshToken: req.RefreshToken}
+
+	if err := s.validator.ValidateStruct(refreshReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.RefreshSessionResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	refreshToken, next, err := s.newRefreshToken()
+	if err != nil {
+		log.Printf("Failed to generate refresh token: %v", err)
+		return &proto.RefreshSessionResponse{
+			Success: false,
+			Message: "Failed to refresh session",
+		}, status.Error(codes.Internal, "Failed to refresh session")
+	}
+
+	tokenHash := hashOneTimeToken(req.RefreshToken)
+
+	// Checked before rotating so that the refusal does not use up the token.
+	// Tokens that are not current are left to Rotate, which detects reuse.
+	if s.requireVerifiedEmail {
+		user, err := s.sessionRepo.GetUserByRefreshToken(tokenHash, time.Now())
+		if err != nil && !errors.Is(err, repository.ErrInvalidRefreshToken) {
+			st := rpcerror.Storage(ctx, "Failed to refresh session", err)
+			return &proto.RefreshSessionResponse{
+				Success: false,
+				Message: st.Message(),
+			}, st.Err()
+		}
+		if err == nil && !user.EmailVerified {
+			return &proto.RefreshSessionResponse{
+				Success: false,
+				Message: "Email address is not verified",
+			}, status.Error(codes.FailedPrecondition, "Email address is not verified")
+		}
+	}
+
+	// Filled in by the repository if the token turns out to be reused
+	reuseAudit := s.auditContext(ctx, &models.AuditEvent{Action: models.AuditRefreshTokenReused})
+
+	session, user, err := s.sessionRepo.Rotate(tokenHash, next, s.clientUserAgent(ctx), s.clientAddress(ctx), reuseAudit)
+	if errors.Is(err, repository.ErrRefreshTokenReused) {
+		log.Printf("Refresh token reused from %s, session revoked", s.clientAddress(ctx))
+		return &proto.RefreshSessionResponse{
+			Success: false,
+			Message: "Refresh token was already used, the session has been revoked",
+		}, status.Error(codes.Unauthenticated, "Refresh token was already used, the session has been revoked")
+	}
+	if errors.Is(err, repository.ErrInvalidRefreshToken) {
+		return &proto.RefreshSessionResponse{
+			Success: false,
+			Message: "Invalid or expired refresh token",
+		}, status.Error(codes.Unauthenticated, "Invalid or expired refresh token")
+	}
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to refresh session", err)
+		return &proto.RefreshSessionResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	accessToken, expiresAt, err := s.tokens.Issue(user.ID, user.Email, session.ID)
+	if err != nil {
+		log.Printf("Failed to issue token for user %d: %v", user.ID, err)
+		return &proto.RefreshSessionResponse{
+			Success: false,
+			Message: "Failed to issue token",
+		}, status.Error(codes.Internal, "Failed to issue token")
+	}
+
+	return &proto.RefreshSessionResponse{
+		AccessToken:           accessToken,
+		TokenType:             auth.TokenType,
+		ExpiresAt:             timestamppb.New(expiresAt),
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: timestamppb.New(next.ExpiresAt),
+		Session:               toProtoSession(session, session.ID),
+		Message:               "Session refreshed successfully",
+		Success:               true,
+	}, nil
+}
+
+// ListSessions lists the active sessions of the caller, or of any user for
+// admins
+func (s *UserService) ListSessions(ctx context.Context, req *proto.ListSessionsRequest) (*proto.ListSessionsResponse, error) {
+	if req.UserId < 0 {
+		return &proto.ListSessionsResponse{
+			Success: false,
+			Message: "Invalid user ID",
+		}, status.Error(codes.InvalidArgument, "Invalid user ID")
+	}
+
+	userID, err := s.sessionOwner(ctx, req.UserId)
+	if err != nil {
+		return &proto.ListSessionsResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	sessions, err := s.sessionRepo.ListActive(userID, time.Now())
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to list sessions", err)
+		return &proto.ListSessionsResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	current := currentSessionID(ctx)
+	protoSessions := make([]*proto.Session, len(sessions))
+	for i := range sessions {
+		protoSessions[i] = toProtoSession(&sessions[i], current)
+	}
+
+	return &proto.ListSessionsResponse{
+		Sessions: protoSessions,
+		Message:  "Sessions retrieved successfully",
+		Success:  true,
+	}, nil
+}
+
+// RevokeSession logs out a session. Users may revoke their own sessions and
+// admins any session.
+func (s *UserService) RevokeSession(ctx context.Context, req *proto.RevokeSessionRequest) (*proto.RevokeSessionResponse, error) {
+	if req.Id <= 0 {
+		return &proto.RevokeSessionResponse{
+			Success: false,
+			Message: "Invalid session ID",
+		}, status.Error(codes.InvalidArgument, "Invalid session ID")
+	}
+
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.RevokeSessionResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	session, err := s.sessionRepo.GetByID(uint(req.Id))
+	if err != nil {
+		if repository.IsNotFound(err) {
+			return &proto.RevokeSessionResponse{
+				Success: false,
+				Message: "Session not found",
+			}, status.Error(codes.NotFound, "Session not found")
+		}
+		st := rpcerror.Storage(ctx, "Failed to get session", err)
+		return &proto.RevokeSessionResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	if session.UserID != caller.ID && !s.hasRole(caller, models.RoleAdmin) {
+		// Other users' sessions are reported as missing, not forbidden, so
+		// session IDs cannot be probed
+		return &proto.RevokeSessionResponse{
+			Success: false,
+			Message: "Session not found",
+		}, status.Error(codes.NotFound, "Session not found")
+	}
+
+	audit := s.sessionAuditEvent(ctx, models.AuditSessionRevoked, caller, session.UserID, map[string]interface{}{
+		"session_id": session.ID,
+	})
+
+	revoked, err := s.sessionRepo.Revoke(session, models.SessionRevokedByUser, audit)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to revoke session", err)
+		return &proto.RevokeSessionResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	message := "Session revoked successfully"
+	if !revoked {
+		message = "Session was already revoked"
+	}
+
+	return &proto.RevokeSessionResponse{
+		Session: toProtoSession(session, currentSessionID(ctx)),
+		Message: message,
+		Success: true,
+	}, nil
+}
+
+// RevokeAllSessions logs out every session of the caller, or of any user for
+// admins, optionally keeping the caller's own session
+func (s *UserService) RevokeAllSessions(ctx context.Context, req *proto.RevokeAllSessionsRequest) (*proto.RevokeAllSessionsResponse, error) {
+	if req.UserId < 0 {
+		return &proto.RevokeAllSessionsResponse{
+			Success: false,
+			Message: "Invalid user ID",
+		}, status.Error(codes.InvalidArgument, "Invalid user ID")
+	}
+
+	caller, err := s.currentCaller(ctx)
+	if err != nil {
+		return &proto.RevokeAllSessionsResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	userID, err := s.sessionOwner(ctx, req.UserId)
+	if err != nil {
+		return &proto.RevokeAllSessionsResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	var keep uint
+	if req.KeepCurrent && userID == caller.ID {
+		keep = currentSessionID(ctx)
+	}
+
+	audit := s.sessionAuditEvent(ctx, models.AuditSessionsRevoked, caller, userID, map[string]interface{}{
+		"kept_session_id": keep,
+	})
+
+	revoked, err := s.sessionRepo.RevokeAll(userID, keep, models.SessionRevokedByUser, audit)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to revoke sessions", err)
+		return &proto.RevokeAllSessionsResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	return &proto.RevokeAllSessionsResponse{
+		RevokedCount: revoked,
+		Message:      "Sessions revoked successfully",
+		Success:      true,
+	}, nil
+}
+
+// revokeSessionsAfterPasswordChange logs out the sessions of a user whose
+// password was changed or reset, except keep if not zero. Failures are only
+// logged, the password has been changed already.
+func (s *UserService) revokeSessionsAfterPasswordChange(ctx context.Context, actor *models.User, userID, keep uint) {
+	audit := s.sessionAuditEvent(ctx, models.AuditSessionsRevoked, actor, userID, map[string]interface{}{
+		"kept_session_id": keep,
+		"reason":          models.SessionRevokedPassword,
+	})
+	if _, err := s.sessionRepo.RevokeAll(userID, keep, models.SessionRevokedPassword, audit); err != nil {
+		log.Printf("Failed to revoke sessions of user %d after a password change: %v", userID, err)
+	}
+}
+
+// sessionOwner returns whose sessions a call acts on: the requested user, or
+// the caller when none was requested. Acting on other users' sessions
+// requires the admin role.
+func (s *UserService) sessionOwner(ctx context.Context, requested int64) (uint, error) {
+	if requested == 0 {
+		caller, err := s.currentCaller(ctx)
+		if err != nil {
+			return 0, err
+		}
+		return caller.ID, nil
+	}
+
+	if _, err := s.requireSelfOrRole(ctx, uint(requested), models.RoleAdmin); err != nil {
+		return 0, err
+	}
+	return uint(requested), nil
+}
+
+// currentSessionID returns the session of the caller's access token, or 0
+func currentSessionID(ctx context.Context) uint {
+	principal, ok := auth.FromContext(ctx)
+	if !ok {
+		return 0
+	}
+	return principal.SessionID
+}
+
+// sessionAuditEvent builds the audit event recording the revocation of
+// sessions
+func (s *UserService) sessionAuditEvent(ctx context.Context, action string, actor *models.User, userID uint, details map[string]interface{}) *models.AuditEvent {
+	data, _ := json.Marshal(details)
+
+	return s.auditContext(ctx, &models.AuditEvent{
+		ActorID:      actor.ID,
+		Action:       action,
+		TargetUserID: userID,
+		Details:      string(data),
+	})
+}
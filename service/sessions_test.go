@@ -0,0 +1,48 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRefreshSessionKeepsTokenOfUnverifiedUser(t *testing.T) {
+	s := newTestService(t)
+	s.SetTokenManager(auth.NewTokenManager([]byte("0123456789abcdef0123456789abcdef"), "test", time.Minute))
+	s.SetRequireVerifiedEmail(true)
+	ctx := context.Background()
+
+	user := &models.User{Name: "Unverified User", Email: "unverified@example.com", Age: 30}
+	if err := database.DB.Create(user).Error; err != nil {
+		t.Fatalf("create user: %v", err)
+	}
+	_, refreshToken, err := s.startSession(ctx, user)
+	if err != nil {
+		t.Fatalf("startSession: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := s.RefreshSession(ctx, &proto.RefreshSessionRequest{RefreshToken: refreshToken})
+		if status.Code(err) != codes.FailedPrecondition {
+			t.Fatalf("RefreshSession of an unverified user: %v, want FailedPrecondition", err)
+		}
+	}
+
+	if err := database.DB.Model(user).Update("email_verified", true).Error; err != nil {
+		t.Fatalf("verify email: %v", err)
+	}
+	resp, err := s.RefreshSession(ctx, &proto.RefreshSessionRequest{RefreshToken: refreshToken})
+	if err != nil {
+		t.Fatalf("RefreshSession after verifying the email: %v", err)
+	}
+	if resp.AccessToken == "" || resp.RefreshToken == "" || resp.RefreshToken == refreshToken {
+		t.Errorf("RefreshSession() = %+v, want new tokens", resp)
+	}
+}
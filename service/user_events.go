@@ -0,0 +1,217 @@
+package service
+
+import (
+	"sync"
+
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// Events buffered per subscriber before it has to catch up from the log
+	subscriberBufferSize = 256
+	// Events read per query when replaying the log
+	replayBatchSize = 100
+)
+
+// userEventHub fans out user events to live subscribers. Events are stored
+// by the repositories, in the transaction making the change, and published
+// here once it commits.
+type userEventHub struct {
+	eventRepo *repository.UserEventRepository
+
+	mu          sync.Mutex
+	subscribers map[*userEventSubscriber]struct{}
+
+	// closed is closed when the server shuts down, ending all streams
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// userEventSubscriber receives events published after it subscribed. When
+// events is full the event is dropped and missed is signalled instead, and
+// the subscriber reads what it missed back from the log.
+type userEventSubscriber struct {
+	events chan models.UserEvent
+	missed chan struct{}
+}
+
+func newUserEventHub() *userEventHub {
+	return &userEventHub{
+		eventRepo:   repository.NewUserEventRepository(),
+		subscribers: make(map[*userEventSubscriber]struct{}),
+		closed:      make(chan struct{}),
+	}
+}
+
+// newUserEvent starts an event of the given type, to be stored by the
+// repository along with the change
+func newUserEvent(eventType string) *models.UserEvent {
+	return &models.UserEvent{Type: eventType}
+}
+
+// publish hands a committed event to the subscribers. Events that were not
+// stored, because the change turned out to be a no-op, are skipped.
+func (h *userEventHub) publish(event *models.UserEvent) {
+	if event.ID == 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- *event:
+		default:
+			select {
+			case sub.missed <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (h *userEventHub) subscribe() *userEventSubscriber {
+	sub := &userEventSubscriber{
+		events: make(chan models.UserEvent, subscriberBufferSize),
+		missed: make(chan struct{}, 1),
+	}
+
+	h.mu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+func (h *userEventHub) unsubscribe(sub *userEventSubscriber) {
+	h.mu.Lock()
+	delete(h.subscribers, sub)
+	h.mu.Unlock()
+}
+
+func (h *userEventHub) close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+// CloseWatchers ends all WatchUsers streams, and any started later, with
+// Unavailable so a graceful stop does not wait for them. Clients resume on
+// another server with after_sequence.
+func (s *UserService) CloseWatchers() {
+	s.events.close()
+}
+
+// WatchUsers streams user change events, optionally replaying stored events
+// first so reconnecting subscribers can resume where they left off
+func (s *UserService) WatchUsers(req *proto.WatchUsersRequest, stream grpc.ServerStreamingServer[proto.UserEvent]) error {
+	if _, err := s.requireRole(stream.Context(), models.RoleAdmin, models.RoleSupport); err != nil {
+		return err
+	}
+
+	if req.AfterSequence != nil && req.GetAfterSequence() < 0 {
+		return status.Error(codes.InvalidArgument, "Invalid after_sequence")
+	}
+
+	// Subscribe before reading the log so no event committed in between is
+	// missed
+	sub := s.events.subscribe()
+	defer s.events.unsubscribe(sub)
+
+	var lastSequence uint
+	if req.AfterSequence != nil {
+		lastSequence = uint(req.GetAfterSequence())
+	} else {
+		// Only events from now on
+		sequence, err := s.events.eventRepo.LastSequence()
+		if err != nil {
+			return rpcerror.Storage(stream.Context(), "Failed to read user events", err).Err()
+		}
+		lastSequence = sequence
+	}
+
+	// catchUp sends the stored events after lastSequence, a page at a time
+	catchUp := func() error {
+		for {
+			events, err := s.events.eventRepo.ListAfter(lastSequence, replayBatchSize)
+			if err != nil {
+				return rpcerror.Storage(stream.Context(), "Failed to replay user events", err).Err()
+			}
+
+			for _, event := range events {
+				if err := sendUserEvent(stream, event); err != nil {
+					return err
+				}
+				lastSequence = event.ID
+			}
+
+			if len(events) < replayBatchSize {
+				return nil
+			}
+		}
+	}
+
+	if req.AfterSequence != nil {
+		if err := catchUp(); err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.events.closed:
+			return status.Errorf(codes.Unavailable, "Server is shutting down, resume after sequence %d", lastSequence)
+		case <-sub.missed:
+			if err := catchUp(); err != nil {
+				return err
+			}
+		case event := <-sub.events:
+			// Already sent from the log
+			if event.ID <= lastSequence {
+				continue
+			}
+			// Events may be published out of order, or skipped while the
+			// buffer was full, so anything unexpected is read from the log
+			if event.ID != lastSequence+1 {
+				if err := catchUp(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := sendUserEvent(stream, event); err != nil {
+				return err
+			}
+			lastSequence = event.ID
+		}
+	}
+}
+
+func sendUserEvent(stream grpc.ServerStreamingServer[proto.UserEvent], event models.UserEvent) error {
+	user, err := event.User()
+	if err != nil {
+		return status.Errorf(codes.Internal, "Corrupt user event %d", event.ID)
+	}
+
+	return stream.Send(&proto.UserEvent{
+		Sequence:   int64(event.ID),
+		Type:       userEventTypes[event.Type],
+		User:       toProtoUser(user),
+		OccurredAt: timestamppb.New(event.CreatedAt),
+	})
+}
+
+var userEventTypes = map[string]proto.UserEventType{
+	models.UserEventCreated:  proto.UserEventType_USER_EVENT_TYPE_CREATED,
+	models.UserEventUpdated:  proto.UserEventType_USER_EVENT_TYPE_UPDATED,
+	models.UserEventDeleted:  proto.UserEventType_USER_EVENT_TYPE_DELETED,
+	models.UserEventRestored: proto.UserEventType_USER_EVENT_TYPE_RESTORED,
+	models.UserEventPurged:   proto.UserEventType_USER_EVENT_TYPE_PURGED,
+}
@@ -0,0 +1,67 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/riskykurniawan15/learn-grpc/database"
+	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/proto"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestDeleteEventCarriesDeletionTime(t *testing.T) {
+	s := newTestService(t)
+	s.SetRequireAdminMFA(false)
+	admin := createTestUserWithRole(t, "admin@example.com", models.RoleAdmin)
+	user := createTestUser(t, "deleted@example.com")
+
+	if _, err := s.DeleteUser(callerContext(admin), &proto.DeleteUserRequest{Id: int64(user.ID)}); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+
+	var event models.UserEvent
+	if err := database.DB.Where("user_id = ? AND type = ?", user.ID, models.UserEventDeleted).First(&event).Error; err != nil {
+		t.Fatalf("no delete event: %v", err)
+	}
+	deleted, err := event.User()
+	if err != nil {
+		t.Fatalf("decode event: %v", err)
+	}
+	if !deleted.DeletedAt.Valid || toProtoUser(deleted).DeletedAt == nil {
+		t.Errorf("delete event payload %s has no deleted_at", event.Payload)
+	}
+}
+
+func TestPurgeKeepsEventLog(t *testing.T) {
+	s := newTestService(t)
+	s.SetRequireAdminMFA(false)
+	s.SetAdminKey("admin-key")
+	admin := createTestUserWithRole(t, "admin@example.com", models.RoleAdmin)
+	ctx := metadata.NewIncomingContext(callerContext(admin), metadata.Pairs(AdminKeyMetadata, "admin-key"))
+	user := createTestUser(t, "purged@example.com")
+
+	if _, err := s.DeleteUser(ctx, &proto.DeleteUserRequest{Id: int64(user.ID)}); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := s.PurgeUser(ctx, &proto.PurgeUserRequest{Id: int64(user.ID)}); err != nil {
+		t.Fatalf("PurgeUser: %v", err)
+	}
+
+	var events []models.UserEvent
+	if err := database.DB.Where("user_id = ?", user.ID).Order("id").Find(&events).Error; err != nil {
+		t.Fatalf("list events: %v", err)
+	}
+	if len(events) != 2 || events[0].Type != models.UserEventDeleted || events[1].Type != models.UserEventPurged {
+		t.Fatalf("events of the purged user = %+v, want the delete event followed by a purge event", events)
+	}
+	purged, err := events[1].User()
+	if err != nil {
+		t.Fatalf("decode purge event: %v", err)
+	}
+	if purged.ID != user.ID || purged.Email != "" {
+		t.Errorf("purge event payload %s, want only the user id", events[1].Payload)
+	}
+	if userEventTypes[events[1].Type] != proto.UserEventType_USER_EVENT_TYPE_PURGED {
+		t.Errorf("purge event is sent as %v", userEventTypes[events[1].Type])
+	}
+}
@@ -2,34 +2,120 @@ package service
 
 import (
 	"context"
-	"crypto/sha256"
+	"errors"
 	"fmt"
+	"log"
+	"net/netip"
+	"slices"
 	"strings"
 	"time"
+	"unicode"
 
+	"github.com/riskykurniawan15/learn-grpc/auth"
+	"github.com/riskykurniawan15/learn-grpc/encryption"
+	"github.com/riskykurniawan15/learn-grpc/lockout"
 	"github.com/riskykurniawan15/learn-grpc/models"
+	"github.com/riskykurniawan15/learn-grpc/notify"
+	"github.com/riskykurniawan15/learn-grpc/password"
 	"github.com/riskykurniawan15/learn-grpc/proto"
 	"github.com/riskykurniawan15/learn-grpc/repository"
+	"github.com/riskykurniawan15/learn-grpc/rpcerror"
 	"github.com/riskykurniawan15/learn-grpc/validation"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // UserService implements the gRPC UserService interface
 type UserService struct {
 	proto.UnimplementedUserServiceServer
-	userRepo  *repository.UserRepository
-	validator *validation.Validator
+	userRepo   *repository.UserRepository
+	roleRepo   *repository.RoleRepository
+	apiKeyRepo *repository.APIKeyRepository
+	auditRepo  *repository.AuditRepository
+	validator  *validation.Validator
+	events     *userEventHub
+	passwords  *password.Manager
+	tokens     *auth.TokenManager
+	adminKey   string
+
+	resetRepo *repository.PasswordResetRepository
+	mailer    notify.Mailer
+	resetTTL  time.Duration
+
+	verificationRepo     *repository.EmailVerificationRepository
+	verificationTTL      time.Duration
+	requireVerifiedEmail bool
+
+	sessionRepo *repository.SessionRepository
+	refreshTTL  time.Duration
+
+	mfaRepo         *repository.MFARepository
+	mfaCipher       *encryption.Cipher
+	requireAdminMFA bool
+
+	lockout        *lockout.Tracker
+	trustedProxies []netip.Prefix
 }
 
 // NewUserService creates a new user service
 func NewUserService(validator *validation.Validator) *UserService {
 	return &UserService{
-		userRepo:  repository.NewUserRepository(),
-		validator: validator,
+		userRepo:   repository.NewUserRepository(),
+		roleRepo:   repository.NewRoleRepository(),
+		apiKeyRepo: repository.NewAPIKeyRepository(),
+		auditRepo:  repository.NewAuditRepository(),
+		validator:  validator,
+		events:     newUserEventHub(),
+		passwords:  password.NewDefaultManager(),
+		resetRepo:  repository.NewPasswordResetRepository(),
+		mailer:     notify.LogMailer{},
+		resetTTL:   DefaultPasswordResetTTL,
+
+		verificationRepo: repository.NewEmailVerificationRepository(),
+		verificationTTL:  DefaultEmailVerificationTTL,
+
+		sessionRepo: repository.NewSessionRepository(),
+		refreshTTL:  DefaultRefreshTokenTTL,
+
+		mfaRepo:         repository.NewMFARepository(),
+		requireAdminMFA: true,
+
+		lockout:        lockout.NewTracker(lockout.DefaultAccountPolicy, lockout.DefaultAddressPolicy),
+		trustedProxies: defaultTrustedProxies,
 	}
 }
 
+// toProtoUser converts a user model to its proto message
+func toProtoUser(user *models.User) *proto.User {
+	protoUser := &proto.User{
+		Id:        int64(user.ID),
+		Name:      user.Name,
+		Email:     user.Email,
+		Age:       int32(user.Age),
+		CreatedAt: timestamppb.New(user.CreatedAt),
+		UpdatedAt: timestamppb.New(user.UpdatedAt),
+
+		// Kept for clients that have not moved to the Timestamp fields yet
+		LegacyCreatedAt: user.CreatedAt.Format(time.RFC3339),
+		LegacyUpdatedAt: user.UpdatedAt.Format(time.RFC3339),
+
+		Version:       int64(user.Version),
+		EmailVerified: user.EmailVerified,
+		TotpEnabled:   user.TOTPEnabled,
+	}
+
+	if user.DeletedAt.Valid {
+		protoUser.DeletedAt = timestamppb.New(user.DeletedAt.Time)
+	}
+
+	for _, role := range user.Roles {
+		protoUser.Roles = append(protoUser.Roles, role.Role)
+	}
+
+	return protoUser
+}
+
 // CreateUser creates a new user
 func (s *UserService) CreateUser(ctx context.Context, req *proto.CreateUserRequest) (*proto.CreateUserResponse, error) {
 	// Convert proto request to validation struct
@@ -46,7 +132,7 @@ func (s *UserService) CreateUser(ctx context.Context, req *proto.CreateUserReque
 		return &proto.CreateUserResponse{
 			Success: false,
 			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
-		}, status.Error(codes.InvalidArgument, "Validation failed")
+		}, validationFailed(s.validator.GetFieldViolations(err))
 	}
 
 	// Check if email already exists
@@ -59,7 +145,13 @@ func (s *UserService) CreateUser(ctx context.Context, req *proto.CreateUserReque
 	}
 
 	// Hash password
-	hashedPassword := fmt.Sprintf("%x", sha256.Sum256([]byte(req.Password)))
+	hashedPassword, err := s.passwords.Hash(req.Password)
+	if err != nil {
+		return &proto.CreateUserResponse{
+			Success: false,
+			Message: "Failed to hash password",
+		}, status.Error(codes.Internal, "Failed to hash password")
+	}
 
 	// Create user model
 	user := &models.User{
@@ -70,23 +162,26 @@ func (s *UserService) CreateUser(ctx context.Context, req *proto.CreateUserReque
 	}
 
 	// Save to database
-	if err := s.userRepo.Create(user); err != nil {
+	event := newUserEvent(models.UserEventCreated)
+	if err := s.userRepo.Create(user, s.userAuditEvent(ctx, models.AuditUserCreated, nil, user), event); err != nil {
+		st := rpcerror.Storage(ctx, "Failed to create user", err)
 		return &proto.CreateUserResponse{
 			Success: false,
-			Message: "Failed to create user: " + err.Error(),
-		}, status.Error(codes.Internal, "Database error")
+			Message: st.Message(),
+		}, st.Err()
 	}
 
-	// Convert to proto message
-	protoUser := &proto.User{
-		Id:        int64(user.ID),
-		Name:      user.Name,
-		Email:     user.Email,
-		Age:       int32(user.Age),
-		CreatedAt: user.CreatedAt.Format(time.RFC3339),
-		UpdatedAt: user.UpdatedAt.Format(time.RFC3339),
+	s.events.publish(event)
+
+	// The user is created either way, the token can be sent again with
+	// ResendVerificationEmail
+	if err := s.sendVerificationEmail(ctx, user); err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
 	}
 
+	// Convert to proto message
+	protoUser := toProtoUser(user)
+
 	return &proto.CreateUserResponse{
 		User:    protoUser,
 		Message: "User created successfully",
@@ -103,22 +198,23 @@ func (s *UserService) GetUser(ctx context.Context, req *proto.GetUserRequest) (*
 		}, status.Error(codes.InvalidArgument, "Invalid user ID")
 	}
 
+	if _, err := s.requireSelfOrRole(ctx, uint(req.Id), models.RoleAdmin, models.RoleSupport); err != nil {
+		return &proto.GetUserResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
 	user, err := s.userRepo.GetByID(uint(req.Id))
 	if err != nil {
+		st := rpcerror.Lookup(ctx, "User not found", err)
 		return &proto.GetUserResponse{
 			Success: false,
-			Message: "User not found",
-		}, status.Error(codes.NotFound, "User not found")
+			Message: st.Message(),
+		}, st.Err()
 	}
 
-	protoUser := &proto.User{
-		Id:        int64(user.ID),
-		Name:      user.Name,
-		Email:     user.Email,
-		Age:       int32(user.Age),
-		CreatedAt: user.CreatedAt.Format(time.RFC3339),
-		UpdatedAt: user.UpdatedAt.Format(time.RFC3339),
-	}
+	protoUser := toProtoUser(user)
 
 	return &proto.GetUserResponse{
 		User:    protoUser,
@@ -128,26 +224,28 @@ func (s *UserService) GetUser(ctx context.Context, req *proto.GetUserRequest) (*
 }
 
 // GetAllUsers retrieves all users
+//
+// Deprecated: use ListUsers, which pages through the results.
 func (s *UserService) GetAllUsers(ctx context.Context, req *proto.GetAllUsersRequest) (*proto.GetAllUsersResponse, error) {
+	if _, err := s.requireRole(ctx, models.RoleAdmin); err != nil {
+		return &proto.GetAllUsersResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
 	users, err := s.userRepo.GetAll()
 	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to retrieve users", err)
 		return &proto.GetAllUsersResponse{
 			Success: false,
-			Message: "Failed to retrieve users: " + err.Error(),
-		}, status.Error(codes.Internal, "Database error")
+			Message: st.Message(),
+		}, st.Err()
 	}
 
 	var protoUsers []*proto.User
-	for _, user := range users {
-		protoUser := &proto.User{
-			Id:        int64(user.ID),
-			Name:      user.Name,
-			Email:     user.Email,
-			Age:       int32(user.Age),
-			CreatedAt: user.CreatedAt.Format(time.RFC3339),
-			UpdatedAt: user.UpdatedAt.Format(time.RFC3339),
-		}
-		protoUsers = append(protoUsers, protoUser)
+	for i := range users {
+		protoUsers = append(protoUsers, toProtoUser(&users[i]))
 	}
 
 	return &proto.GetAllUsersResponse{
@@ -157,6 +255,177 @@ func (s *UserService) GetAllUsers(ctx context.Context, req *proto.GetAllUsersReq
 	}, nil
 }
 
+// ListUsers retrieves a page of users matching the request filters
+func (s *UserService) ListUsers(ctx context.Context, req *proto.ListUsersRequest) (*proto.ListUsersResponse, error) {
+	if _, err := s.requireRole(ctx, models.RoleAdmin, models.RoleSupport); err != nil {
+		return &proto.ListUsersResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	orderBy, desc, err := parseOrderBy(req.OrderBy)
+	if err != nil {
+		return &proto.ListUsersResponse{
+			Success: false,
+			Message: "Validation failed: " + err.Error(),
+		}, validationFailed([]validation.FieldViolation{{
+			Field:   "order_by",
+			Rule:    "format",
+			Message: err.Error(),
+		}})
+	}
+
+	filter := req.GetFilter()
+
+	// Convert proto request to validation struct
+	listReq := models.ListUsersRequest{
+		PageSize: int(req.PageSize),
+		OrderBy:  orderBy,
+		Filter: models.ListUsersFilter{
+			MinAge:      int(filter.GetMinAge()),
+			MaxAge:      int(filter.GetMaxAge()),
+			NamePrefix:  filter.GetNamePrefix(),
+			EmailDomain: filter.GetEmailDomain(),
+		},
+	}
+
+	// Validate request
+	if err := s.validator.ValidateStruct(listReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.ListUsersResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	opts := repository.UserListOptions{
+		Limit:       listReq.PageSize,
+		OrderBy:     listReq.OrderBy,
+		Desc:        desc,
+		MinAge:      listReq.Filter.MinAge,
+		MaxAge:      listReq.Filter.MaxAge,
+		NamePrefix:  listReq.Filter.NamePrefix,
+		EmailDomain: listReq.Filter.EmailDomain,
+	}
+	if opts.Limit == 0 {
+		opts.Limit = defaultPageSize
+	}
+	if opts.Limit > maxPageSize {
+		opts.Limit = maxPageSize
+	}
+
+	// Timestamps are stored in local time, so compare them in local time too
+	if filter.GetCreatedAfter() != nil {
+		opts.CreatedAfter = filter.GetCreatedAfter().AsTime().Local()
+	}
+	if filter.GetCreatedBefore() != nil {
+		opts.CreatedBefore = filter.GetCreatedBefore().AsTime().Local()
+	}
+
+	if req.PageToken != "" {
+		cursor, err := decodePageToken(req.PageToken, opts)
+		if err != nil {
+			return &proto.ListUsersResponse{
+				Success: false,
+				Message: "Invalid page token",
+			}, status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+		opts.After = cursor
+	}
+
+	users, total, err := s.userRepo.List(opts)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to retrieve users", err)
+		return &proto.ListUsersResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	// The repository returns one extra row when another page follows
+	var nextPageToken string
+	if len(users) > opts.Limit {
+		users = users[:opts.Limit]
+		nextPageToken = encodePageToken(opts, users[len(users)-1])
+	}
+
+	var protoUsers []*proto.User
+	for i := range users {
+		protoUsers = append(protoUsers, toProtoUser(&users[i]))
+	}
+
+	return &proto.ListUsersResponse{
+		Users:         protoUsers,
+		NextPageToken: nextPageToken,
+		TotalSize:     total,
+		Message:       "Users retrieved successfully",
+		Success:       true,
+	}, nil
+}
+
+// SearchUsers finds users by partial name or email
+func (s *UserService) SearchUsers(ctx context.Context, req *proto.SearchUsersRequest) (*proto.SearchUsersResponse, error) {
+	if _, err := s.requireRole(ctx, models.RoleAdmin, models.RoleSupport); err != nil {
+		return &proto.SearchUsersResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	searchReq := models.SearchUsersRequest{
+		Query:    strings.TrimSpace(req.Query),
+		PageSize: int(req.PageSize),
+	}
+
+	if err := s.validator.ValidateStruct(searchReq); err != nil {
+		validationErrors := s.validator.GetValidationErrors(err)
+		return &proto.SearchUsersResponse{
+			Success: false,
+			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+		}, validationFailed(s.validator.GetFieldViolations(err))
+	}
+
+	limit := searchReq.PageSize
+	if limit == 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+
+	results, err := s.userRepo.Search(searchTerms(searchReq.Query), limit)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to search users", err)
+		return &proto.SearchUsersResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	var protoResults []*proto.SearchUserResult
+	for i := range results {
+		protoResults = append(protoResults, &proto.SearchUserResult{
+			User:  toProtoUser(&results[i].User),
+			Score: results[i].Score,
+		})
+	}
+
+	return &proto.SearchUsersResponse{
+		Results: protoResults,
+		Message: "Users retrieved successfully",
+		Success: true,
+	}, nil
+}
+
+// searchTerms splits a search query into lower-cased words, the same way the
+// search index tokenizes names and emails
+func searchTerms(query string) []string {
+	return strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
 // UpdateUser updates a user
 func (s *UserService) UpdateUser(ctx context.Context, req *proto.UpdateUserRequest) (*proto.UpdateUserResponse, error) {
 	if req.Id <= 0 {
@@ -166,82 +435,164 @@ func (s *UserService) UpdateUser(ctx context.Context, req *proto.UpdateUserReque
 		}, status.Error(codes.InvalidArgument, "Invalid user ID")
 	}
 
+	caller, err := s.requireSelfOrRole(ctx, uint(req.Id), models.RoleAdmin, models.RoleSupport)
+	if err != nil {
+		return &proto.UpdateUserResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
 	// Get existing user
 	user, err := s.userRepo.GetByID(uint(req.Id))
 	if err != nil {
+		st := rpcerror.Lookup(ctx, "User not found", err)
 		return &proto.UpdateUserResponse{
 			Success: false,
-			Message: "User not found",
-		}, status.Error(codes.NotFound, "User not found")
+			Message: st.Message(),
+		}, st.Err()
 	}
 
-	// Create update request for validation
-	updateReq := models.UpdateUserRequest{}
-
-	if req.Name != "" {
-		updateReq.Name = req.Name
-	}
-	if req.Email != "" {
-		updateReq.Email = req.Email
-	}
-	if req.Password != "" {
-		updateReq.Password = req.Password
-	}
-	if req.Age > 0 {
-		updateReq.Age = int(req.Age)
+	if req.ExpectedVersion > 0 && uint(req.ExpectedVersion) != user.Version {
+		return &proto.UpdateUserResponse{
+			Success: false,
+			Message: versionConflictMessage(user.Version),
+		}, versionConflict(user.Version)
 	}
 
-	// Validate update request
-	if err := s.validator.ValidateStruct(updateReq); err != nil {
-		validationErrors := s.validator.GetValidationErrors(err)
+	// Passwords are changed with ChangePassword or a password reset, which
+	// prove the caller knows the current password or owns the email
+	if req.Password != "" || slices.Contains(req.GetUpdateMask().GetPaths(), "password") {
+		violation := validation.FieldViolation{
+			Field:   "password",
+			Rule:    "read_only",
+			Message: "password cannot be changed with UpdateUser, use ChangePassword or RequestPasswordReset",
+		}
 		return &proto.UpdateUserResponse{
 			Success: false,
-			Message: "Validation failed: " + strings.Join(validationErrors, "; "),
-		}, status.Error(codes.InvalidArgument, "Validation failed")
+			Message: "Validation failed: " + violation.Message,
+		}, validationFailed([]validation.FieldViolation{violation})
 	}
 
-	// Check email uniqueness if updating email
-	if req.Email != "" && req.Email != user.Email {
-		existingUser, _ := s.userRepo.GetByEmail(req.Email)
-		if existingUser != nil {
+	// Work out which fields to update and validate them
+	var paths []string
+	if len(req.GetUpdateMask().GetPaths()) > 0 {
+		paths, err = normalizeUpdateMask(req.UpdateMask.Paths)
+		if err != nil {
 			return &proto.UpdateUserResponse{
 				Success: false,
-				Message: "Email already exists",
-			}, status.Error(codes.AlreadyExists, "Email already exists")
+				Message: err.Error(),
+			}, status.Error(codes.InvalidArgument, err.Error())
 		}
-	}
 
-	// Update fields
-	if req.Name != "" {
-		user.Name = req.Name
-	}
-	if req.Email != "" {
-		user.Email = req.Email
+		patchReq := models.PatchUserRequest{
+			Name:  req.Name,
+			Email: req.Email,
+			Age:   int(req.Age),
+		}
+
+		fields := make([]string, len(paths))
+		for i, path := range paths {
+			fields[i] = updateMaskFields[path]
+		}
+
+		if err := s.validator.ValidateStructPartial(patchReq, fields...); err != nil {
+			validationErrors := s.validator.GetValidationErrors(err)
+			return &proto.UpdateUserResponse{
+				Success: false,
+				Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+			}, validationFailed(s.validator.GetFieldViolations(err))
+		}
+	} else {
+		// Without a mask, update the fields that are set
+		updateReq := models.UpdateUserRequest{}
+
+		if req.Name != "" {
+			updateReq.Name = req.Name
+			paths = append(paths, "name")
+		}
+		if req.Email != "" {
+			updateReq.Email = req.Email
+			paths = append(paths, "email")
+		}
+		if req.Age > 0 {
+			updateReq.Age = int(req.Age)
+			paths = append(paths, "age")
+		}
+
+		// Validate update request
+		if err := s.validator.ValidateStruct(updateReq); err != nil {
+			validationErrors := s.validator.GetValidationErrors(err)
+			return &proto.UpdateUserResponse{
+				Success: false,
+				Message: "Validation failed: " + strings.Join(validationErrors, "; "),
+			}, validationFailed(s.validator.GetFieldViolations(err))
+		}
 	}
-	if req.Password != "" {
-		user.Password = fmt.Sprintf("%x", sha256.Sum256([]byte(req.Password)))
+
+	if err := s.checkUpdateFields(caller, user.ID, paths); err != nil {
+		return &proto.UpdateUserResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
 	}
-	if req.Age > 0 {
-		user.Age = int(req.Age)
+
+	// Update fields
+	before := *user
+	emailChanged := false
+	for _, path := range paths {
+		switch path {
+		case "name":
+			user.Name = req.Name
+		case "email":
+			// Check email uniqueness if updating email
+			if req.Email != user.Email {
+				existingUser, _ := s.userRepo.GetByEmail(req.Email)
+				if existingUser != nil {
+					return &proto.UpdateUserResponse{
+						Success: false,
+						Message: "Email already exists",
+					}, status.Error(codes.AlreadyExists, "Email already exists")
+				}
+			}
+			if req.Email != user.Email {
+				// The new email has to be verified again
+				user.EmailVerified = false
+				emailChanged = true
+			}
+			user.Email = req.Email
+		case "age":
+			user.Age = int(req.Age)
+		}
 	}
 
-	// Save changes
-	if err := s.userRepo.Update(user); err != nil {
+	// Save changes, failing if someone else changed the user since it was loaded
+	event := newUserEvent(models.UserEventUpdated)
+	if err := s.userRepo.Update(user, s.userAuditEvent(ctx, models.AuditUserUpdated, &before, user), event); err != nil {
+		if errors.Is(err, repository.ErrVersionConflict) {
+			currentVersion := s.currentVersion(user.ID)
+			return &proto.UpdateUserResponse{
+				Success: false,
+				Message: versionConflictMessage(currentVersion),
+			}, versionConflict(currentVersion)
+		}
+		st := rpcerror.Storage(ctx, "Failed to update user", err)
 		return &proto.UpdateUserResponse{
 			Success: false,
-			Message: "Failed to update user: " + err.Error(),
-		}, status.Error(codes.Internal, "Database error")
+			Message: st.Message(),
+		}, st.Err()
 	}
 
-	protoUser := &proto.User{
-		Id:        int64(user.ID),
-		Name:      user.Name,
-		Email:     user.Email,
-		Age:       int32(user.Age),
-		CreatedAt: user.CreatedAt.Format(time.RFC3339),
-		UpdatedAt: user.UpdatedAt.Format(time.RFC3339),
+	s.events.publish(event)
+
+	if emailChanged {
+		if err := s.sendVerificationEmail(ctx, user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
 	}
 
+	protoUser := toProtoUser(user)
+
 	return &proto.UpdateUserResponse{
 		User:    protoUser,
 		Message: "User updated successfully",
@@ -249,8 +600,40 @@ func (s *UserService) UpdateUser(ctx context.Context, req *proto.UpdateUserReque
 	}, nil
 }
 
+// updateMaskFields maps the UpdateUser field mask paths to the fields of
+// models.PatchUserRequest
+var updateMaskFields = map[string]string{
+	"name":  "Name",
+	"email": "Email",
+	"age":   "Age",
+}
+
+// normalizeUpdateMask checks that every path of an UpdateUser field mask is
+// known and drops duplicates
+func normalizeUpdateMask(paths []string) ([]string, error) {
+	seen := make(map[string]bool, len(paths))
+	var normalized []string
+	for _, path := range paths {
+		if _, ok := updateMaskFields[path]; !ok {
+			return nil, fmt.Errorf("Unknown update_mask path: %q", path)
+		}
+		if !seen[path] {
+			seen[path] = true
+			normalized = append(normalized, path)
+		}
+	}
+	return normalized, nil
+}
+
 // DeleteUser deletes a user
 func (s *UserService) DeleteUser(ctx context.Context, req *proto.DeleteUserRequest) (*proto.DeleteUserResponse, error) {
+	if _, err := s.requireRole(ctx, models.RoleAdmin); err != nil {
+		return &proto.DeleteUserResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
 	if req.Id <= 0 {
 		return &proto.DeleteUserResponse{
 			Success: false,
@@ -259,24 +642,216 @@ func (s *UserService) DeleteUser(ctx context.Context, req *proto.DeleteUserReque
 	}
 
 	// Check if user exists
-	_, err := s.userRepo.GetByID(uint(req.Id))
+	user, err := s.userRepo.GetByID(uint(req.Id))
 	if err != nil {
+		st := rpcerror.Lookup(ctx, "User not found", err)
 		return &proto.DeleteUserResponse{
 			Success: false,
-			Message: "User not found",
-		}, status.Error(codes.NotFound, "User not found")
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	if req.ExpectedVersion > 0 && uint(req.ExpectedVersion) != user.Version {
+		return &proto.DeleteUserResponse{
+			Success: false,
+			Message: versionConflictMessage(user.Version),
+		}, versionConflict(user.Version)
 	}
 
 	// Delete user
-	if err := s.userRepo.Delete(uint(req.Id)); err != nil {
+	event := newUserEvent(models.UserEventDeleted)
+	if err := s.userRepo.Delete(user, uint(req.ExpectedVersion), s.userAuditEvent(ctx, models.AuditUserDeleted, user, nil), event); err != nil {
+		if errors.Is(err, repository.ErrVersionConflict) {
+			currentVersion := s.currentVersion(user.ID)
+			return &proto.DeleteUserResponse{
+				Success: false,
+				Message: versionConflictMessage(currentVersion),
+			}, versionConflict(currentVersion)
+		}
+		st := rpcerror.Storage(ctx, "Failed to delete user", err)
 		return &proto.DeleteUserResponse{
 			Success: false,
-			Message: "Failed to delete user: " + err.Error(),
-		}, status.Error(codes.Internal, "Database error")
+			Message: st.Message(),
+		}, st.Err()
 	}
 
+	s.events.publish(event)
+
 	return &proto.DeleteUserResponse{
 		Message: "User deleted successfully",
 		Success: true,
 	}, nil
 }
+
+// UndeleteUser restores a soft-deleted user
+func (s *UserService) UndeleteUser(ctx context.Context, req *proto.UndeleteUserRequest) (*proto.UndeleteUserResponse, error) {
+	caller, err := s.requireRole(ctx, models.RoleAdmin)
+	if err != nil {
+		return &proto.UndeleteUserResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	if req.Id <= 0 {
+		return &proto.UndeleteUserResponse{
+			Success: false,
+			Message: "Invalid user ID",
+		}, status.Error(codes.InvalidArgument, "Invalid user ID")
+	}
+
+	audit := s.auditContext(ctx, &models.AuditEvent{
+		ActorID:      caller.ID,
+		Action:       models.AuditUserRestored,
+		TargetUserID: uint(req.Id),
+	})
+	event := newUserEvent(models.UserEventRestored)
+	user, err := s.userRepo.Restore(uint(req.Id), audit, event)
+	if err != nil {
+		if repository.IsNotFound(err) {
+			return &proto.UndeleteUserResponse{
+				Success: false,
+				Message: "Deleted user not found",
+			}, status.Error(codes.NotFound, "Deleted user not found")
+		}
+		st := rpcerror.Storage(ctx, "Failed to restore user", err)
+		return &proto.UndeleteUserResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	s.events.publish(event)
+
+	return &proto.UndeleteUserResponse{
+		User:    toProtoUser(user),
+		Message: "User restored successfully",
+		Success: true,
+	}, nil
+}
+
+// ListDeletedUsers retrieves a page of soft-deleted users, most recently deleted first
+func (s *UserService) ListDeletedUsers(ctx context.Context, req *proto.ListDeletedUsersRequest) (*proto.ListDeletedUsersResponse, error) {
+	if _, err := s.requireRole(ctx, models.RoleAdmin, models.RoleSupport); err != nil {
+		return &proto.ListDeletedUsersResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	if req.PageSize < 0 {
+		return &proto.ListDeletedUsersResponse{
+			Success: false,
+			Message: "Invalid page size",
+		}, status.Error(codes.InvalidArgument, "Invalid page size")
+	}
+
+	opts := repository.UserListOptions{
+		Limit:   int(req.PageSize),
+		OrderBy: "deleted_at",
+		Desc:    true,
+		Deleted: true,
+	}
+	if opts.Limit == 0 {
+		opts.Limit = defaultPageSize
+	}
+	if opts.Limit > maxPageSize {
+		opts.Limit = maxPageSize
+	}
+
+	if req.PageToken != "" {
+		cursor, err := decodePageToken(req.PageToken, opts)
+		if err != nil {
+			return &proto.ListDeletedUsersResponse{
+				Success: false,
+				Message: "Invalid page token",
+			}, status.Error(codes.InvalidArgument, "Invalid page token")
+		}
+		opts.After = cursor
+	}
+
+	users, total, err := s.userRepo.List(opts)
+	if err != nil {
+		st := rpcerror.Storage(ctx, "Failed to retrieve deleted users", err)
+		return &proto.ListDeletedUsersResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	var nextPageToken string
+	if len(users) > opts.Limit {
+		users = users[:opts.Limit]
+		nextPageToken = encodePageToken(opts, users[len(users)-1])
+	}
+
+	var deletedUsers []*proto.DeletedUser
+	for i := range users {
+		deletedUsers = append(deletedUsers, &proto.DeletedUser{
+			User:      toProtoUser(&users[i]),
+			DeletedAt: timestamppb.New(users[i].DeletedAt.Time),
+		})
+	}
+
+	return &proto.ListDeletedUsersResponse{
+		Users:         deletedUsers,
+		NextPageToken: nextPageToken,
+		TotalSize:     total,
+		Message:       "Deleted users retrieved successfully",
+		Success:       true,
+	}, nil
+}
+
+// PurgeUser permanently removes a soft-deleted user, admin only
+func (s *UserService) PurgeUser(ctx context.Context, req *proto.PurgeUserRequest) (*proto.PurgeUserResponse, error) {
+	if _, err := s.requireRole(ctx, models.RoleAdmin); err != nil {
+		return &proto.PurgeUserResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+	if err := s.requireAdminKey(ctx); err != nil {
+		return &proto.PurgeUserResponse{
+			Success: false,
+			Message: status.Convert(err).Message(),
+		}, err
+	}
+
+	if req.Id <= 0 {
+		return &proto.PurgeUserResponse{
+			Success: false,
+			Message: "Invalid user ID",
+		}, status.Error(codes.InvalidArgument, "Invalid user ID")
+	}
+
+	// Only users that were deleted first can be purged
+	user, err := s.userRepo.GetDeletedByID(uint(req.Id))
+	if err != nil {
+		if _, getErr := s.userRepo.GetByID(uint(req.Id)); getErr == nil {
+			return &proto.PurgeUserResponse{
+				Success: false,
+				Message: "User must be deleted before it can be purged",
+			}, status.Error(codes.FailedPrecondition, "User must be deleted before it can be purged")
+		}
+		st := rpcerror.Lookup(ctx, "Deleted user not found", err)
+		return &proto.PurgeUserResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+
+	event := newUserEvent(models.UserEventPurged)
+	if err := s.userRepo.Purge(user.ID, s.userAuditEvent(ctx, models.AuditUserPurged, user, nil), event); err != nil {
+		st := rpcerror.Storage(ctx, "Failed to purge user", err)
+		return &proto.PurgeUserResponse{
+			Success: false,
+			Message: st.Message(),
+		}, st.Err()
+	}
+	s.events.publish(event)
+
+	return &proto.PurgeUserResponse{
+		Message: "User purged successfully",
+		Success: true,
+	}, nil
+}
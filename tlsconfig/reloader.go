@@ -0,0 +1,180 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultReloadInterval is how often Watch checks the files for changes
+// unless configured
+const DefaultReloadInterval = 30 * time.Second
+
+// Reloader holds a certificate key pair and a CA bundle loaded from disk and
+// reloads them when the files change, so certificates can be rotated without
+// a restart. Either part is optional.
+type Reloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// NewReloader loads the key pair from certFile and keyFile and the PEM CA
+// bundle from caFile. Leave certFile and keyFile or caFile empty to skip
+// that part.
+func NewReloader(certFile, keyFile, caFile string) (*Reloader, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("certificate and key files must be set together")
+	}
+
+	r := &Reloader{certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// HasCertificate reports whether the reloader serves a key pair
+func (r *Reloader) HasCertificate() bool {
+	return r.certFile != ""
+}
+
+// HasCA reports whether the reloader holds a CA bundle
+func (r *Reloader) HasCA() bool {
+	return r.caFile != ""
+}
+
+// Reload reads the files again. On failure the previously loaded
+// certificates stay in use.
+func (r *Reloader) Reload() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	var cert *tls.Certificate
+	if r.HasCertificate() {
+		pair, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("load key pair: %w", err)
+		}
+		cert = &pair
+	}
+
+	var pool *x509.CertPool
+	if r.HasCA() {
+		pem, err := os.ReadFile(r.caFile)
+		if err != nil {
+			return fmt.Errorf("read CA bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", r.caFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = cert
+	r.pool = pool
+	r.modTimes = modTimes
+	return nil
+}
+
+// Watch checks the files every interval and reloads them after a change,
+// until ctx is done. Failed reloads are logged and retried on the next
+// change.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				log.Printf("Failed to reload TLS certificates, keeping the current ones: %v", err)
+				continue
+			}
+			log.Println("Reloaded TLS certificates")
+		}
+	}
+}
+
+// files lists the files the reloader reads
+func (r *Reloader) files() []string {
+	var files []string
+	if r.HasCertificate() {
+		files = append(files, r.certFile, r.keyFile)
+	}
+	if r.HasCA() {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// changed reports whether a file was modified since the last reload
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			// Probably being replaced, look again on the next tick
+			continue
+		}
+		if !info.ModTime().Equal(r.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetCertificate returns the current key pair, for tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		return nil, errors.New("no certificate configured")
+	}
+	return r.cert, nil
+}
+
+// GetClientCertificate returns the current key pair, for
+// tls.Config.GetClientCertificate
+func (r *Reloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.cert == nil {
+		// An empty certificate tells the server we have none
+		return &tls.Certificate{}, nil
+	}
+	return r.cert, nil
+}
+
+// CAPool returns the current CA bundle, nil without one
+func (r *Reloader) CAPool() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.pool
+}
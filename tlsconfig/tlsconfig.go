@@ -0,0 +1,111 @@
+// Package tlsconfig builds the TLS configurations of the gRPC server, the Go
+// client and the HTTP gateway, with certificates that are reloaded from disk
+// when they change.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Server returns a server configuration serving the reloader's key pair.
+// When the reloader holds a CA bundle, clients must present a certificate
+// issued by it (mutual TLS). Client certificates are checked against the CA
+// bundle loaded at handshake time, so the bundle can be rotated too.
+func Server(r *Reloader) (*tls.Config, error) {
+	if !r.HasCertificate() {
+		return nil, errors.New("server TLS needs a certificate and key")
+	}
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+	}
+	if r.HasCA() {
+		// RequireAndVerifyClientCert would pin the pool for the lifetime of
+		// the config, so the chain is verified by hand instead
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			return verifyClientCertificate(r.CAPool(), rawCerts)
+		}
+	}
+	return cfg, nil
+}
+
+// verifyClientCertificate checks that the certificate chain sent by a client
+// leads to one of the roots and is meant for client authentication
+func verifyClientCertificate(roots *x509.CertPool, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return errors.New("client certificate required")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return fmt.Errorf("parse client certificate: %w", err)
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return fmt.Errorf("verify client certificate: %w", err)
+	}
+	return nil
+}
+
+// ClientFiles are the files a client uses to connect over TLS
+type ClientFiles struct {
+	// CA bundle used to verify the server, the system roots when empty
+	CAFile string
+	// Key pair presented to servers requiring mutual TLS, optional
+	CertFile string
+	KeyFile  string
+	// Name expected in the server certificate, the dialed host when empty
+	ServerName string
+}
+
+// Enabled reports whether any TLS setting is given
+func (f ClientFiles) Enabled() bool {
+	return f.CAFile != "" || f.CertFile != "" || f.KeyFile != "" || f.ServerName != ""
+}
+
+// ClientCredentials returns gRPC transport credentials for the files, or
+// plaintext credentials when no TLS setting is given. The client key pair is
+// reloaded whenever it changes on disk; the returned reloader is nil for
+// plaintext.
+func ClientCredentials(files ClientFiles) (credentials.TransportCredentials, *Reloader, error) {
+	if !files.Enabled() {
+		return insecure.NewCredentials(), nil, nil
+	}
+
+	r, err := NewReloader(files.CertFile, files.KeyFile, files.CAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: files.ServerName,
+		RootCAs:    r.CAPool(),
+	}
+	if r.HasCertificate() {
+		cfg.GetClientCertificate = r.GetClientCertificate
+	}
+	return credentials.NewTLS(cfg), r, nil
+}
@@ -0,0 +1,274 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate with its key, issued by a test CA or self-signed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert issues a certificate from the parent, self-signed when parent is
+// nil. Without extended key usages the certificate is a CA.
+func newTestCert(t *testing.T, name string, parent *testCert, usages ...x509.ExtKeyUsage) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("generate serial: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  usages,
+	}
+	if len(usages) == 0 {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	return pool
+}
+
+// write stores the certificate and key as PEM files in dir
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+"-key.pem")
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}))
+	writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+// writeFile writes a file and moves its modification time forward, so that
+// a rewrite within the file system's time resolution still counts as a change
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	var modTime time.Time
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+	if !modTime.IsZero() {
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("touch %s: %v", path, err)
+		}
+	}
+}
+
+func TestVerifyClientCertificate(t *testing.T) {
+	ca := newTestCert(t, "Test CA", nil)
+	intermediate := newTestCert(t, "Test Intermediate", ca)
+	otherCA := newTestCert(t, "Other CA", nil)
+
+	tests := []struct {
+		name    string
+		chain   []*testCert
+		wantErr bool
+	}{
+		{"client certificate", []*testCert{newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth)}, false},
+		{"any usage", []*testCert{newTestCert(t, "client", ca, x509.ExtKeyUsageAny)}, false},
+		{"no certificate", nil, true},
+		{"other CA", []*testCert{newTestCert(t, "client", otherCA, x509.ExtKeyUsageClientAuth)}, true},
+		{"self-signed", []*testCert{newTestCert(t, "client", nil, x509.ExtKeyUsageClientAuth)}, true},
+		{"server certificate", []*testCert{newTestCert(t, "client", ca, x509.ExtKeyUsageServerAuth)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var raw [][]byte
+			for _, c := range tt.chain {
+				raw = append(raw, c.cert.Raw)
+			}
+			err := verifyClientCertificate(ca.pool(), raw)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("verifyClientCertificate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	// Intermediates sent by the client complete the chain
+	leaf := newTestCert(t, "client", intermediate, x509.ExtKeyUsageClientAuth)
+	if err := verifyClientCertificate(ca.pool(), [][]byte{leaf.cert.Raw, intermediate.cert.Raw}); err != nil {
+		t.Errorf("chain through an intermediate: %v", err)
+	}
+	if err := verifyClientCertificate(ca.pool(), [][]byte{leaf.cert.Raw}); err == nil {
+		t.Error("chain missing its intermediate was accepted")
+	}
+}
+
+// handshake connects a client to a server over loopback and returns the
+// errors of both sides
+func handshake(t *testing.T, serverConfig, clientConfig *tls.Config) (serverErr, clientErr error) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		err = conn.(*tls.Conn).Handshake()
+		if err == nil {
+			// TLS 1.3 clients only learn about a rejected certificate on
+			// their first read
+			_, err = conn.Write([]byte{0})
+		}
+		done <- err
+	}()
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", listener.Addr().String(), clientConfig)
+	if err == nil {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	return <-done, err
+}
+
+func TestServerRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	certFile, keyFile := newTestCert(t, "localhost", ca, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	caFile, _ := ca.write(t, dir, "ca")
+
+	r, err := NewReloader(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	serverConfig, err := Server(r)
+	if err != nil {
+		t.Fatalf("Server() error = %v", err)
+	}
+
+	clientConfig := func(client *testCert) *tls.Config {
+		cfg := &tls.Config{ServerName: "localhost", RootCAs: ca.pool()}
+		if client != nil {
+			cfg.Certificates = []tls.Certificate{{Certificate: [][]byte{client.cert.Raw}, PrivateKey: client.key}}
+		}
+		return cfg
+	}
+
+	if serverErr, clientErr := handshake(t, serverConfig, clientConfig(newTestCert(t, "client", ca, x509.ExtKeyUsageClientAuth))); serverErr != nil || clientErr != nil {
+		t.Errorf("client with a certificate: server error %v, client error %v", serverErr, clientErr)
+	}
+	if serverErr, _ := handshake(t, serverConfig, clientConfig(nil)); serverErr == nil {
+		t.Error("client without a certificate was accepted")
+	}
+	if serverErr, _ := handshake(t, serverConfig, clientConfig(newTestCert(t, "client", newTestCert(t, "Other CA", nil), x509.ExtKeyUsageClientAuth))); serverErr == nil {
+		t.Error("client with a certificate from another CA was accepted")
+	}
+}
+
+func TestReloadKeepsKeyPairOnFailure(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil)
+	first := newTestCert(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := first.write(t, dir, "server")
+
+	r, err := NewReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatalf("NewReloader() error = %v", err)
+	}
+	serving := func() *x509.Certificate {
+		t.Helper()
+		cert, err := r.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate() error = %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatalf("parse served certificate: %v", err)
+		}
+		return leaf
+	}
+	if r.changed() {
+		t.Error("changed() right after loading")
+	}
+
+	// A certificate written without its new key does not match the old key
+	second := newTestCert(t, "localhost", ca, x509.ExtKeyUsageServerAuth)
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: second.cert.Raw}))
+	if !r.changed() {
+		t.Fatal("changed() missed the new certificate")
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload() accepted a certificate that does not match the key")
+	}
+	if !serving().Equal(first.cert) {
+		t.Error("a failed reload replaced the key pair")
+	}
+
+	writeFile(t, certFile, []byte("not a certificate"))
+	if err := r.Reload(); err == nil {
+		t.Fatal("Reload() accepted a broken certificate")
+	}
+	if !serving().Equal(first.cert) {
+		t.Error("a failed reload replaced the key pair")
+	}
+
+	second.write(t, dir, "server")
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload() of the new pair: %v", err)
+	}
+	if !serving().Equal(second.cert) {
+		t.Error("Reload() kept the old key pair")
+	}
+	if r.changed() {
+		t.Error("changed() right after reloading")
+	}
+}
@@ -2,8 +2,10 @@ package validation
 
 import (
 	"fmt"
+	"reflect"
 	"regexp"
 	"strings"
+	"unicode"
 
 	"github.com/go-playground/validator/v10"
 )
@@ -12,6 +14,13 @@ type Validator struct {
 	validate *validator.Validate
 }
 
+// FieldViolation describes a single field that failed validation
+type FieldViolation struct {
+	Field   string // path of the field, using its json (and proto) name
+	Rule    string // validation tag that failed, e.g. "min"
+	Message string
+}
+
 func NewValidator() *Validator {
 	v := validator.New()
 	
@@ -19,6 +28,15 @@ func NewValidator() *Validator {
 	v.RegisterValidation("alpha_space", validateAlphaSpace)
 	v.RegisterValidation("password_strength", validatePasswordStrength)
 	v.RegisterValidation("unique_email", validateUniqueEmail)
+
+	// Report fields by their json name, which matches the proto field name
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
 	
 	return &Validator{
 		validate: v,
@@ -30,6 +48,11 @@ func (v *Validator) ValidateStruct(s interface{}) error {
 	return v.validate.Struct(s)
 }
 
+// ValidateStructPartial validates only the named fields of a struct
+func (v *Validator) ValidateStructPartial(s interface{}, fields ...string) error {
+	return v.validate.StructPartial(s, fields...)
+}
+
 // ValidateVar validates a single field
 func (v *Validator) ValidateVar(field interface{}, tag string) error {
 	return v.validate.Var(field, tag)
@@ -86,6 +109,59 @@ func (v *Validator) GetValidationErrors(err error) []string {
 	return errors
 }
 
+// GetFieldViolations returns one violation per failing field
+func (v *Validator) GetFieldViolations(err error) []FieldViolation {
+	var violations []FieldViolation
+
+	if validationErrors, ok := err.(validator.ValidationErrors); ok {
+		for _, e := range validationErrors {
+			violations = append(violations, FieldViolation{
+				Field:   fieldPath(e),
+				Rule:    e.Tag(),
+				Message: formatValidationError(e),
+			})
+		}
+	}
+
+	return violations
+}
+
+// fieldPath returns the dotted path of a field relative to the validated
+// struct, e.g. "filter.min_age"
+func fieldPath(e validator.FieldError) string {
+	namespace := e.Namespace()
+	if i := strings.Index(namespace, "."); i >= 0 {
+		return namespace[i+1:]
+	}
+	return namespace
+}
+
+// isNumber reports whether min/max apply to a value rather than a length
+func isNumber(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// toSnakeCase converts a Go field name such as MinAge to min_age
+func toSnakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 // Format validation error messages
 func formatValidationError(e validator.FieldError) string {
 	field := strings.ToLower(e.Field())
@@ -96,11 +172,27 @@ func formatValidationError(e validator.FieldError) string {
 	case "email":
 		return fmt.Sprintf("%s must be a valid email address", field)
 	case "min":
+		if isNumber(e.Kind()) {
+			return fmt.Sprintf("%s must be at least %s", field, e.Param())
+		}
 		return fmt.Sprintf("%s must be at least %s characters", field, e.Param())
 	case "max":
+		if isNumber(e.Kind()) {
+			return fmt.Sprintf("%s must be at most %s", field, e.Param())
+		}
 		return fmt.Sprintf("%s must be at most %s characters", field, e.Param())
+	case "len":
+		return fmt.Sprintf("%s must be exactly %s characters", field, e.Param())
+	case "numeric":
+		return fmt.Sprintf("%s can only contain digits", field)
 	case "alpha_space":
 		return fmt.Sprintf("%s can only contain letters and spaces", field)
+	case "oneof":
+		return fmt.Sprintf("%s must be one of: %s", field, e.Param())
+	case "fqdn":
+		return fmt.Sprintf("%s must be a valid domain name", field)
+	case "gtefield":
+		return fmt.Sprintf("%s must be greater than or equal to %s", field, toSnakeCase(e.Param()))
 	case "password_strength":
 		return fmt.Sprintf("%s must contain at least 8 characters with uppercase, lowercase, number, and special character", field)
 	default: